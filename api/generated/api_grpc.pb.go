@@ -28,6 +28,18 @@ type DaemonClient interface {
 	CreateChat(ctx context.Context, in *ChatRequest, opts ...grpc.CallOption) (*empty.Empty, error)
 	DeleteChat(ctx context.Context, in *ChatRequest, opts ...grpc.CallOption) (*empty.Empty, error)
 	Send(ctx context.Context, opts ...grpc.CallOption) (Daemon_SendClient, error)
+	History(ctx context.Context, in *HistoryRequest, opts ...grpc.CallOption) (*HistoryResponse, error)
+	CreateRoom(ctx context.Context, in *CreateRoomRequest, opts ...grpc.CallOption) (*Room, error)
+	InviteToRoom(ctx context.Context, in *RoomInviteRequest, opts ...grpc.CallOption) (*empty.Empty, error)
+	LeaveRoom(ctx context.Context, in *RoomRequest, opts ...grpc.CallOption) (*empty.Empty, error)
+	ListRooms(ctx context.Context, in *empty.Empty, opts ...grpc.CallOption) (*RoomList, error)
+	WatchPresence(ctx context.Context, in *PresenceRequest, opts ...grpc.CallOption) (Daemon_WatchPresenceClient, error)
+	MarkRead(ctx context.Context, in *ReadRequest, opts ...grpc.CallOption) (*empty.Empty, error)
+	SendFile(ctx context.Context, in *SendFileRequest, opts ...grpc.CallOption) (Daemon_SendFileClient, error)
+	UploadFile(ctx context.Context, opts ...grpc.CallOption) (Daemon_UploadFileClient, error)
+	WatchFileOffers(ctx context.Context, in *empty.Empty, opts ...grpc.CallOption) (Daemon_WatchFileOffersClient, error)
+	AnswerFileOffer(ctx context.Context, in *FileAnswer, opts ...grpc.CallOption) (Daemon_AnswerFileOfferClient, error)
+	Status(ctx context.Context, in *empty.Empty, opts ...grpc.CallOption) (*StatusResponse, error)
 }
 
 type daemonClient struct {
@@ -84,8 +96,8 @@ func (c *daemonClient) Send(ctx context.Context, opts ...grpc.CallOption) (Daemo
 }
 
 type Daemon_SendClient interface {
-	Send(*ChatMessage) error
-	Recv() (*ChatMessage, error)
+	Send(*ChatInput) error
+	Recv() (*ChatEvent, error)
 	grpc.ClientStream
 }
 
@@ -93,18 +105,240 @@ type daemonSendClient struct {
 	grpc.ClientStream
 }
 
-func (x *daemonSendClient) Send(m *ChatMessage) error {
+func (x *daemonSendClient) Send(m *ChatInput) error {
 	return x.ClientStream.SendMsg(m)
 }
 
-func (x *daemonSendClient) Recv() (*ChatMessage, error) {
-	m := new(ChatMessage)
+func (x *daemonSendClient) Recv() (*ChatEvent, error) {
+	m := new(ChatEvent)
 	if err := x.ClientStream.RecvMsg(m); err != nil {
 		return nil, err
 	}
 	return m, nil
 }
 
+func (c *daemonClient) History(ctx context.Context, in *HistoryRequest, opts ...grpc.CallOption) (*HistoryResponse, error) {
+	out := new(HistoryResponse)
+	err := c.cc.Invoke(ctx, "/api.Daemon/History", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *daemonClient) CreateRoom(ctx context.Context, in *CreateRoomRequest, opts ...grpc.CallOption) (*Room, error) {
+	out := new(Room)
+	err := c.cc.Invoke(ctx, "/api.Daemon/CreateRoom", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *daemonClient) InviteToRoom(ctx context.Context, in *RoomInviteRequest, opts ...grpc.CallOption) (*empty.Empty, error) {
+	out := new(empty.Empty)
+	err := c.cc.Invoke(ctx, "/api.Daemon/InviteToRoom", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *daemonClient) LeaveRoom(ctx context.Context, in *RoomRequest, opts ...grpc.CallOption) (*empty.Empty, error) {
+	out := new(empty.Empty)
+	err := c.cc.Invoke(ctx, "/api.Daemon/LeaveRoom", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *daemonClient) ListRooms(ctx context.Context, in *empty.Empty, opts ...grpc.CallOption) (*RoomList, error) {
+	out := new(RoomList)
+	err := c.cc.Invoke(ctx, "/api.Daemon/ListRooms", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *daemonClient) WatchPresence(ctx context.Context, in *PresenceRequest, opts ...grpc.CallOption) (Daemon_WatchPresenceClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Daemon_ServiceDesc.Streams[1], "/api.Daemon/WatchPresence", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &daemonWatchPresenceClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Daemon_WatchPresenceClient interface {
+	Recv() (*PresenceEvent, error)
+	grpc.ClientStream
+}
+
+type daemonWatchPresenceClient struct {
+	grpc.ClientStream
+}
+
+func (x *daemonWatchPresenceClient) Recv() (*PresenceEvent, error) {
+	m := new(PresenceEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *daemonClient) MarkRead(ctx context.Context, in *ReadRequest, opts ...grpc.CallOption) (*empty.Empty, error) {
+	out := new(empty.Empty)
+	err := c.cc.Invoke(ctx, "/api.Daemon/MarkRead", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *daemonClient) SendFile(ctx context.Context, in *SendFileRequest, opts ...grpc.CallOption) (Daemon_SendFileClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Daemon_ServiceDesc.Streams[2], "/api.Daemon/SendFile", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &daemonSendFileClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Daemon_SendFileClient interface {
+	Recv() (*FileProgress, error)
+	grpc.ClientStream
+}
+
+type daemonSendFileClient struct {
+	grpc.ClientStream
+}
+
+func (x *daemonSendFileClient) Recv() (*FileProgress, error) {
+	m := new(FileProgress)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *daemonClient) UploadFile(ctx context.Context, opts ...grpc.CallOption) (Daemon_UploadFileClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Daemon_ServiceDesc.Streams[3], "/api.Daemon/UploadFile", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &daemonUploadFileClient{stream}
+	return x, nil
+}
+
+type Daemon_UploadFileClient interface {
+	Send(*FileUpload) error
+	Recv() (*FileProgress, error)
+	grpc.ClientStream
+}
+
+type daemonUploadFileClient struct {
+	grpc.ClientStream
+}
+
+func (x *daemonUploadFileClient) Send(m *FileUpload) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *daemonUploadFileClient) Recv() (*FileProgress, error) {
+	m := new(FileProgress)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *daemonClient) WatchFileOffers(ctx context.Context, in *empty.Empty, opts ...grpc.CallOption) (Daemon_WatchFileOffersClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Daemon_ServiceDesc.Streams[4], "/api.Daemon/WatchFileOffers", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &daemonWatchFileOffersClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Daemon_WatchFileOffersClient interface {
+	Recv() (*FileOffer, error)
+	grpc.ClientStream
+}
+
+type daemonWatchFileOffersClient struct {
+	grpc.ClientStream
+}
+
+func (x *daemonWatchFileOffersClient) Recv() (*FileOffer, error) {
+	m := new(FileOffer)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *daemonClient) AnswerFileOffer(ctx context.Context, in *FileAnswer, opts ...grpc.CallOption) (Daemon_AnswerFileOfferClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Daemon_ServiceDesc.Streams[5], "/api.Daemon/AnswerFileOffer", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &daemonAnswerFileOfferClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Daemon_AnswerFileOfferClient interface {
+	Recv() (*FileProgress, error)
+	grpc.ClientStream
+}
+
+type daemonAnswerFileOfferClient struct {
+	grpc.ClientStream
+}
+
+func (x *daemonAnswerFileOfferClient) Recv() (*FileProgress, error) {
+	m := new(FileProgress)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *daemonClient) Status(ctx context.Context, in *empty.Empty, opts ...grpc.CallOption) (*StatusResponse, error) {
+	out := new(StatusResponse)
+	err := c.cc.Invoke(ctx, "/api.Daemon/Status", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // DaemonServer is the server API for Daemon service.
 // All implementations must embed UnimplementedDaemonServer
 // for forward compatibility
@@ -114,6 +348,18 @@ type DaemonServer interface {
 	CreateChat(context.Context, *ChatRequest) (*empty.Empty, error)
 	DeleteChat(context.Context, *ChatRequest) (*empty.Empty, error)
 	Send(Daemon_SendServer) error
+	History(context.Context, *HistoryRequest) (*HistoryResponse, error)
+	CreateRoom(context.Context, *CreateRoomRequest) (*Room, error)
+	InviteToRoom(context.Context, *RoomInviteRequest) (*empty.Empty, error)
+	LeaveRoom(context.Context, *RoomRequest) (*empty.Empty, error)
+	ListRooms(context.Context, *empty.Empty) (*RoomList, error)
+	WatchPresence(*PresenceRequest, Daemon_WatchPresenceServer) error
+	MarkRead(context.Context, *ReadRequest) (*empty.Empty, error)
+	SendFile(*SendFileRequest, Daemon_SendFileServer) error
+	UploadFile(Daemon_UploadFileServer) error
+	WatchFileOffers(*empty.Empty, Daemon_WatchFileOffersServer) error
+	AnswerFileOffer(*FileAnswer, Daemon_AnswerFileOfferServer) error
+	Status(context.Context, *empty.Empty) (*StatusResponse, error)
 	mustEmbedUnimplementedDaemonServer()
 }
 
@@ -136,6 +382,42 @@ func (UnimplementedDaemonServer) DeleteChat(context.Context, *ChatRequest) (*emp
 func (UnimplementedDaemonServer) Send(Daemon_SendServer) error {
 	return status.Errorf(codes.Unimplemented, "method Send not implemented")
 }
+func (UnimplementedDaemonServer) History(context.Context, *HistoryRequest) (*HistoryResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method History not implemented")
+}
+func (UnimplementedDaemonServer) CreateRoom(context.Context, *CreateRoomRequest) (*Room, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateRoom not implemented")
+}
+func (UnimplementedDaemonServer) InviteToRoom(context.Context, *RoomInviteRequest) (*empty.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method InviteToRoom not implemented")
+}
+func (UnimplementedDaemonServer) LeaveRoom(context.Context, *RoomRequest) (*empty.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method LeaveRoom not implemented")
+}
+func (UnimplementedDaemonServer) ListRooms(context.Context, *empty.Empty) (*RoomList, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListRooms not implemented")
+}
+func (UnimplementedDaemonServer) WatchPresence(*PresenceRequest, Daemon_WatchPresenceServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchPresence not implemented")
+}
+func (UnimplementedDaemonServer) MarkRead(context.Context, *ReadRequest) (*empty.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method MarkRead not implemented")
+}
+func (UnimplementedDaemonServer) SendFile(*SendFileRequest, Daemon_SendFileServer) error {
+	return status.Errorf(codes.Unimplemented, "method SendFile not implemented")
+}
+func (UnimplementedDaemonServer) UploadFile(Daemon_UploadFileServer) error {
+	return status.Errorf(codes.Unimplemented, "method UploadFile not implemented")
+}
+func (UnimplementedDaemonServer) WatchFileOffers(*empty.Empty, Daemon_WatchFileOffersServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchFileOffers not implemented")
+}
+func (UnimplementedDaemonServer) AnswerFileOffer(*FileAnswer, Daemon_AnswerFileOfferServer) error {
+	return status.Errorf(codes.Unimplemented, "method AnswerFileOffer not implemented")
+}
+func (UnimplementedDaemonServer) Status(context.Context, *empty.Empty) (*StatusResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Status not implemented")
+}
 func (UnimplementedDaemonServer) mustEmbedUnimplementedDaemonServer() {}
 
 // UnsafeDaemonServer may be embedded to opt out of forward compatibility for this service.
@@ -226,8 +508,8 @@ func _Daemon_Send_Handler(srv interface{}, stream grpc.ServerStream) error {
 }
 
 type Daemon_SendServer interface {
-	Send(*ChatMessage) error
-	Recv() (*ChatMessage, error)
+	Send(*ChatEvent) error
+	Recv() (*ChatInput, error)
 	grpc.ServerStream
 }
 
@@ -235,18 +517,254 @@ type daemonSendServer struct {
 	grpc.ServerStream
 }
 
-func (x *daemonSendServer) Send(m *ChatMessage) error {
+func (x *daemonSendServer) Send(m *ChatEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *daemonSendServer) Recv() (*ChatInput, error) {
+	m := new(ChatInput)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _Daemon_History_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(HistoryRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DaemonServer).History(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/api.Daemon/History",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DaemonServer).History(ctx, req.(*HistoryRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Daemon_CreateRoom_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateRoomRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DaemonServer).CreateRoom(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/api.Daemon/CreateRoom",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DaemonServer).CreateRoom(ctx, req.(*CreateRoomRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Daemon_InviteToRoom_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RoomInviteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DaemonServer).InviteToRoom(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/api.Daemon/InviteToRoom",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DaemonServer).InviteToRoom(ctx, req.(*RoomInviteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Daemon_LeaveRoom_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RoomRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DaemonServer).LeaveRoom(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/api.Daemon/LeaveRoom",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DaemonServer).LeaveRoom(ctx, req.(*RoomRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Daemon_ListRooms_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(empty.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DaemonServer).ListRooms(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/api.Daemon/ListRooms",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DaemonServer).ListRooms(ctx, req.(*empty.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Daemon_WatchPresence_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(PresenceRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(DaemonServer).WatchPresence(m, &daemonWatchPresenceServer{stream})
+}
+
+type Daemon_WatchPresenceServer interface {
+	Send(*PresenceEvent) error
+	grpc.ServerStream
+}
+
+type daemonWatchPresenceServer struct {
+	grpc.ServerStream
+}
+
+func (x *daemonWatchPresenceServer) Send(m *PresenceEvent) error {
 	return x.ServerStream.SendMsg(m)
 }
 
-func (x *daemonSendServer) Recv() (*ChatMessage, error) {
-	m := new(ChatMessage)
+func _Daemon_MarkRead_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReadRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DaemonServer).MarkRead(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/api.Daemon/MarkRead",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DaemonServer).MarkRead(ctx, req.(*ReadRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Daemon_SendFile_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SendFileRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(DaemonServer).SendFile(m, &daemonSendFileServer{stream})
+}
+
+type Daemon_SendFileServer interface {
+	Send(*FileProgress) error
+	grpc.ServerStream
+}
+
+type daemonSendFileServer struct {
+	grpc.ServerStream
+}
+
+func (x *daemonSendFileServer) Send(m *FileProgress) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Daemon_UploadFile_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(DaemonServer).UploadFile(&daemonUploadFileServer{stream})
+}
+
+type Daemon_UploadFileServer interface {
+	Send(*FileProgress) error
+	Recv() (*FileUpload, error)
+	grpc.ServerStream
+}
+
+type daemonUploadFileServer struct {
+	grpc.ServerStream
+}
+
+func (x *daemonUploadFileServer) Send(m *FileProgress) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *daemonUploadFileServer) Recv() (*FileUpload, error) {
+	m := new(FileUpload)
 	if err := x.ServerStream.RecvMsg(m); err != nil {
 		return nil, err
 	}
 	return m, nil
 }
 
+func _Daemon_WatchFileOffers_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(empty.Empty)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(DaemonServer).WatchFileOffers(m, &daemonWatchFileOffersServer{stream})
+}
+
+type Daemon_WatchFileOffersServer interface {
+	Send(*FileOffer) error
+	grpc.ServerStream
+}
+
+type daemonWatchFileOffersServer struct {
+	grpc.ServerStream
+}
+
+func (x *daemonWatchFileOffersServer) Send(m *FileOffer) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Daemon_AnswerFileOffer_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(FileAnswer)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(DaemonServer).AnswerFileOffer(m, &daemonAnswerFileOfferServer{stream})
+}
+
+type Daemon_AnswerFileOfferServer interface {
+	Send(*FileProgress) error
+	grpc.ServerStream
+}
+
+type daemonAnswerFileOfferServer struct {
+	grpc.ServerStream
+}
+
+func (x *daemonAnswerFileOfferServer) Send(m *FileProgress) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Daemon_Status_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(empty.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DaemonServer).Status(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/api.Daemon/Status",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DaemonServer).Status(ctx, req.(*empty.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // Daemon_ServiceDesc is the grpc.ServiceDesc for Daemon service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -270,6 +788,34 @@ var Daemon_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "DeleteChat",
 			Handler:    _Daemon_DeleteChat_Handler,
 		},
+		{
+			MethodName: "History",
+			Handler:    _Daemon_History_Handler,
+		},
+		{
+			MethodName: "CreateRoom",
+			Handler:    _Daemon_CreateRoom_Handler,
+		},
+		{
+			MethodName: "InviteToRoom",
+			Handler:    _Daemon_InviteToRoom_Handler,
+		},
+		{
+			MethodName: "LeaveRoom",
+			Handler:    _Daemon_LeaveRoom_Handler,
+		},
+		{
+			MethodName: "ListRooms",
+			Handler:    _Daemon_ListRooms_Handler,
+		},
+		{
+			MethodName: "MarkRead",
+			Handler:    _Daemon_MarkRead_Handler,
+		},
+		{
+			MethodName: "Status",
+			Handler:    _Daemon_Status_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
@@ -278,6 +824,32 @@ var Daemon_ServiceDesc = grpc.ServiceDesc{
 			ServerStreams: true,
 			ClientStreams: true,
 		},
+		{
+			StreamName:    "WatchPresence",
+			Handler:       _Daemon_WatchPresence_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "SendFile",
+			Handler:       _Daemon_SendFile_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "UploadFile",
+			Handler:       _Daemon_UploadFile_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "WatchFileOffers",
+			Handler:       _Daemon_WatchFileOffers_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "AnswerFileOffer",
+			Handler:       _Daemon_AnswerFileOffer_Handler,
+			ServerStreams: true,
+		},
 	},
 	Metadata: "api.proto",
 }
@@ -1,21 +1,20 @@
 package main
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
+	"github.com/aaletov/nats-chat/pkg/logger"
 	"github.com/aaletov/nats-chat/pkg/natscli"
-	nested "github.com/antonfisher/nested-logrus-formatter"
+	"github.com/aaletov/nats-chat/pkg/profile"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
 )
 
 func main() {
-	logger := logrus.New()
-	logger.SetFormatter(&nested.Formatter{
-		HideKeys:    true,
-		FieldsOrder: []string{"component", "method"},
-	})
+	logger := logger.NewDefaultLogger()
 
 	var (
 		err     error
@@ -30,17 +29,66 @@ func main() {
 	app := cli.App{
 		Name:  "nats-chat",
 		Usage: "Chat using nats",
+		Before: func(cCtx *cli.Context) error {
+			return configureLogger(cCtx, logger)
+		},
 		Action: func(cCtx *cli.Context) error {
 			cli.ShowAppHelpAndExit(cCtx, 0)
 			return nil
 		},
-		Flags: []cli.Flag{
+		Flags: append([]cli.Flag{
 			&cli.StringFlag{
 				Name:     "log",
-				Usage:    "Where to put log file",
+				Usage:    "Log file, stderr if empty",
 				Required: false,
 			},
-		},
+			&cli.StringFlag{
+				Name:  "log-level",
+				Usage: "One of trace, debug, info, warn, error",
+				Value: "info",
+			},
+			&cli.StringFlag{
+				Name:  "log-format",
+				Usage: "text or json",
+				Value: "text",
+			},
+			&cli.StringFlag{
+				Name:     "contacts",
+				Usage:    "Path to the contact book",
+				Required: false,
+				Value:    filepath.Join(natsDir, "contacts.json"),
+			},
+			&cli.StringFlag{
+				Name:    "socket",
+				Usage:   "Path of the daemon socket",
+				EnvVars: []string{"NATS_CHAT_SOCKET"},
+				Value:   filepath.Join(natsDir, "socket", "natschat.sock"),
+			},
+			&cli.StringFlag{
+				Name:    "daemon-addr",
+				Usage:   "TCP address of a remote daemon, used instead of the socket",
+				EnvVars: []string{"NATS_CHAT_DAEMON_ADDR"},
+			},
+			&cli.StringFlag{
+				Name:    "daemon-cert",
+				Usage:   "Client certificate for the remote daemon",
+				EnvVars: []string{"NATS_CHAT_DAEMON_CERT"},
+			},
+			&cli.StringFlag{
+				Name:    "daemon-key",
+				Usage:   "Key of the client certificate",
+				EnvVars: []string{"NATS_CHAT_DAEMON_KEY"},
+			},
+			&cli.StringFlag{
+				Name:    "daemon-ca",
+				Usage:   "CA of the remote daemon certificate, the system roots if empty",
+				EnvVars: []string{"NATS_CHAT_DAEMON_CA"},
+			},
+			&cli.IntFlag{
+				Name:  "passphrase-fd",
+				Usage: "Read passphrases from the file descriptor, one per line, instead of " + natscli.PassphraseEnv + " or the terminal",
+			},
+		}, rotationFlags()...),
 		Commands: []*cli.Command{
 			{
 				Name:  "generate",
@@ -52,6 +100,11 @@ func main() {
 						Required: false,
 						Value:    natsDir,
 					},
+					&cli.StringFlag{
+						Name:  "type",
+						Usage: "Type of the key, rsa or ed25519",
+						Value: string(profile.KeyTypeRSA),
+					},
 				},
 				Action: natscli.NewGenerateHandler(logger),
 			},
@@ -69,6 +122,25 @@ func main() {
 				Before: natscli.CheckProfileDir,
 				Action: natscli.NewAddressHandler(logger),
 			},
+			{
+				Name:  "rotate",
+				Usage: "Replace the key pair, the old key signs the new address for contacts",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "profile",
+						Usage:    "Profile to use",
+						Required: false,
+						Value:    natsDir,
+					},
+					&cli.StringFlag{
+						Name:  "type",
+						Usage: "Type of the new key, ed25519 or rsa",
+						Value: string(profile.KeyTypeEd25519),
+					},
+				},
+				Before: natscli.CheckProfileDir,
+				Action: natscli.NewRotateHandler(logger),
+			},
 			{
 				Name:  "online",
 				Usage: "Go online",
@@ -81,11 +153,65 @@ func main() {
 					},
 					&cli.StringFlag{
 						Name:     "nats-url",
-						Usage:    "URL of nats instance",
-						Required: true,
+						Usage:    "URL of nats instance, the daemon default if empty",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:  "jetstream",
+						Usage: "Keep messages in a jetstream inbox while offline",
+					},
+					&cli.StringFlag{
+						Name:  "downloads",
+						Usage: "Directory for received files, ~/.natschat/downloads by default",
+					},
+					&cli.StringFlag{
+						Name:  "nats-user",
+						Usage: "User to authenticate to nats",
+					},
+					&cli.StringFlag{
+						Name:  "nats-password-file",
+						Usage: "File with the password of --nats-user",
+					},
+					&cli.StringFlag{
+						Name:  "nats-token-file",
+						Usage: "File with the token to authenticate to nats",
+					},
+					&cli.StringFlag{
+						Name:  "nats-nkey",
+						Usage: "File with the NKey seed to authenticate to nats",
+					},
+					&cli.StringFlag{
+						Name:  "nats-creds",
+						Usage: "JWT credentials file to authenticate to nats",
+					},
+					&cli.StringFlag{
+						Name:  "tls-cert",
+						Usage: "Client certificate for nats",
+					},
+					&cli.StringFlag{
+						Name:  "tls-key",
+						Usage: "Key of the client certificate",
+					},
+					&cli.StringFlag{
+						Name:  "tls-ca",
+						Usage: "CA of the nats server certificate",
+					},
+					&cli.IntFlag{
+						Name:  "max-reconnects",
+						Usage: "Attempts to reconnect to nats after an outage, negative is unlimited",
+						Value: -1,
+					},
+					&cli.DurationFlag{
+						Name:  "reconnect-wait",
+						Usage: "Delay between attempts to reconnect to nats",
+						Value: 2 * time.Second,
+					},
+					&cli.IntFlag{
+						Name:  "reconnect-buffer",
+						Usage: "Bytes of outgoing messages buffered while reconnecting, 0 is the nats default",
 					},
 				},
-				Before: natscli.CheckProfileDir,
+				Before: natscli.CheckOnlineProfileDir,
 				Action: natscli.NewOnlineHandler(logger),
 			},
 			{
@@ -93,13 +219,18 @@ func main() {
 				Usage:  "Go offline",
 				Action: natscli.NewOfflineHandler(logger),
 			},
+			{
+				Name:   "status",
+				Usage:  "Show state of the daemon, its nats connection and chats",
+				Action: natscli.NewStatusHandler(logger),
+			},
 			{
 				Name:  "createchat",
 				Usage: "Start a chat",
 				Flags: []cli.Flag{
 					&cli.StringFlag{
 						Name:     "recepient",
-						Usage:    "Address of the recepient",
+						Usage:    "Contact name or address of the recepient",
 						Required: true,
 					},
 				},
@@ -111,21 +242,255 @@ func main() {
 				Flags: []cli.Flag{
 					&cli.StringFlag{
 						Name:     "recepient",
-						Usage:    "Address of the recepient",
+						Usage:    "Contact name or address of the recepient",
 						Required: true,
 					},
 				},
 				Action: natscli.NewRmChatHandler(logger),
 			},
 			{
-				Name:   "openchat",
-				Usage:  "Open chat",
+				Name:  "openchat",
+				Usage: "Open chat or room",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "recepient",
+						Usage: "Contact name or address of the recepient",
+					},
+					&cli.StringFlag{
+						Name:  "room",
+						Usage: "Id of the room",
+					},
+					&cli.UintFlag{
+						Name:  "history",
+						Usage: "Number of previous messages to show",
+						Value: 20,
+					},
+				},
 				Action: natscli.NewOpenChatHandler(logger),
 			},
+			{
+				Name:  "createroom",
+				Usage: "Create a room",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "name",
+						Usage:    "Name of the room",
+						Required: false,
+					},
+				},
+				Action: natscli.NewCreateRoomHandler(logger),
+			},
+			{
+				Name:  "invite",
+				Usage: "Invite member to a room",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "room",
+						Usage:    "Id of the room",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "member",
+						Usage:    "Contact name or address of the member",
+						Required: true,
+					},
+				},
+				Action: natscli.NewInviteHandler(logger),
+			},
+			{
+				Name:  "leaveroom",
+				Usage: "Leave a room",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "room",
+						Usage:    "Id of the room",
+						Required: true,
+					},
+				},
+				Action: natscli.NewLeaveRoomHandler(logger),
+			},
+			{
+				Name:      "who",
+				Usage:     "Show which contacts are online",
+				ArgsUsage: "[contact or address...]",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "watch",
+						Usage: "Keep printing presence changes",
+					},
+					&cli.DurationFlag{
+						Name:  "wait",
+						Usage: "How long to wait for heartbeats without --watch",
+						Value: 2 * time.Second,
+					},
+				},
+				Action: natscli.NewWhoHandler(logger),
+			},
+			{
+				Name:  "profile",
+				Usage: "Manage the profile",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "passwd",
+						Usage: "Change the passphrase of the private key, " + natscli.NewPassphraseEnv + " is read for the new one",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "profile",
+								Usage:    "Path to the nats-chat profile",
+								Required: false,
+								Value:    natsDir,
+							},
+						},
+						Before: natscli.CheckProfileDir,
+						Action: natscli.NewPasswdHandler(logger),
+					},
+					{
+						Name:      "export",
+						Usage:     "Export the keys and contacts to an archive encrypted with " + natscli.ArchivePassphraseEnv,
+						ArgsUsage: "<archive>",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "profile",
+								Usage:    "Path to the nats-chat profile",
+								Required: false,
+								Value:    natsDir,
+							},
+						},
+						Before: natscli.CheckProfileDir,
+						Action: natscli.NewExportHandler(logger),
+					},
+					{
+						Name:      "import",
+						Usage:     "Restore the keys and contacts from an archive made by export",
+						ArgsUsage: "<archive>",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "profile",
+								Usage:    "Path to the nats-chat profile",
+								Required: false,
+								Value:    natsDir,
+							},
+						},
+						Action: natscli.NewImportHandler(logger),
+					},
+				},
+			},
+			{
+				Name:  "contact",
+				Usage: "Manage contacts",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "add",
+						Usage: "Add contact",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "name",
+								Usage:    "Name of the contact",
+								Required: true,
+							},
+							&cli.StringFlag{
+								Name:     "address",
+								Usage:    "Address of the contact",
+								Required: true,
+							},
+							&cli.StringFlag{
+								Name:     "key",
+								Usage:    "Public key of the contact to pin",
+								Required: false,
+							},
+						},
+						Action: natscli.NewContactAddHandler(logger),
+					},
+					{
+						Name:   "list",
+						Usage:  "List contacts",
+						Action: natscli.NewContactListHandler(logger),
+					},
+					{
+						Name:  "rm",
+						Usage: "Remove contact",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "name",
+								Usage:    "Name of the contact",
+								Required: true,
+							},
+						},
+						Action: natscli.NewContactRmHandler(logger),
+					},
+					{
+						Name:  "rename",
+						Usage: "Rename contact",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "name",
+								Usage:    "Name of the contact",
+								Required: true,
+							},
+							&cli.StringFlag{
+								Name:     "to",
+								Usage:    "New name of the contact",
+								Required: true,
+							},
+						},
+						Action: natscli.NewContactRenameHandler(logger),
+					},
+				},
+			},
+			{
+				Name:   "rooms",
+				Usage:  "List rooms",
+				Action: natscli.NewRoomsHandler(logger),
+			},
+			{
+				Name:      "sendfile",
+				Usage:     "Send a file",
+				ArgsUsage: "<path>",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "recepient",
+						Usage:    "Contact name or address of the recepient",
+						Required: true,
+					},
+				},
+				Action: natscli.NewSendFileHandler(logger),
+			},
+			{
+				Name:  "receive",
+				Usage: "Accept or reject offered files",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "yes",
+						Usage: "Accept every offer without prompting",
+					},
+				},
+				Action: natscli.NewReceiveHandler(logger),
+			},
 		},
 	}
 
 	if err := app.Run(os.Args); err != nil {
+		// The error is shown on the terminal when the log goes to a file
+		if logger.Out != os.Stderr {
+			fmt.Fprintln(os.Stderr, err)
+		}
 		logger.Fatal(err)
 	}
 }
+
+func rotationFlags() []cli.Flag {
+	var flags []cli.Flag
+	for _, flag := range logger.RotationFlags() {
+		flags = append(flags, flag)
+	}
+	return flags
+}
+
+func configureLogger(cCtx *cli.Context, ll *logrus.Logger) error {
+	if path := cCtx.String("log"); path != "" {
+		if err := logger.SetFile(ll, path, logger.RotationOf(cCtx)); err != nil {
+			return err
+		}
+	}
+	return logger.Configure(ll, cCtx.String("log-level"), cCtx.String("log-format"))
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	api "github.com/aaletov/nats-chat/api/generated"
+	"github.com/aaletov/nats-chat/pkg/logger"
+	"github.com/aaletov/nats-chat/pkg/natsdaemon"
+	"github.com/aaletov/nats-chat/pkg/tracing"
+	"github.com/urfave/cli/v2"
+	"github.com/urfave/cli/v2/altsrc"
+)
+
+// Settings which are read again from the config file on SIGHUP, the socket and
+// the data directory need a restart
+var reloadable = []string{
+	"log-level", "log-format", "nats-url", "nats-user", "nats-password-file",
+	"nats-token-file", "nats-nkey", "nats-creds", "tls-cert", "tls-key", "tls-ca",
+	"connect-timeout", "dial-timeout", "outage-timeout",
+}
+
+func envOf(name string) []string {
+	return []string{"NATS_CHAT_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))}
+}
+
+func stringFlag(name string, usage string, value string) cli.Flag {
+	return altsrc.NewStringFlag(&cli.StringFlag{
+		Name:    name,
+		Usage:   usage,
+		Value:   value,
+		EnvVars: envOf(name),
+	})
+}
+
+func durationFlag(name string, usage string, value time.Duration) cli.Flag {
+	return altsrc.NewDurationFlag(&cli.DurationFlag{
+		Name:    name,
+		Usage:   usage,
+		Value:   value,
+		EnvVars: envOf(name),
+	})
+}
+
+func intFlag(name string, usage string, value int) cli.Flag {
+	return altsrc.NewIntFlag(&cli.IntFlag{
+		Name:    name,
+		Usage:   usage,
+		Value:   value,
+		EnvVars: envOf(name),
+	})
+}
+
+// rotationFlags are the log rotation flags shared with the client, read from
+// the environment and the config file as well
+func rotationFlags() []cli.Flag {
+	var flags []cli.Flag
+	for _, flag := range logger.RotationFlags() {
+		flag.EnvVars = envOf(flag.Name)
+		flags = append(flags, altsrc.NewIntFlag(flag))
+	}
+	return flags
+}
+
+func daemonFlags(natsDir string) []cli.Flag {
+	flags := []cli.Flag{
+		&cli.StringFlag{
+			Name:    "config",
+			Usage:   "YAML or TOML config file, keys are names of the flags (default: daemon.yaml in the data directory)",
+			EnvVars: envOf("config"),
+		},
+		stringFlag("data-dir", "Directory of the daemon data", natsDir),
+		stringFlag("socket", "Path of the daemon socket (default: socket/natschat.sock in the data directory)", ""),
+		stringFlag("listen", "TCP address to serve remote clients with mutual TLS, disabled if empty", ""),
+		stringFlag("listen-cert", "Certificate of the TCP listener", ""),
+		stringFlag("listen-key", "Key of the TCP listener certificate", ""),
+		stringFlag("client-ca", "CA of the remote client certificates", ""),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:    "allow-client",
+			Usage:   "Common name or SHA-256 fingerprint of a client certificate allowed to connect over TCP, any client certificate signed by the CA if unset",
+			EnvVars: envOf("allow-client"),
+		}),
+		stringFlag("metrics-listen", "TCP address to serve Prometheus metrics at /metrics over HTTP, disabled if empty", ""),
+		stringFlag("trace-exporter", "Exporter of OpenTelemetry spans: none, stdout or otlp", tracing.ExporterNone),
+		stringFlag("trace-endpoint", "OTLP/HTTP traces endpoint of the otlp exporter", tracing.DefaultOTLPEndpoint),
+		stringFlag("log-level", "One of trace, debug, info, warn, error", "info"),
+		stringFlag("log-format", "text or json", "text"),
+		stringFlag("log", "Log file, stderr if empty", ""),
+		stringFlag("nats-url", "URL of nats instance if online does not set it", ""),
+		stringFlag("nats-user", "User of the nats server if online sets no credentials", ""),
+		stringFlag("nats-password-file", "File with the password of the nats user", ""),
+		stringFlag("nats-token-file", "File with the token of the nats server", ""),
+		stringFlag("nats-nkey", "File with the nkey seed of the nats user", ""),
+		stringFlag("nats-creds", "JWT .creds file of the nats user", ""),
+		stringFlag("tls-cert", "Client certificate for nats", ""),
+		stringFlag("tls-key", "Key of the client certificate", ""),
+		stringFlag("tls-ca", "CA of the nats server certificate", ""),
+		durationFlag("connect-timeout", "Timeout of connecting to the nats server", natsdaemon.DefaultConnectTimeout),
+		durationFlag("dial-timeout", "Timeout of dialing a peer, 0 waits until it answers", 0),
+		durationFlag("outage-timeout", "How long sending to an inbox waits for the nats connection to come back", natsdaemon.DefaultOutageTimeout),
+	}
+	return append(flags, rotationFlags()...)
+}
+
+// flagDefaults returns the values of flags before they are parsed
+func flagDefaults(flags []cli.Flag) map[string]string {
+	defaults := make(map[string]string)
+	for _, flag := range flags {
+		if f, ok := flag.(cli.DocGenerationFlag); ok {
+			defaults[flag.Names()[0]] = f.GetValue()
+		}
+	}
+	return defaults
+}
+
+func configPath(cCtx *cli.Context) string {
+	if cCtx.IsSet("config") {
+		return cCtx.String("config")
+	}
+	return filepath.Join(cCtx.String("data-dir"), "daemon.yaml")
+}
+
+// readConfigFile parses the config file by its extension, missing default
+// file is empty
+func readConfigFile(cCtx *cli.Context) (altsrc.InputSourceContext, error) {
+	path := configPath(cCtx)
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) && !cCtx.IsSet("config") {
+		return altsrc.NewMapInputSource(path, map[interface{}]interface{}{}), nil
+	}
+	var (
+		err    error
+		source altsrc.InputSourceContext
+	)
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		source, err = altsrc.NewTomlSourceFromFile(path)
+	} else {
+		source, err = altsrc.NewYamlSourceFromFile(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading config: %s", err)
+	}
+	return source, nil
+}
+
+// settings are the reloadable settings resolved from flags, env and the
+// config file
+type settings struct {
+	logLevel  string
+	logFormat string
+	config    natsdaemon.Config
+}
+
+func newSettings(value func(name string) string) (settings, error) {
+	s := settings{
+		logLevel:  value("log-level"),
+		logFormat: value("log-format"),
+		config: natsdaemon.Config{
+			NatsUrl: value("nats-url"),
+			Credentials: &api.NatsCredentials{
+				User:         value("nats-user"),
+				PasswordFile: value("nats-password-file"),
+				TokenFile:    value("nats-token-file"),
+				NkeySeedFile: value("nats-nkey"),
+				CredsFile:    value("nats-creds"),
+				TlsCertFile:  value("tls-cert"),
+				TlsKeyFile:   value("tls-key"),
+				TlsCaFile:    value("tls-ca"),
+			},
+		},
+	}
+	for name, timeout := range map[string]*time.Duration{
+		"connect-timeout": &s.config.ConnectTimeout,
+		"dial-timeout":    &s.config.DialTimeout,
+		"outage-timeout":  &s.config.OutageTimeout,
+	} {
+		var err error
+		if *timeout, err = time.ParseDuration(value(name)); err != nil {
+			return settings{}, fmt.Errorf("invalid %s: %s", name, err)
+		}
+	}
+	return s, nil
+}
+
+// configLoader resolves settings with flags over env over the config file
+type configLoader struct {
+	defaults map[string]string
+	// explicit are the flags set on the command line or by env
+	explicit map[string]bool
+}
+
+func newConfigLoader(flags []cli.Flag) *configLoader {
+	return &configLoader{
+		defaults: flagDefaults(flags),
+		explicit: make(map[string]bool),
+	}
+}
+
+// Before applies the config file to the flags not set explicitly
+func (l *configLoader) Before(cCtx *cli.Context) error {
+	for _, flag := range cCtx.App.Flags {
+		if name := flag.Names()[0]; cCtx.IsSet(name) {
+			l.explicit[name] = true
+		}
+	}
+	source, err := readConfigFile(cCtx)
+	if err != nil {
+		return err
+	}
+	return altsrc.ApplyInputSourceValues(cCtx, source, cCtx.App.Flags)
+}
+
+// Load returns the settings parsed at start
+func (l *configLoader) Load(cCtx *cli.Context) (settings, error) {
+	return newSettings(cCtx.String)
+}
+
+// Reload reads the config file again, flags set explicitly keep their values
+// and settings removed from the file return to defaults
+func (l *configLoader) Reload(cCtx *cli.Context) (settings, error) {
+	source, err := readConfigFile(cCtx)
+	if err != nil {
+		return settings{}, err
+	}
+	values := make(map[string]string)
+	for _, name := range reloadable {
+		switch {
+		case l.explicit[name]:
+			values[name] = cCtx.String(name)
+		case strings.HasSuffix(name, "-timeout"):
+			var timeout time.Duration
+			if timeout, err = source.Duration(name); err != nil {
+				return settings{}, fmt.Errorf("error reading config: %s", err)
+			}
+			values[name] = l.defaults[name]
+			if timeout != 0 {
+				values[name] = timeout.String()
+			}
+		default:
+			var value string
+			if value, err = source.String(name); err != nil {
+				return settings{}, fmt.Errorf("error reading config: %s", err)
+			}
+			values[name] = l.defaults[name]
+			if value != "" {
+				values[name] = value
+			}
+		}
+	}
+	return newSettings(func(name string) string { return values[name] })
+}
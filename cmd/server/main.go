@@ -1,22 +1,27 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"net"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"syscall"
+	"time"
 
 	api "github.com/aaletov/nats-chat/api/generated"
 	"github.com/aaletov/nats-chat/pkg/logger"
+	"github.com/aaletov/nats-chat/pkg/metrics"
 	"github.com/aaletov/nats-chat/pkg/natsdaemon"
+	"github.com/aaletov/nats-chat/pkg/tracing"
 	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
 	"google.golang.org/grpc"
 )
 
 func main() {
 	logger := logger.NewDefaultLogger()
-	logger.SetLevel(logrus.DebugLevel)
 
 	var (
 		homeDir string
@@ -26,44 +31,156 @@ func main() {
 	if homeDir, err = os.UserHomeDir(); err != nil {
 		logger.Fatalf("Unable to get user's home directory: %s", err)
 	}
-	natsDir := filepath.Join(homeDir, ".natschat")
+	flags := daemonFlags(filepath.Join(homeDir, ".natschat"))
+	loader := newConfigLoader(flags)
+
+	app := cli.App{
+		Name:   "nats-chat-daemon",
+		Usage:  "Daemon of nats-chat",
+		Flags:  flags,
+		Before: loader.Before,
+		Action: func(cCtx *cli.Context) error {
+			return serve(cCtx, logger, loader)
+		},
+	}
+	if err = app.Run(os.Args); err != nil {
+		logger.Fatal(err)
+	}
+}
+
+func serve(cCtx *cli.Context, ll *logrus.Logger, loader *configLoader) error {
+	var (
+		err  error
+		conf settings
+	)
+	if conf, err = loader.Load(cCtx); err != nil {
+		return err
+	}
+	if path := cCtx.String("log"); path != "" {
+		if err = logger.SetFile(ll, path, logger.RotationOf(cCtx)); err != nil {
+			return err
+		}
+	}
+	if err = logger.Configure(ll, conf.logLevel, conf.logFormat); err != nil {
+		return err
+	}
+
+	var shutdownTracing func(context.Context) error
+	if shutdownTracing, err = tracing.Setup(cCtx.String("trace-exporter"), cCtx.String("trace-endpoint"), "nats-chat-daemon", natsdaemon.Version); err != nil {
+		return err
+	}
+	// Deferred to flush the spans after the daemon is shut down
+	logrus.DeferExitHandler(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdownTracing(ctx)
+	})
+
+	natsDir := cCtx.String("data-dir")
 	if _, err := os.Stat(natsDir); (err != nil) && (os.IsNotExist(err)) {
 		if err := os.Mkdir(natsDir, 0700); err != nil {
-			logger.Fatalf("error when create profile directory: %s", err)
+			return fmt.Errorf("error when create profile directory: %s", err)
 		}
 	}
 
-	socketDir := filepath.Join(natsDir, "socket")
+	SOCKET := cCtx.String("socket")
+	if SOCKET == "" {
+		SOCKET = filepath.Join(natsDir, "socket", "natschat.sock")
+	}
+	socketDir := filepath.Dir(SOCKET)
 	if _, err := os.Stat(socketDir); (err != nil) && (os.IsNotExist(err)) {
-		if err := os.Mkdir(socketDir, 0700); err != nil {
-			logger.Fatalf("error when create socket directory: %s", err)
+		if err := os.MkdirAll(socketDir, 0700); err != nil {
+			return fmt.Errorf("error when create socket directory: %s", err)
 		}
 	}
 
 	PROTOCOL := "unix"
-	SOCKET := filepath.Join(socketDir, "natschat.sock")
-
 	lis, err := net.Listen(PROTOCOL, SOCKET)
 	if err != nil {
-		logger.Fatalf("failed to listen: %v", err)
+		return fmt.Errorf("failed to listen: %v", err)
 	}
 
-	c := make(chan os.Signal)
-	signal.Notify(c, os.Interrupt, os.Kill, syscall.SIGTERM)
-	go func() {
-		logger.Fatalf("Got signal: %s", <-c)
-	}()
-
-	daemonServer := natsdaemon.NewDaemon(logger)
+	daemonServer, err := natsdaemon.NewDaemon(ll, natsDir, conf.config)
+	if err != nil {
+		lis.Close()
+		return fmt.Errorf("failed to initialize daemon: %v", err)
+	}
 	logrus.RegisterExitHandler(func() {
 		lis.Close()
 		daemonServer.Shutdown()
 	})
-	s := grpc.NewServer()
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, os.Kill, syscall.SIGTERM)
+	go func() {
+		ll.Fatalf("Got signal: %s", <-c)
+	}()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reloaded, err := loader.Reload(cCtx)
+			if err == nil {
+				err = logger.Configure(ll, reloaded.logLevel, reloaded.logFormat)
+			}
+			if err != nil {
+				ll.Errorf("Unable to reload config: %s", err)
+				continue
+			}
+			daemonServer.Configure(reloaded.config)
+			ll.Printf("Reloaded config %s", configPath(cCtx))
+		}
+	}()
+
+	errs := make(chan error, 3)
+	if cCtx.String("metrics-listen") != "" {
+		var metricsServer *metrics.Server
+		if metricsServer, err = metrics.Listen(cCtx.String("metrics-listen")); err != nil {
+			return err
+		}
+		logrus.RegisterExitHandler(func() {
+			metricsServer.Shutdown()
+		})
+		ll.Printf("metrics listening at http://%v/metrics", metricsServer.Addr())
+		go func() { errs <- metricsServer.Serve() }()
+	}
+	if cCtx.String("listen") != "" {
+		var remote *grpc.Server
+		if remote, err = newRemoteServer(cCtx, ll); err != nil {
+			return err
+		}
+		api.RegisterDaemonServer(remote, daemonServer)
+		var tcpLis net.Listener
+		if tcpLis, err = net.Listen("tcp", cCtx.String("listen")); err != nil {
+			return fmt.Errorf("failed to listen: %v", err)
+		}
+		ll.Printf("server listening at %v with mutual TLS", tcpLis.Addr())
+		go func() { errs <- remote.Serve(tcpLis) }()
+	}
+
+	s := grpc.NewServer(grpc.StreamInterceptor(metrics.StreamInterceptor))
 	api.RegisterDaemonServer(s, daemonServer)
 
-	logger.Printf("server listening at %v", lis.Addr())
-	if err := s.Serve(lis); err != nil {
-		logger.Fatalf("failed to serve: %v", err)
+	ll.Printf("server listening at %v", lis.Addr())
+	go func() { errs <- s.Serve(lis) }()
+	if err := <-errs; err != nil {
+		return fmt.Errorf("failed to serve: %v", err)
+	}
+	return nil
+}
+
+// newRemoteServer returns the server of remote clients, which are authorized
+// by their certificates
+func newRemoteServer(cCtx *cli.Context, ll *logrus.Logger) (*grpc.Server, error) {
+	creds, err := natsdaemon.ServerCredentials(cCtx.String("listen-cert"), cCtx.String("listen-key"), cCtx.String("client-ca"))
+	if err != nil {
+		return nil, err
 	}
+	authorizer := natsdaemon.NewClientAuthorizer(ll, cCtx.StringSlice("allow-client"))
+	return grpc.NewServer(
+		grpc.Creds(creds),
+		grpc.UnaryInterceptor(authorizer.UnaryInterceptor),
+		grpc.ChainStreamInterceptor(authorizer.StreamInterceptor, metrics.StreamInterceptor),
+	), nil
 }
@@ -0,0 +1,331 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aaletov/nats-chat/pkg/contacts"
+	"github.com/aaletov/nats-chat/pkg/profile"
+)
+
+// The archive is a PEM block of archiveType sealed with profile.SealBlock,
+// which authenticates its Version header. Its data is a gzipped tar of the
+// manifest, the profile directory under profileDir and the contact book.
+const (
+	archiveType  = "NATS-CHAT PROFILE ARCHIVE"
+	Version      = 1
+	manifestName = "manifest.json"
+	profileDir   = "profile"
+	contactsName = "contacts.json"
+	rotationsDir = "rotations"
+)
+
+var ErrExists = errors.New("profile already exists")
+
+type Manifest struct {
+	Version int             `json:"version"`
+	Created time.Time       `json:"created"`
+	Address string          `json:"address"`
+	KeyType profile.KeyType `json:"key_type"`
+	// Files are hex SHA-256 checksums of the archived files by their names
+	Files map[string]string `json:"files"`
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// profileFiles lists the key pairs and the rotation statements of the profile,
+// other files of the directory are data of the daemon
+func profileFiles(profilePath string) ([]string, error) {
+	var names []string
+	for _, pattern := range []string{"*.pem", filepath.Join(rotationsDir, "*.pb")} {
+		matches, err := filepath.Glob(filepath.Join(profilePath, pattern))
+		if err != nil {
+			return nil, fmt.Errorf("error listing profile: %s", err)
+		}
+		for _, match := range matches {
+			name, _ := filepath.Rel(profilePath, match)
+			names = append(names, filepath.ToSlash(name))
+		}
+	}
+	return names, nil
+}
+
+// Export writes the archive of the profile and the contact book encrypted with
+// passphrase, senderProfile is the profile read from profilePath
+func Export(w io.Writer, profilePath string, contactsPath string, senderProfile profile.Profile, passphrase []byte) error {
+	if len(passphrase) == 0 {
+		return errors.New("archive passphrase is empty")
+	}
+	var (
+		err   error
+		names []string
+		data  []byte
+	)
+	if names, err = profileFiles(profilePath); err != nil {
+		return err
+	}
+	files := make(map[string][]byte)
+	for _, name := range names {
+		if data, err = os.ReadFile(filepath.Join(profilePath, filepath.FromSlash(name))); err != nil {
+			return fmt.Errorf("error reading profile: %s", err)
+		}
+		files[path.Join(profileDir, name)] = data
+	}
+	if data, err = os.ReadFile(contactsPath); err == nil {
+		files[contactsName] = data
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("error reading contacts: %s", err)
+	}
+
+	manifest := Manifest{
+		Version: Version,
+		Created: time.Now().UTC(),
+		Address: senderProfile.GetAddress(),
+		KeyType: senderProfile.GetKeyType(),
+		Files:   make(map[string]string),
+	}
+	for name, data := range files {
+		manifest.Files[name] = checksum(data)
+	}
+	if data, err = json.MarshalIndent(manifest, "", "  "); err != nil {
+		return fmt.Errorf("error marshalling manifest: %s", err)
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	write := func(name string, data []byte) error {
+		header := &tar.Header{
+			Name:    name,
+			Mode:    0600,
+			Size:    int64(len(data)),
+			ModTime: manifest.Created,
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return fmt.Errorf("error writing archive: %s", err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			return fmt.Errorf("error writing archive: %s", err)
+		}
+		return nil
+	}
+	if err = write(manifestName, data); err != nil {
+		return err
+	}
+	names = names[:0]
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err = write(name, files[name]); err != nil {
+			return err
+		}
+	}
+	if err = tw.Close(); err != nil {
+		return fmt.Errorf("error writing archive: %s", err)
+	}
+	if err = gz.Close(); err != nil {
+		return fmt.Errorf("error compressing archive: %s", err)
+	}
+
+	var block *pem.Block
+	headers := map[string]string{"Version": strconv.Itoa(Version)}
+	if block, err = profile.SealBlock(archiveType, headers, buf.Bytes(), passphrase); err != nil {
+		return err
+	}
+	if err = pem.Encode(w, block); err != nil {
+		return fmt.Errorf("error encoding archive: %s", err)
+	}
+	return nil
+}
+
+// validName reports whether the archived file may be restored
+func validName(name string) bool {
+	if (name == manifestName) || (name == contactsName) {
+		return true
+	}
+	rel := strings.TrimPrefix(name, profileDir+"/")
+	if (rel == name) || (path.Clean(rel) != rel) {
+		return false
+	}
+	dir, base := path.Split(rel)
+	if dir == "" {
+		return path.Ext(base) == ".pem"
+	}
+	return (dir == rotationsDir+"/") && (path.Ext(base) == ".pb")
+}
+
+// Read decrypts the archive and checks the files against the manifest
+func Read(r io.Reader, passphrase []byte) (*Manifest, map[string][]byte, error) {
+	var (
+		err  error
+		data []byte
+		gz   *gzip.Reader
+	)
+	if data, err = io.ReadAll(r); err != nil {
+		return nil, nil, fmt.Errorf("error reading archive: %s", err)
+	}
+	block, _ := pem.Decode(data)
+	if (block == nil) || (block.Type != archiveType) {
+		return nil, nil, errors.New("not a profile archive")
+	}
+	if version, _ := strconv.Atoi(block.Headers["Version"]); version != Version {
+		return nil, nil, fmt.Errorf("unsupported archive version: %q", block.Headers["Version"])
+	}
+	if data, err = profile.OpenBlock(block, passphrase); err != nil {
+		return nil, nil, fmt.Errorf("error decrypting archive: %w", err)
+	}
+
+	if gz, err = gzip.NewReader(bytes.NewReader(data)); err != nil {
+		return nil, nil, fmt.Errorf("error decompressing archive: %s", err)
+	}
+	files := make(map[string][]byte)
+	tr := tar.NewReader(gz)
+	for {
+		var header *tar.Header
+		if header, err = tr.Next(); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("error reading archive: %s", err)
+		}
+		if !validName(header.Name) {
+			return nil, nil, fmt.Errorf("unexpected file in archive: %s", header.Name)
+		}
+		if _, ok := files[header.Name]; ok {
+			return nil, nil, fmt.Errorf("duplicate file in archive: %s", header.Name)
+		}
+		if files[header.Name], err = io.ReadAll(tr); err != nil {
+			return nil, nil, fmt.Errorf("error reading archive: %s", err)
+		}
+	}
+
+	manifest := &Manifest{}
+	if data, ok := files[manifestName]; !ok {
+		return nil, nil, errors.New("archive has no manifest")
+	} else if err = json.Unmarshal(data, manifest); err != nil {
+		return nil, nil, fmt.Errorf("error parsing manifest: %s", err)
+	}
+	delete(files, manifestName)
+	if manifest.Version != Version {
+		return nil, nil, fmt.Errorf("unsupported manifest version: %d", manifest.Version)
+	}
+	if len(files) != len(manifest.Files) {
+		return nil, nil, errors.New("archive does not match its manifest")
+	}
+	for name, data := range files {
+		if sum, ok := manifest.Files[name]; !ok || (sum != checksum(data)) {
+			return nil, nil, fmt.Errorf("checksum mismatch: %s", name)
+		}
+	}
+	for _, name := range []string{"private.pem", "public.pem"} {
+		if _, ok := files[path.Join(profileDir, name)]; !ok {
+			return nil, nil, fmt.Errorf("archive has no %s", name)
+		}
+	}
+	return manifest, files, nil
+}
+
+func writeFiles(dir string, files map[string][]byte) error {
+	for name, data := range files {
+		rel, ok := strings.CutPrefix(name, profileDir+"/")
+		if !ok {
+			continue
+		}
+		filePath := filepath.Join(dir, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(filePath), 0700); err != nil {
+			return fmt.Errorf("error creating profile directory: %s", err)
+		}
+		if err := os.WriteFile(filePath, data, 0600); err != nil {
+			return fmt.Errorf("error writing profile: %s", err)
+		}
+	}
+	return nil
+}
+
+// Import restores the archive to profilePath and contactsPath, which must not
+// hold a profile and a contact book yet. The key is read with passphrase and
+// has to yield the address from the manifest.
+func Import(r io.Reader, profilePath string, contactsPath string, archivePassphrase []byte, passphrase profile.PassphraseFunc) (*Manifest, error) {
+	var (
+		err      error
+		manifest *Manifest
+		files    map[string][]byte
+		staging  string
+		restored profile.Profile
+	)
+	if manifest, files, err = Read(r, archivePassphrase); err != nil {
+		return nil, err
+	}
+	if _, err = os.Stat(filepath.Join(profilePath, "private.pem")); err == nil {
+		return nil, fmt.Errorf("%w: %s", ErrExists, profilePath)
+	}
+	_, hasContacts := files[contactsName]
+	if _, err = os.Stat(contactsPath); hasContacts && (err == nil) {
+		return nil, fmt.Errorf("contacts already exist: %s", contactsPath)
+	}
+
+	if err = os.MkdirAll(profilePath, 0700); err != nil {
+		return nil, fmt.Errorf("error creating profile directory: %s", err)
+	}
+	if staging, err = os.MkdirTemp(profilePath, ".import-"); err != nil {
+		return nil, fmt.Errorf("error creating staging directory: %s", err)
+	}
+	defer os.RemoveAll(staging)
+	if err = writeFiles(staging, files); err != nil {
+		return nil, err
+	}
+	if restored, err = profile.ReadProfile(staging, passphrase); err != nil {
+		return nil, err
+	}
+	// Archives made before addresses were checksummed record the legacy one
+	if !profile.BelongsTo(restored.GetPublicKey(), manifest.Address) {
+		return nil, fmt.Errorf("key of the archive yields %s instead of %s", restored.GetAddress(), manifest.Address)
+	}
+	var publicKey crypto.PublicKey
+	if publicKey, err = profile.ReadPublicKey(filepath.Join(staging, "public.pem")); err != nil {
+		return nil, err
+	}
+	if !profile.BelongsTo(publicKey, manifest.Address) {
+		return nil, fmt.Errorf("public key of the archive does not belong to %s", manifest.Address)
+	}
+	manifest.Address = restored.GetAddress()
+	if hasContacts {
+		stagedContacts := filepath.Join(staging, contactsName)
+		if err = os.WriteFile(stagedContacts, files[contactsName], 0600); err != nil {
+			return nil, fmt.Errorf("error writing contacts: %s", err)
+		}
+		if _, err = contacts.Open(stagedContacts); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = writeFiles(profilePath, files); err != nil {
+		return nil, err
+	}
+	if hasContacts {
+		if err = os.WriteFile(contactsPath, files[contactsName], 0600); err != nil {
+			return nil, fmt.Errorf("error writing contacts: %s", err)
+		}
+	}
+	return manifest, nil
+}
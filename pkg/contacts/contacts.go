@@ -0,0 +1,178 @@
+package contacts
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/aaletov/nats-chat/pkg/profile"
+)
+
+var (
+	ErrNotFound = errors.New("contact not found")
+	ErrExists   = errors.New("contact already exists")
+)
+
+type Contact struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	// PublicKey is the public key of the contact encoded by
+	// profile.MarshalPublicKey, the daemon refuses to chat with the address if
+	// it presents another key
+	PublicKey []byte `json:"public_key,omitempty"`
+}
+
+type Book struct {
+	path     string
+	contacts map[string]Contact
+}
+
+// Open reads the contact book from path, missing file is an empty book
+func Open(path string) (*Book, error) {
+	b := &Book{
+		path:     path,
+		contacts: make(map[string]Contact),
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading contacts: %s", err)
+	}
+	var contacts []Contact
+	if err = json.Unmarshal(data, &contacts); err != nil {
+		return nil, fmt.Errorf("error parsing contacts: %s", err)
+	}
+	for _, contact := range contacts {
+		b.contacts[contact.Name] = contact
+	}
+	return b, nil
+}
+
+func (b *Book) Save() error {
+	data, err := json.MarshalIndent(b.List(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshalling contacts: %s", err)
+	}
+	if err = os.WriteFile(b.path, data, 0600); err != nil {
+		return fmt.Errorf("error writing contacts: %s", err)
+	}
+	return nil
+}
+
+// List returns contacts sorted by name
+func (b *Book) List() []Contact {
+	contacts := make([]Contact, 0, len(b.contacts))
+	for _, contact := range b.contacts {
+		contacts = append(contacts, contact)
+	}
+	sort.Slice(contacts, func(i, j int) bool {
+		return contacts[i].Name < contacts[j].Name
+	})
+	return contacts
+}
+
+func (b *Book) Add(name string, address string, publicKey crypto.PublicKey) error {
+	if name == "" {
+		return errors.New("contact name is empty")
+	}
+	if _, ok := b.contacts[name]; ok {
+		return fmt.Errorf("%w: %s", ErrExists, name)
+	}
+	if err := profile.ValidateAddress(address); err != nil {
+		return err
+	}
+	contact := Contact{
+		Name:    name,
+		Address: address,
+	}
+	if publicKey != nil {
+		if !profile.BelongsTo(publicKey, address) {
+			return fmt.Errorf("public key does not belong to %s", address)
+		}
+		// The key gives the current address of a legacy one
+		actual, err := profile.AddressOf(publicKey)
+		if err != nil {
+			return err
+		}
+		contact.Address = actual
+		contact.PublicKey = profile.MarshalPublicKey(publicKey)
+	}
+	b.contacts[name] = contact
+	return nil
+}
+
+func (b *Book) Remove(name string) error {
+	if _, ok := b.contacts[name]; !ok {
+		return fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	delete(b.contacts, name)
+	return nil
+}
+
+func (b *Book) Rename(name string, newName string) error {
+	contact, ok := b.contacts[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	if newName == "" {
+		return errors.New("contact name is empty")
+	}
+	if _, ok = b.contacts[newName]; ok {
+		return fmt.Errorf("%w: %s", ErrExists, newName)
+	}
+	delete(b.contacts, name)
+	contact.Name = newName
+	b.contacts[newName] = contact
+	return nil
+}
+
+// Move updates contacts at oldAddress, or at the legacy address of oldKey,
+// after its owner rotated oldKey to newKey, it fails if any of them is pinned
+// to another key. It returns names of the moved contacts.
+func (b *Book) Move(oldAddress string, oldKey crypto.PublicKey, newAddress string, newKey crypto.PublicKey) ([]string, error) {
+	legacyAddress, _ := profile.LegacyAddressOf(oldKey)
+	var moved []string
+	for _, contact := range b.List() {
+		if (contact.Address != oldAddress) && (contact.Address != legacyAddress) {
+			continue
+		}
+		if contact.PublicKey != nil {
+			if !bytes.Equal(contact.PublicKey, profile.MarshalPublicKey(oldKey)) {
+				return nil, fmt.Errorf("%s is pinned to another key than the rotated one", contact.Name)
+			}
+			contact.PublicKey = profile.MarshalPublicKey(newKey)
+		}
+		contact.Address = newAddress
+		b.contacts[contact.Name] = contact
+		moved = append(moved, contact.Name)
+	}
+	return moved, nil
+}
+
+// Resolve returns the contact named nameOrAddress, otherwise nameOrAddress is
+// treated as a raw address
+func (b *Book) Resolve(nameOrAddress string) (Contact, error) {
+	if contact, ok := b.contacts[nameOrAddress]; ok {
+		return contact, nil
+	}
+	if err := profile.ValidateAddress(nameOrAddress); err != nil {
+		return Contact{}, fmt.Errorf("%s is not a contact: %w", nameOrAddress, err)
+	}
+	return Contact{Address: nameOrAddress}, nil
+}
+
+// NameOf returns name of the contact with address or the address itself
+func (b *Book) NameOf(address string) string {
+	for _, contact := range b.List() {
+		if contact.Address == address {
+			return contact.Name
+		}
+	}
+	return address
+}
@@ -0,0 +1,264 @@
+package envelope
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"filippo.io/edwards25519"
+	api "github.com/aaletov/nats-chat/api/generated"
+	"github.com/aaletov/nats-chat/pkg/profile"
+)
+
+const keySize = 32
+
+const (
+	messageContext      = "nats-chat-message"
+	keyAgreementContext = "nats-chat-x25519"
+)
+
+var label = []byte("nats-chat")
+
+// Kind of a signed payload, it is signed along with the payload, so a payload
+// sent as one kind is not accepted as another
+type Kind string
+
+const (
+	KindMessage Kind = "message"
+	KindReceipt Kind = "receipt"
+	KindTyping  Kind = "typing"
+	KindFile    Kind = "file"
+	KindChunk   Kind = "chunk"
+	KindRoom    Kind = "room"
+)
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	var (
+		err   error
+		block cipher.Block
+	)
+	if block, err = aes.NewCipher(key); err != nil {
+		return nil, fmt.Errorf("error creating cipher: %s", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// x25519PublicKey converts the Ed25519 key to X25519 for key agreement, keys
+// which are not valid Edwards points are rejected
+func x25519PublicKey(publicKey ed25519.PublicKey) (*ecdh.PublicKey, error) {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid ed25519 key size: %d", len(publicKey))
+	}
+	point, err := new(edwards25519.Point).SetBytes(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ed25519 key: %s", err)
+	}
+	return ecdh.X25519().NewPublicKey(point.BytesMontgomery())
+}
+
+func x25519PrivateKey(privateKey ed25519.PrivateKey) (*ecdh.PrivateKey, error) {
+	h := sha512.Sum512(privateKey.Seed())
+	return ecdh.X25519().NewPrivateKey(h[:32])
+}
+
+// wrapKey encrypts the message key to publicKey. RSA keys wrap it with
+// RSA-OAEP, for Ed25519 keys the wrapped key is an ephemeral X25519 key the
+// message key is agreed with.
+func wrapKey(publicKey crypto.PublicKey) (key []byte, wrappedKey []byte, err error) {
+	switch publicKey := publicKey.(type) {
+	case *rsa.PublicKey:
+		key = make([]byte, keySize)
+		if _, err = io.ReadFull(rand.Reader, key); err != nil {
+			return nil, nil, fmt.Errorf("error generating message key: %s", err)
+		}
+		if wrappedKey, err = rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKey, key, label); err != nil {
+			return nil, nil, fmt.Errorf("error encrypting message key: %s", err)
+		}
+		return key, wrappedKey, nil
+	case ed25519.PublicKey:
+		var (
+			recepient *ecdh.PublicKey
+			ephemeral *ecdh.PrivateKey
+			shared    []byte
+		)
+		if recepient, err = x25519PublicKey(publicKey); err != nil {
+			return nil, nil, err
+		}
+		if ephemeral, err = ecdh.X25519().GenerateKey(rand.Reader); err != nil {
+			return nil, nil, fmt.Errorf("error generating ephemeral key: %s", err)
+		}
+		if shared, err = ephemeral.ECDH(recepient); err != nil {
+			return nil, nil, fmt.Errorf("error agreeing message key: %s", err)
+		}
+		wrappedKey = ephemeral.PublicKey().Bytes()
+		return digest(keyAgreementContext, shared, wrappedKey, recepient.Bytes()), wrappedKey, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported key type: %T", publicKey)
+}
+
+func unwrapKey(privateKey crypto.Signer, wrappedKey []byte) ([]byte, error) {
+	switch privateKey := privateKey.(type) {
+	case *rsa.PrivateKey:
+		key, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, privateKey, wrappedKey, label)
+		if err != nil {
+			return nil, fmt.Errorf("error decrypting message key: %s", err)
+		}
+		return key, nil
+	case ed25519.PrivateKey:
+		var (
+			err       error
+			recepient *ecdh.PrivateKey
+			ephemeral *ecdh.PublicKey
+			shared    []byte
+		)
+		if recepient, err = x25519PrivateKey(privateKey); err != nil {
+			return nil, err
+		}
+		if ephemeral, err = ecdh.X25519().NewPublicKey(wrappedKey); err != nil {
+			return nil, fmt.Errorf("invalid ephemeral key: %s", err)
+		}
+		if shared, err = recepient.ECDH(ephemeral); err != nil {
+			return nil, fmt.Errorf("error agreeing message key: %s", err)
+		}
+		return digest(keyAgreementContext, shared, wrappedKey, recepient.PublicKey().Bytes()), nil
+	}
+	return nil, fmt.Errorf("unsupported key type: %T", privateKey)
+}
+
+func Seal(publicKey crypto.PublicKey, plaintext []byte) (*api.NatsEncrypted, error) {
+	var (
+		err        error
+		gcm        cipher.AEAD
+		key        []byte
+		wrappedKey []byte
+	)
+
+	if key, wrappedKey, err = wrapKey(publicKey); err != nil {
+		return nil, err
+	}
+	if gcm, err = newGCM(key); err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("error generating nonce: %s", err)
+	}
+
+	return &api.NatsEncrypted{
+		Key:        wrappedKey,
+		Nonce:      nonce,
+		Ciphertext: gcm.Seal(nil, nonce, plaintext, nil),
+	}, nil
+}
+
+func Open(privateKey crypto.Signer, emsg *api.NatsEncrypted) ([]byte, error) {
+	var (
+		err       error
+		gcm       cipher.AEAD
+		key       []byte
+		plaintext []byte
+	)
+
+	if key, err = unwrapKey(privateKey, emsg.Key); err != nil {
+		return nil, err
+	}
+	if gcm, err = newGCM(key); err != nil {
+		return nil, err
+	}
+	if len(emsg.Nonce) != gcm.NonceSize() {
+		return nil, fmt.Errorf("invalid nonce size: %d", len(emsg.Nonce))
+	}
+	if plaintext, err = gcm.Open(nil, emsg.Nonce, emsg.Ciphertext, nil); err != nil {
+		return nil, fmt.Errorf("error decrypting message: %s", err)
+	}
+	return plaintext, nil
+}
+
+func digest(context string, parts ...[]byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(context))
+	for _, part := range parts {
+		var size [4]byte
+		binary.BigEndian.PutUint32(size[:], uint32(len(part)))
+		h.Write(size[:])
+		h.Write(part)
+	}
+	return h.Sum(nil)
+}
+
+// SignData signs the digest of parts with RSA-PSS or Ed25519
+func SignData(privateKey crypto.Signer, context string, parts ...[]byte) ([]byte, error) {
+	var (
+		err       error
+		signature []byte
+	)
+	switch privateKey := privateKey.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPSS(rand.Reader, privateKey, crypto.SHA256, digest(context, parts...), nil)
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(privateKey, digest(context, parts...))
+	default:
+		err = fmt.Errorf("unsupported key type: %T", privateKey)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error signing data: %s", err)
+	}
+	return signature, nil
+}
+
+func VerifyData(publicKey crypto.PublicKey, signature []byte, context string, parts ...[]byte) error {
+	switch publicKey := publicKey.(type) {
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPSS(publicKey, crypto.SHA256, digest(context, parts...), signature, nil); err != nil {
+			return fmt.Errorf("invalid signature: %s", err)
+		}
+		return nil
+	case ed25519.PublicKey:
+		if !ed25519.Verify(publicKey, digest(context, parts...), signature) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported key type: %T", publicKey)
+}
+
+// Sign signs payload of kind for recepient
+func Sign(privateKey crypto.Signer, kind Kind, recepient string, payload []byte) (*api.NatsSigned, error) {
+	var (
+		err       error
+		signature []byte
+	)
+	if signature, err = SignData(privateKey, messageContext, []byte(kind), []byte(recepient), payload); err != nil {
+		return nil, err
+	}
+	return &api.NatsSigned{
+		Payload:   payload,
+		PublicKey: profile.MarshalPublicKey(privateKey.Public()),
+		Signature: signature,
+	}, nil
+}
+
+// Verify checks that smsg is a payload of kind signed for recepient and
+// returns the key of the signer
+func Verify(smsg *api.NatsSigned, kind Kind, recepient string) (crypto.PublicKey, error) {
+	var (
+		err       error
+		publicKey crypto.PublicKey
+	)
+	if publicKey, err = profile.ParsePublicKey(smsg.PublicKey); err != nil {
+		return nil, err
+	}
+	if err = VerifyData(publicKey, smsg.Signature, messageContext, []byte(kind), []byte(recepient), smsg.Payload); err != nil {
+		return nil, err
+	}
+	return publicKey, nil
+}
@@ -0,0 +1,160 @@
+package envelope
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"testing"
+
+	api "github.com/aaletov/nats-chat/api/generated"
+	"github.com/aaletov/nats-chat/pkg/profile"
+)
+
+var keyTypes = []profile.KeyType{profile.KeyTypeRSA, profile.KeyTypeEd25519}
+
+func generateKey(t *testing.T, keyType profile.KeyType) crypto.Signer {
+	t.Helper()
+	privateKey, err := profile.GenerateKey(keyType)
+	if err != nil {
+		t.Fatalf("error generating %s key: %s", keyType, err)
+	}
+	return privateKey
+}
+
+func TestSignVerify(t *testing.T) {
+	for _, keyType := range keyTypes {
+		privateKey := generateKey(t, keyType)
+		otherKey := generateKey(t, keyType)
+		tests := []struct {
+			name   string
+			tamper func(smsg *api.NatsSigned) (Kind, string)
+			valid  bool
+		}{
+			{
+				name:   "round trip",
+				tamper: func(smsg *api.NatsSigned) (Kind, string) { return KindMessage, "bob" },
+				valid:  true,
+			},
+			{
+				name: "tampered payload",
+				tamper: func(smsg *api.NatsSigned) (Kind, string) {
+					smsg.Payload[0] ^= 1
+					return KindMessage, "bob"
+				},
+			},
+			{
+				name:   "other kind",
+				tamper: func(smsg *api.NatsSigned) (Kind, string) { return KindReceipt, "bob" },
+			},
+			{
+				name:   "other recepient",
+				tamper: func(smsg *api.NatsSigned) (Kind, string) { return KindMessage, "carol" },
+			},
+			{
+				name: "other key",
+				tamper: func(smsg *api.NatsSigned) (Kind, string) {
+					smsg.PublicKey = profile.MarshalPublicKey(otherKey.Public())
+					return KindMessage, "bob"
+				},
+			},
+		}
+		for _, tt := range tests {
+			t.Run(string(keyType)+"/"+tt.name, func(t *testing.T) {
+				smsg, err := Sign(privateKey, KindMessage, "bob", []byte("hello"))
+				if err != nil {
+					t.Fatalf("Sign: %s", err)
+				}
+				kind, recepient := tt.tamper(smsg)
+				publicKey, err := Verify(smsg, kind, recepient)
+				if !tt.valid {
+					if err == nil {
+						t.Fatalf("Verify accepted the signature")
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("Verify: %s", err)
+				}
+				if !profile.BelongsTo(publicKey, mustAddress(t, privateKey.Public())) {
+					t.Fatalf("Verify returned a key of another signer")
+				}
+			})
+		}
+	}
+}
+
+func mustAddress(t *testing.T, publicKey crypto.PublicKey) string {
+	t.Helper()
+	address, err := profile.AddressOf(publicKey)
+	if err != nil {
+		t.Fatalf("AddressOf: %s", err)
+	}
+	return address
+}
+
+func TestSealOpen(t *testing.T) {
+	plaintext := []byte("hello")
+	for _, keyType := range keyTypes {
+		privateKey := generateKey(t, keyType)
+		otherKey := generateKey(t, keyType)
+		tests := []struct {
+			name   string
+			key    crypto.Signer
+			tamper func(emsg *api.NatsEncrypted)
+			valid  bool
+		}{
+			{
+				name:   "round trip",
+				key:    privateKey,
+				tamper: func(emsg *api.NatsEncrypted) {},
+				valid:  true,
+			},
+			{
+				name:   "other key",
+				key:    otherKey,
+				tamper: func(emsg *api.NatsEncrypted) {},
+			},
+			{
+				name:   "tampered ciphertext",
+				key:    privateKey,
+				tamper: func(emsg *api.NatsEncrypted) { emsg.Ciphertext[0] ^= 1 },
+			},
+			{
+				name:   "tampered key",
+				key:    privateKey,
+				tamper: func(emsg *api.NatsEncrypted) { emsg.Key[len(emsg.Key)-1] ^= 1 },
+			},
+		}
+		for _, tt := range tests {
+			t.Run(string(keyType)+"/"+tt.name, func(t *testing.T) {
+				emsg, err := Seal(privateKey.Public(), plaintext)
+				if err != nil {
+					t.Fatalf("Seal: %s", err)
+				}
+				tt.tamper(emsg)
+				opened, err := Open(tt.key, emsg)
+				if !tt.valid {
+					if err == nil {
+						t.Fatalf("Open accepted the message")
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("Open: %s", err)
+				}
+				if !bytes.Equal(opened, plaintext) {
+					t.Fatalf("got %q, expected %q", opened, plaintext)
+				}
+			})
+		}
+	}
+}
+
+func TestSealInvalidKey(t *testing.T) {
+	// y = 2 is not the coordinate of a point on the curve
+	publicKey := make(ed25519.PublicKey, ed25519.PublicKeySize)
+	publicKey[0] = 2
+	if _, err := Seal(publicKey, []byte("hello")); err == nil {
+		t.Fatalf("Seal accepted a key which is not a valid point")
+	}
+}
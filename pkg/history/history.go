@@ -0,0 +1,229 @@
+package history
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	api "github.com/aaletov/nats-chat/api/generated"
+	bolt "go.etcd.io/bbolt"
+	"google.golang.org/protobuf/proto"
+)
+
+const DefaultLimit = 100
+
+type Store struct {
+	db *bolt.DB
+}
+
+func Open(path string) (*Store, error) {
+	var (
+		err error
+		db  *bolt.DB
+	)
+	if db, err = bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second}); err != nil {
+		return nil, fmt.Errorf("error opening history database: %s", err)
+	}
+	return &Store{db: db}, nil
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// RoomKey is used as peer to keep history of the room apart from the chats
+func RoomKey(roomID string) string {
+	return fmt.Sprintf("room.%s", roomID)
+}
+
+// idsKey is the bucket which maps message ids to sequences in history of peer
+func idsKey(peer string) []byte {
+	return []byte(fmt.Sprintf("ids.%s", peer))
+}
+
+func sequenceKey(sequence uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, sequence)
+	return key
+}
+
+// Append stores cmsg in the history of the chat between owner and peer and
+// returns its sequence number in that chat
+func (s *Store) Append(owner string, peer string, outgoing bool, cmsg *api.ChatMessage) (uint64, error) {
+	var sequence uint64
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var (
+			err         error
+			ownerBucket *bolt.Bucket
+			peerBucket  *bolt.Bucket
+			idsBucket   *bolt.Bucket
+			data        []byte
+		)
+		if ownerBucket, err = tx.CreateBucketIfNotExists([]byte(owner)); err != nil {
+			return err
+		}
+		if peerBucket, err = ownerBucket.CreateBucketIfNotExists([]byte(peer)); err != nil {
+			return err
+		}
+		if sequence, err = peerBucket.NextSequence(); err != nil {
+			return err
+		}
+		entry := &api.HistoryEntry{
+			Sequence: sequence,
+			Outgoing: outgoing,
+			Message:  cmsg,
+		}
+		if data, err = proto.Marshal(entry); err != nil {
+			return err
+		}
+		if err = peerBucket.Put(sequenceKey(sequence), data); err != nil {
+			return err
+		}
+		if cmsg.Id == "" {
+			return nil
+		}
+		if idsBucket, err = ownerBucket.CreateBucketIfNotExists(idsKey(peer)); err != nil {
+			return err
+		}
+		return idsBucket.Put([]byte(cmsg.Id), sequenceKey(sequence))
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error appending to history: %s", err)
+	}
+	return sequence, nil
+}
+
+// Has reports whether the message with id is in the history of the chat
+// between owner and peer
+func (s *Store) Has(owner string, peer string, id string) (bool, error) {
+	var found bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		ownerBucket := tx.Bucket([]byte(owner))
+		if ownerBucket == nil {
+			return nil
+		}
+		idsBucket := ownerBucket.Bucket(idsKey(peer))
+		if idsBucket == nil {
+			return nil
+		}
+		found = idsBucket.Get([]byte(id)) != nil
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("error reading history: %s", err)
+	}
+	return found, nil
+}
+
+// SetStatus updates status of the outgoing message with id sent to peer, the
+// status is never downgraded
+func (s *Store) SetStatus(owner string, peer string, id string, status api.MessageStatus) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		ownerBucket := tx.Bucket([]byte(owner))
+		if ownerBucket == nil {
+			return nil
+		}
+		idsBucket := ownerBucket.Bucket(idsKey(peer))
+		peerBucket := ownerBucket.Bucket([]byte(peer))
+		if (idsBucket == nil) || (peerBucket == nil) {
+			return nil
+		}
+		key := idsBucket.Get([]byte(id))
+		if key == nil {
+			return nil
+		}
+		entry := &api.HistoryEntry{}
+		if err := proto.Unmarshal(peerBucket.Get(key), entry); err != nil {
+			return err
+		}
+		if !entry.Outgoing || (entry.Status >= status) {
+			return nil
+		}
+		entry.Status = status
+		data, err := proto.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		return peerBucket.Put(key, data)
+	})
+	if err != nil {
+		return fmt.Errorf("error updating status in history: %s", err)
+	}
+	return nil
+}
+
+func matches(entry *api.HistoryEntry, req *api.HistoryRequest) bool {
+	if (req.AfterSequence != 0) && (entry.Sequence <= req.AfterSequence) {
+		return false
+	}
+	t := entry.Message.GetTime().AsTime()
+	if (req.Before != nil) && !t.Before(req.Before.AsTime()) {
+		return false
+	}
+	if (req.After != nil) && !t.After(req.After.AsTime()) {
+		return false
+	}
+	return true
+}
+
+func (s *Store) Query(owner string, req *api.HistoryRequest) ([]*api.HistoryEntry, error) {
+	limit := int(req.Limit)
+	if limit == 0 {
+		limit = DefaultLimit
+	}
+
+	peer := req.RecepientAddress
+	if req.RoomId != "" {
+		peer = RoomKey(req.RoomId)
+	}
+
+	var entries []*api.HistoryEntry
+	err := s.db.View(func(tx *bolt.Tx) error {
+		ownerBucket := tx.Bucket([]byte(owner))
+		if ownerBucket == nil {
+			return nil
+		}
+		peerBucket := ownerBucket.Bucket([]byte(peer))
+		if peerBucket == nil {
+			return nil
+		}
+
+		c := peerBucket.Cursor()
+		var k, v []byte
+		if req.BeforeSequence != 0 {
+			k, _ = c.Seek(sequenceKey(req.BeforeSequence))
+			if k == nil {
+				k, v = c.Last()
+			} else {
+				k, v = c.Prev()
+			}
+		} else {
+			k, v = c.Last()
+		}
+
+		for ; (k != nil) && (len(entries) < limit); k, v = c.Prev() {
+			if (req.BeforeSequence != 0) && (binary.BigEndian.Uint64(k) >= req.BeforeSequence) {
+				continue
+			}
+			if (req.AfterSequence != 0) && (binary.BigEndian.Uint64(k) <= req.AfterSequence) {
+				break
+			}
+			entry := &api.HistoryEntry{}
+			if err := proto.Unmarshal(v, entry); err != nil {
+				return fmt.Errorf("error unmarshalling entry %d: %s", binary.BigEndian.Uint64(k), err)
+			}
+			if matches(entry, req) {
+				entries = append(entries, entry)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error querying history: %s", err)
+	}
+
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, nil
+}
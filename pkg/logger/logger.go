@@ -1,15 +1,114 @@
 package logger
 
 import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
 	nested "github.com/antonfisher/nested-logrus-formatter"
 	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/term"
+	"gopkg.in/natefinch/lumberjack.v2"
 )
 
+// Fields of log lines in the order of the text format: component is the type
+// logging the line, method its method, chat the room id or the recepient
+// address of a direct chat and peer the address of the other user
+var fieldsOrder = []string{"component", "method", "chat", "peer"}
+
+func newTextFormatter(noColors bool) logrus.Formatter {
+	return &nested.Formatter{
+		HideKeys:    true,
+		NoColors:    noColors,
+		FieldsOrder: fieldsOrder,
+	}
+}
+
 func NewDefaultLogger() *logrus.Logger {
 	logger := logrus.New()
-	logger.SetFormatter(&nested.Formatter{
-		HideKeys:    true,
-		FieldsOrder: []string{"component", "method"},
-	})
+	logger.SetFormatter(newTextFormatter(false))
 	return logger
 }
+
+// Rotation limits the log file, it is rotated once it grows over MaxSize
+// megabytes, MaxBackups rotated files are kept for MaxAge days, zero keeps
+// them all
+type Rotation struct {
+	MaxSize    int
+	MaxBackups int
+	MaxAge     int
+}
+
+// RotationFlags are the flags of Rotation shared by the binaries
+func RotationFlags() []*cli.IntFlag {
+	return []*cli.IntFlag{
+		{
+			Name:  "log-max-size",
+			Usage: "Megabytes of the log file before it is rotated",
+			Value: 100,
+		},
+		{
+			Name:  "log-max-backups",
+			Usage: "Rotated log files to keep, 0 keeps all",
+			Value: 3,
+		},
+		{
+			Name:  "log-max-age",
+			Usage: "Days to keep rotated log files, 0 keeps them until there are too many",
+			Value: 0,
+		},
+	}
+}
+
+// RotationOf returns the rotation set by RotationFlags
+func RotationOf(cCtx *cli.Context) Rotation {
+	return Rotation{
+		MaxSize:    cCtx.Int("log-max-size"),
+		MaxBackups: cCtx.Int("log-max-backups"),
+		MaxAge:     cCtx.Int("log-max-age"),
+	}
+}
+
+// SetFile writes the log to path instead of stderr
+func SetFile(logger *logrus.Logger, path string, rotation Rotation) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("error opening log file: %s", err)
+	}
+	file.Close()
+	logger.SetOutput(&lumberjack.Logger{
+		Filename:   path,
+		MaxSize:    rotation.MaxSize,
+		MaxBackups: rotation.MaxBackups,
+		MaxAge:     rotation.MaxAge,
+	})
+	return nil
+}
+
+func isTerminal(out io.Writer) bool {
+	file, ok := out.(*os.File)
+	return ok && term.IsTerminal(int(file.Fd()))
+}
+
+// Configure sets the level and the format of logger, format is text or json
+func Configure(logger *logrus.Logger, level string, format string) error {
+	var (
+		err      error
+		logLevel logrus.Level
+	)
+	if logLevel, err = logrus.ParseLevel(level); err != nil {
+		return fmt.Errorf("invalid log level: %s", err)
+	}
+	switch format {
+	case "text":
+		logger.SetFormatter(newTextFormatter(!isTerminal(logger.Out)))
+	case "json":
+		logger.SetFormatter(&logrus.JSONFormatter{TimestampFormat: time.RFC3339Nano})
+	default:
+		return fmt.Errorf("invalid log format: %q", format)
+	}
+	logger.SetLevel(logLevel)
+	return nil
+}
@@ -0,0 +1,149 @@
+// Package metrics holds the Prometheus metrics of the daemon. Names and labels
+// of the metrics are stable, they are documented in the README:
+//
+//	natschat_messages_sent_total{chat}          messages published to a chat
+//	natschat_messages_received_total{chat}      messages delivered from a chat
+//	natschat_publish_errors_total{chat}         messages not published to a chat
+//	natschat_unmarshal_failures_total{stage}    undecodable incoming messages,
+//	                                            stage is encrypted, signed or message
+//	natschat_dial_duration_seconds{result}      latency of dialing a peer,
+//	                                            result is ok or error
+//	natschat_nats_reconnects_total              reconnects to the nats server
+//	natschat_grpc_active_streams{method}        open gRPC streams of clients
+//
+// chat is the address of the recepient, method is the full gRPC method name.
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+)
+
+const namespace = "natschat"
+
+var (
+	MessagesSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_sent_total",
+		Help:      "Messages published to a chat.",
+	}, []string{"chat"})
+	MessagesReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_received_total",
+		Help:      "Messages delivered from a chat.",
+	}, []string{"chat"})
+	PublishErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "publish_errors_total",
+		Help:      "Messages which could not be published to a chat.",
+	}, []string{"chat"})
+	UnmarshalFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "unmarshal_failures_total",
+		Help:      "Incoming messages which could not be unmarshalled, by the layer of the message.",
+	}, []string{"stage"})
+	DialDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "dial_duration_seconds",
+		Help:      "Latency of dialing a peer, including the handshake.",
+		Buckets:   []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"result"})
+	NatsReconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "nats_reconnects_total",
+		Help:      "Reconnects to the nats server.",
+	})
+	ActiveStreams = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "grpc_active_streams",
+		Help:      "Open gRPC streams of clients.",
+	}, []string{"method"})
+)
+
+// Stages of the incoming message for UnmarshalFailures
+const (
+	StageEncrypted = "encrypted"
+	StageSigned    = "signed"
+	StageMessage   = "message"
+)
+
+var registry = prometheus.NewRegistry()
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		MessagesSent,
+		MessagesReceived,
+		PublishErrors,
+		UnmarshalFailures,
+		DialDuration,
+		NatsReconnects,
+		ActiveStreams,
+	)
+}
+
+// ObserveDial records the latency of a dial started at start
+func ObserveDial(start time.Time, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	DialDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+}
+
+// StreamInterceptor counts the open streams of every method
+func StreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	gauge := ActiveStreams.WithLabelValues(info.FullMethod)
+	gauge.Inc()
+	defer gauge.Dec()
+	return handler(srv, ss)
+}
+
+// Server serves the metrics over HTTP at /metrics
+type Server struct {
+	lis net.Listener
+	srv *http.Server
+}
+
+func Listen(address string) (*Server, error) {
+	lis, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for metrics: %s", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	return &Server{
+		lis: lis,
+		srv: &http.Server{
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		},
+	}, nil
+}
+
+func (s *Server) Addr() net.Addr {
+	return s.lis.Addr()
+}
+
+func (s *Server) Serve() error {
+	if err := s.srv.Serve(s.lis); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (s *Server) Shutdown() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.srv.Shutdown(ctx)
+}
@@ -0,0 +1,92 @@
+package natscli
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/aaletov/nats-chat/pkg/backup"
+	"github.com/aaletov/nats-chat/pkg/profile"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+func NewExportHandler(logger *logrus.Logger) cli.ActionFunc {
+	ll := logger.WithFields(logrus.Fields{
+		"component": "ExportHandler",
+	})
+	return WrapCliHandler(exportHandler, ll)
+}
+
+func exportHandler(cCtx *cli.Context, ll *logrus.Entry) (err error) {
+	archivePath := cCtx.Args().First()
+	if archivePath == "" {
+		return errors.New("path of the archive is required")
+	}
+	var (
+		senderProfile profile.Profile
+		passphrase    []byte
+		archive       *os.File
+	)
+	profilePath := cCtx.String("profile")
+	if senderProfile, err = profile.ReadProfile(profilePath, profilePassphrase(cCtx, profilePath, nil)); err != nil {
+		return err
+	}
+	if passphrase, err = readPassphrase(cCtx, ArchivePassphraseEnv, "Archive passphrase: ", true); err != nil {
+		return err
+	}
+	if len(passphrase) == 0 {
+		return fmt.Errorf("no archive passphrase: set %s or --passphrase-fd", ArchivePassphraseEnv)
+	}
+
+	if archive, err = os.OpenFile(archivePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600); err != nil {
+		return fmt.Errorf("error creating archive: %s", err)
+	}
+	if err = backup.Export(archive, profilePath, cCtx.String("contacts"), senderProfile, passphrase); err != nil {
+		archive.Close()
+		os.Remove(archivePath)
+		return err
+	}
+	if err = archive.Close(); err != nil {
+		return fmt.Errorf("error writing archive: %s", err)
+	}
+	ll.Printf("Exported %s to %s", senderProfile.GetAddress(), archivePath)
+	return nil
+}
+
+func NewImportHandler(logger *logrus.Logger) cli.ActionFunc {
+	ll := logger.WithFields(logrus.Fields{
+		"component": "ImportHandler",
+	})
+	return WrapCliHandler(importHandler, ll)
+}
+
+func importHandler(cCtx *cli.Context, ll *logrus.Entry) (err error) {
+	archivePath := cCtx.Args().First()
+	if archivePath == "" {
+		return errors.New("path of the archive is required")
+	}
+	var (
+		passphrase []byte
+		archive    *os.File
+		manifest   *backup.Manifest
+	)
+	if archive, err = os.Open(archivePath); err != nil {
+		return fmt.Errorf("error opening archive: %s", err)
+	}
+	defer archive.Close()
+	if passphrase, err = readPassphrase(cCtx, ArchivePassphraseEnv, "Archive passphrase: ", false); err != nil {
+		return err
+	}
+	if len(passphrase) == 0 {
+		return fmt.Errorf("no archive passphrase: set %s or --passphrase-fd", ArchivePassphraseEnv)
+	}
+
+	profilePath := cCtx.String("profile")
+	if manifest, err = backup.Import(archive, profilePath, cCtx.String("contacts"), passphrase, profilePassphrase(cCtx, profilePath, nil)); err != nil {
+		return err
+	}
+	ll.Printf("Imported profile exported at %s", manifest.Created.Local().Format("2006-01-02 15:04:05"))
+	fmt.Printf("Your address is:\n%s\n", manifest.Address)
+	return nil
+}
@@ -0,0 +1,128 @@
+package natscli
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"unicode"
+
+	"golang.org/x/term"
+)
+
+const (
+	keyInterrupt = 0x03
+	keyEOF       = 0x04
+	keyBackspace = 0x7f
+)
+
+// console prints chat events without breaking the line being composed. When
+// stdin is a terminal it is read by characters, so typing can be reported
+// before the line is finished.
+type console struct {
+	mu   sync.Mutex
+	fd   int
+	raw  bool
+	line []rune
+}
+
+func newConsole() *console {
+	return &console{fd: int(os.Stdin.Fd())}
+}
+
+func (c *console) Fprintf(w io.Writer, format string, a ...interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	text := fmt.Sprintf(format, a...)
+	if !c.raw {
+		fmt.Fprint(w, text)
+		return
+	}
+	// Clear the composed line, print above it and restore it
+	fmt.Fprintf(w, "\r\x1b[K%s", strings.ReplaceAll(text, "\n", "\r\n"))
+	fmt.Print(string(c.line))
+}
+
+func (c *console) Printf(format string, a ...interface{}) {
+	c.Fprintf(os.Stdout, format, a...)
+}
+
+// ReadLines calls onLine for every line read from stdin until EOF and onTyping
+// for every character typed in the terminal
+func (c *console) ReadLines(onLine func(string) error, onTyping func() error) error {
+	if !term.IsTerminal(c.fd) {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			if err := onLine(scanner.Text()); err != nil {
+				return err
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("Got error from scanner: %s", err)
+		}
+		return nil
+	}
+
+	state, err := term.MakeRaw(c.fd)
+	if err != nil {
+		return fmt.Errorf("unable to set terminal mode: %s", err)
+	}
+	defer term.Restore(c.fd, state)
+	c.mu.Lock()
+	c.raw = true
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.raw = false
+		c.mu.Unlock()
+	}()
+
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		r, _, err := reader.ReadRune()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading stdin: %s", err)
+		}
+
+		var (
+			line   string
+			ended  bool
+			typing bool
+		)
+		c.mu.Lock()
+		switch {
+		case (r == '\r') || (r == '\n'):
+			line, ended = string(c.line), true
+			c.line = c.line[:0]
+			fmt.Print("\r\n")
+		case (r == keyBackspace) || (r == '\b'):
+			if len(c.line) > 0 {
+				c.line = c.line[:len(c.line)-1]
+				fmt.Print("\b \b")
+			}
+		case (r == keyInterrupt) || ((r == keyEOF) && (len(c.line) == 0)):
+			c.mu.Unlock()
+			fmt.Print("\r\n")
+			return nil
+		case unicode.IsPrint(r):
+			c.line = append(c.line, r)
+			fmt.Print(string(r))
+			typing = true
+		}
+		c.mu.Unlock()
+
+		if ended {
+			err = onLine(line)
+		} else if typing {
+			err = onTyping()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
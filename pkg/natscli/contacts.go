@@ -0,0 +1,134 @@
+package natscli
+
+import (
+	"crypto"
+	"fmt"
+
+	"github.com/aaletov/nats-chat/pkg/contacts"
+	"github.com/aaletov/nats-chat/pkg/profile"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// resolveContact reads contact name or address from the flag
+func resolveContact(cCtx *cli.Context, ll *logrus.Entry, flag string) (contacts.Contact, error) {
+	var (
+		err     error
+		book    *contacts.Book
+		contact contacts.Contact
+	)
+	if book, err = contacts.Open(cCtx.String("contacts")); err != nil {
+		return contacts.Contact{}, err
+	}
+	if contact, err = book.Resolve(cCtx.String(flag)); err != nil {
+		return contacts.Contact{}, err
+	}
+	warnLegacy(ll, contact.Address)
+	return contact, nil
+}
+
+// warnLegacy warns about addresses without checksum, which are accepted until
+// every profile migrates
+func warnLegacy(ll *logrus.Entry, address string) {
+	if profile.IsLegacyAddress(address) {
+		ll.Warnf("%s is a legacy address without checksum, ask its owner for the current one", address)
+	}
+}
+
+// contactNames returns NameOf of the contact book, addresses are returned as
+// is if the book can not be read
+func contactNames(cCtx *cli.Context, ll *logrus.Entry) func(string) string {
+	book, err := contacts.Open(cCtx.String("contacts"))
+	if err != nil {
+		ll.Warnf("Unable to read contacts: %s", err)
+		return func(address string) string { return address }
+	}
+	return book.NameOf
+}
+
+func NewContactAddHandler(logger *logrus.Logger) cli.ActionFunc {
+	ll := logger.WithFields(logrus.Fields{
+		"component": "ContactHandler",
+	})
+	return WrapCliHandler(contactAddHandler, ll)
+}
+
+func contactAddHandler(cCtx *cli.Context, ll *logrus.Entry) (err error) {
+	var (
+		book      *contacts.Book
+		publicKey crypto.PublicKey
+	)
+	if book, err = contacts.Open(cCtx.String("contacts")); err != nil {
+		return err
+	}
+	if keyPath := cCtx.String("key"); keyPath != "" {
+		if publicKey, err = profile.ReadPublicKey(keyPath); err != nil {
+			return err
+		}
+	}
+	if err = book.Add(cCtx.String("name"), cCtx.String("address"), publicKey); err != nil {
+		return err
+	}
+	if publicKey == nil {
+		warnLegacy(ll, cCtx.String("address"))
+	}
+	return book.Save()
+}
+
+func NewContactListHandler(logger *logrus.Logger) cli.ActionFunc {
+	ll := logger.WithFields(logrus.Fields{
+		"component": "ContactHandler",
+	})
+	return WrapCliHandler(contactListHandler, ll)
+}
+
+func contactListHandler(cCtx *cli.Context, ll *logrus.Entry) (err error) {
+	var book *contacts.Book
+	if book, err = contacts.Open(cCtx.String("contacts")); err != nil {
+		return err
+	}
+	for _, contact := range book.List() {
+		pinned := ""
+		if contact.PublicKey != nil {
+			pinned = " (pinned key)"
+		}
+		fmt.Printf("%s %s%s\n", contact.Name, contact.Address, pinned)
+	}
+	return nil
+}
+
+func NewContactRmHandler(logger *logrus.Logger) cli.ActionFunc {
+	ll := logger.WithFields(logrus.Fields{
+		"component": "ContactHandler",
+	})
+	return WrapCliHandler(contactRmHandler, ll)
+}
+
+func contactRmHandler(cCtx *cli.Context, ll *logrus.Entry) (err error) {
+	var book *contacts.Book
+	if book, err = contacts.Open(cCtx.String("contacts")); err != nil {
+		return err
+	}
+	if err = book.Remove(cCtx.String("name")); err != nil {
+		return err
+	}
+	return book.Save()
+}
+
+func NewContactRenameHandler(logger *logrus.Logger) cli.ActionFunc {
+	ll := logger.WithFields(logrus.Fields{
+		"component": "ContactHandler",
+	})
+	return WrapCliHandler(contactRenameHandler, ll)
+}
+
+func contactRenameHandler(cCtx *cli.Context, ll *logrus.Entry) (err error) {
+	var book *contacts.Book
+	if book, err = contacts.Open(cCtx.String("contacts")); err != nil {
+		return err
+	}
+	if err = book.Rename(cCtx.String("name"), cCtx.String("to")); err != nil {
+		return err
+	}
+	return book.Save()
+}
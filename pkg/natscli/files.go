@@ -0,0 +1,211 @@
+package natscli
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	api "github.com/aaletov/nats-chat/api/generated"
+	"github.com/aaletov/nats-chat/pkg/contacts"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// uploadChunkSize is the size of the messages streaming a file to a remote
+// daemon
+const uploadChunkSize = 64 * 1024
+
+// progressReceiver is implemented by streams of SendFile, UploadFile and
+// AnswerFileOffer
+type progressReceiver interface {
+	Recv() (*api.FileProgress, error)
+}
+
+// printProgress prints progress of the transfer until it is over
+func printProgress(name string, stream progressReceiver) error {
+	for {
+		progress, err := stream.Recv()
+		if err == io.EOF {
+			return fmt.Errorf("transfer of %s was interrupted", name)
+		}
+		if err != nil {
+			return err
+		}
+
+		switch progress.State {
+		case api.FileState_OFFERED:
+			fmt.Printf("Offered %s (%d bytes), waiting for the recepient\n", name, progress.Size)
+		case api.FileState_TRANSFERRING:
+			percent := uint64(100)
+			if progress.Size > 0 {
+				percent = progress.Offset * 100 / progress.Size
+			}
+			fmt.Printf("\r%s: %d%% (%d/%d bytes)", name, percent, progress.Offset, progress.Size)
+		case api.FileState_DONE:
+			if progress.Path != "" {
+				fmt.Printf("\n%s saved to %s\n", name, progress.Path)
+			} else {
+				fmt.Printf("\n%s sent\n", name)
+			}
+			return nil
+		case api.FileState_REJECTED:
+			fmt.Printf("%s rejected\n", name)
+			return nil
+		case api.FileState_FAILED:
+			return fmt.Errorf("transfer of %s failed: %s", name, progress.Error)
+		}
+	}
+}
+
+func NewSendFileHandler(logger *logrus.Logger) cli.ActionFunc {
+	ll := logger.WithFields(logrus.Fields{
+		"component": "FileHandler",
+	})
+	return WrapCliHandler(WrapCliDaemonHandler(sendFileHandler), ll)
+}
+
+func sendFileHandler(cCtx *cli.Context, ll *logrus.Entry, daemonClient api.DaemonClient) (err error) {
+	if cCtx.NArg() != 1 {
+		return fmt.Errorf("exactly one file must be given")
+	}
+	var (
+		recepient contacts.Contact
+		path      string
+		stream    api.Daemon_SendFileClient
+	)
+	if recepient, err = resolveContact(cCtx, ll, "recepient"); err != nil {
+		return err
+	}
+	if path, err = filepath.Abs(cCtx.Args().First()); err != nil {
+		return fmt.Errorf("error resolving file path: %s", err)
+	}
+	if isRemote(cCtx) {
+		return uploadFile(cCtx, daemonClient, recepient.Address, path)
+	}
+	if stream, err = daemonClient.SendFile(cCtx.Context, &api.SendFileRequest{
+		RecepientAddress: recepient.Address,
+		Path:             path,
+	}); err != nil {
+		return fmt.Errorf("failed to send file: %s", err)
+	}
+	return printProgress(filepath.Base(path), stream)
+}
+
+// uploadFile streams the file to a remote daemon, which can't read it
+func uploadFile(cCtx *cli.Context, daemonClient api.DaemonClient, recepient string, path string) (err error) {
+	var (
+		file   *os.File
+		info   os.FileInfo
+		stream api.Daemon_UploadFileClient
+		n      int
+	)
+	if file, err = os.Open(path); err != nil {
+		return fmt.Errorf("unable to open file: %s", err)
+	}
+	defer file.Close()
+	if info, err = file.Stat(); err != nil {
+		return fmt.Errorf("unable to stat file: %s", err)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+	if stream, err = daemonClient.UploadFile(cCtx.Context); err != nil {
+		return fmt.Errorf("failed to send file: %s", err)
+	}
+	header := &api.FileUpload{
+		Payload: &api.FileUpload_Header{
+			Header: &api.FileUploadHeader{
+				RecepientAddress: recepient,
+				Name:             filepath.Base(path),
+				Size:             uint64(info.Size()),
+			},
+		},
+	}
+	// Send fails with io.EOF if the daemon ended the stream, the reason is
+	// received with the progress
+	if err = stream.Send(header); err == io.EOF {
+		return printProgress(filepath.Base(path), stream)
+	} else if err != nil {
+		return fmt.Errorf("failed to send file: %s", err)
+	}
+	buf := make([]byte, uploadChunkSize)
+	for {
+		if n, err = file.Read(buf); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("unable to read file: %s", err)
+		}
+		if err = stream.Send(&api.FileUpload{Payload: &api.FileUpload_Data{Data: buf[:n]}}); err == io.EOF {
+			return printProgress(filepath.Base(path), stream)
+		} else if err != nil {
+			return fmt.Errorf("failed to upload file: %s", err)
+		}
+	}
+	if err = stream.CloseSend(); err != nil {
+		return fmt.Errorf("failed to upload file: %s", err)
+	}
+	return printProgress(filepath.Base(path), stream)
+}
+
+func NewReceiveHandler(logger *logrus.Logger) cli.ActionFunc {
+	ll := logger.WithFields(logrus.Fields{
+		"component": "FileHandler",
+	})
+	return WrapCliHandler(WrapCliDaemonHandler(receiveHandler), ll)
+}
+
+func receiveHandler(cCtx *cli.Context, ll *logrus.Entry, daemonClient api.DaemonClient) (err error) {
+	var (
+		offers api.Daemon_WatchFileOffersClient
+		offer  *api.FileOffer
+		answer string
+	)
+	if offers, err = daemonClient.WatchFileOffers(cCtx.Context, &emptypb.Empty{}); err != nil {
+		return fmt.Errorf("failed to watch offers: %s", err)
+	}
+	nameOf := contactNames(cCtx, ll)
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		if offer, err = offers.Recv(); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		accept := cCtx.Bool("yes")
+		fmt.Printf("%s %s offers %s (%d bytes, sha256 %x)\n", offer.Time.AsTime(), nameOf(offer.AuthorAddress),
+			offer.Name, offer.Size, offer.Sha256)
+		if !accept {
+			fmt.Print("Accept? [y/N] ")
+			if answer, err = reader.ReadString('\n'); (err != nil) && (answer == "") {
+				// Offers left unanswered stay pending in the daemon
+				return nil
+			}
+			answer = strings.ToLower(strings.TrimSpace(answer))
+			accept = (answer == "y") || (answer == "yes")
+		}
+
+		var stream api.Daemon_AnswerFileOfferClient
+		if stream, err = daemonClient.AnswerFileOffer(cCtx.Context, &api.FileAnswer{
+			Id:     offer.Id,
+			Accept: accept,
+		}); err != nil {
+			return fmt.Errorf("failed to answer offer: %s", err)
+		}
+		if err = printProgress(offer.Name, stream); err != nil {
+			// The offer may have been answered by another cli
+			if e, ok := status.FromError(err); ok && (e.Code() == codes.NotFound) {
+				ll.Warnf("Offer is gone: %s", e.Message())
+				continue
+			}
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+}
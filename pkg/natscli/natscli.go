@@ -1,19 +1,21 @@
 package natscli
 
 import (
-	"bufio"
 	"context"
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/x509"
+	"crypto"
 	"encoding/pem"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 
 	api "github.com/aaletov/nats-chat/api/generated"
+	"github.com/aaletov/nats-chat/pkg/contacts"
 	"github.com/aaletov/nats-chat/pkg/fs"
+	"github.com/aaletov/nats-chat/pkg/natsdaemon"
 	"github.com/aaletov/nats-chat/pkg/profile"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
@@ -21,22 +23,30 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
 	"google.golang.org/protobuf/types/known/emptypb"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
-func ConnectDaemon(cCtx *cli.Context) (*grpc.ClientConn, error) {
-	var (
-		homeDir string
-		err     error
-	)
+// isRemote reports whether the daemon is reached over TCP, paths passed to it
+// are on its host then
+func isRemote(cCtx *cli.Context) bool {
+	return cCtx.String("daemon-addr") != ""
+}
 
-	if homeDir, err = os.UserHomeDir(); err != nil {
-		return nil, fmt.Errorf("Unable to get user's home directory: %s", err)
+func ConnectDaemon(cCtx *cli.Context) (*grpc.ClientConn, error) {
+	if isRemote(cCtx) {
+		creds, err := natsdaemon.ClientCredentials(cCtx.String("daemon-cert"), cCtx.String("daemon-key"), cCtx.String("daemon-ca"))
+		if err != nil {
+			return nil, err
+		}
+		return grpc.Dial(cCtx.String("daemon-addr"), grpc.WithTransportCredentials(creds))
 	}
+
 	PROTOCOL := "unix"
-	SOCKET := filepath.Join(homeDir, ".natschat/socket/natschat.sock")
+	SOCKET := cCtx.String("socket")
 	dialOption := grpc.WithContextDialer(func(ctx context.Context, s string) (net.Conn, error) {
 		return net.Dial(PROTOCOL, s)
 	})
@@ -70,8 +80,19 @@ type CliHandler func(*cli.Context, *logrus.Entry) error
 
 func WrapCliHandler(handler CliHandler, logger *logrus.Entry) cli.ActionFunc {
 	return func(ctx *cli.Context) error {
-		return handler(ctx, logger)
+		return handler(ctx, logger.WithFields(logrus.Fields{
+			"method": ctx.Command.FullName(),
+		}))
+	}
+}
+
+// CheckOnlineProfileDir checks the profile of online, which is on the host of
+// a remote daemon
+func CheckOnlineProfileDir(cCtx *cli.Context) (err error) {
+	if isRemote(cCtx) {
+		return nil
 	}
+	return CheckProfileDir(cCtx)
 }
 
 func CheckProfileDir(cCxt *cli.Context) (err error) {
@@ -97,33 +118,30 @@ func generateHandler(cCtx *cli.Context, ll *logrus.Entry) (err error) {
 		}
 	}
 
-	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
+	var (
+		privateKey      crypto.Signer
+		privateKeyBlock *pem.Block
+	)
+	if privateKey, err = profile.GenerateKey(profile.KeyType(cCtx.String("type"))); err != nil {
 		return fmt.Errorf("error when generate key pair: %s", err)
 	}
-	publicKey := &privateKey.PublicKey
-
-	var privateKeyBytes []byte = x509.MarshalPKCS1PrivateKey(privateKey)
-	privateKeyBlock := &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: privateKeyBytes,
+	if privateKeyBlock, err = profile.PrivateKeyBlock(privateKey); err != nil {
+		return err
 	}
 
-	var privatePem *os.File
-	if privatePem, err = fs.CreateIfNotExist(filepath.Join(profilePath, "private.pem")); err != nil {
-		return fmt.Errorf("error when create private.pem: %s \n", err)
+	privateKeyPath := filepath.Join(profilePath, "private.pem")
+	if _, err = os.Stat(privateKeyPath); err == nil {
+		return fmt.Errorf("error when create private.pem: file exists")
 	}
-	defer privatePem.Close()
-
-	err = pem.Encode(privatePem, privateKeyBlock)
-	if err != nil {
-		return fmt.Errorf("error when encode private pem: %s \n", err)
+	var passphrase []byte
+	if passphrase, err = readPassphrase(cCtx, PassphraseEnv, "New passphrase (empty for none): ", true); err != nil {
+		return err
 	}
-
-	publicKeyBytes := x509.MarshalPKCS1PublicKey(publicKey)
-	publicKeyBlock := &pem.Block{
-		Type:  "PUBLIC KEY",
-		Bytes: publicKeyBytes,
+	if len(passphrase) == 0 {
+		ll.Warnln("Private key is stored unencrypted")
+	}
+	if err = profile.WritePrivateKey(privateKeyPath, privateKeyBlock, passphrase); err != nil {
+		return err
 	}
 
 	var publicPem *os.File
@@ -132,11 +150,11 @@ func generateHandler(cCtx *cli.Context, ll *logrus.Entry) (err error) {
 	}
 	defer publicPem.Close()
 
-	err = pem.Encode(publicPem, publicKeyBlock)
+	err = pem.Encode(publicPem, profile.PublicKeyBlock(privateKey.Public()))
 	if err != nil {
 		return fmt.Errorf("error when encode public pem: %s \n", err)
 	}
-	ll.Println("Generated new key pair")
+	ll.Printf("Generated new %s key pair", cCtx.String("type"))
 	return nil
 }
 
@@ -150,7 +168,7 @@ func NewAddressHandler(logger *logrus.Logger) cli.ActionFunc {
 func addressHandler(cCtx *cli.Context, ll *logrus.Entry) (err error) {
 	profilePath := cCtx.String("profile")
 	var senderProfile profile.Profile
-	if senderProfile, err = profile.ReadProfile(profilePath); err != nil {
+	if senderProfile, err = profile.ReadProfile(profilePath, profilePassphrase(cCtx, profilePath, nil)); err != nil {
 		return err
 	}
 	ll.Debugf("Read sender profile %s\n", profilePath)
@@ -160,6 +178,40 @@ func addressHandler(cCtx *cli.Context, ll *logrus.Entry) (err error) {
 	return nil
 }
 
+func NewPasswdHandler(logger *logrus.Logger) cli.ActionFunc {
+	ll := logger.WithFields(logrus.Fields{
+		"component": "PasswdHandler",
+	})
+	return WrapCliHandler(passwdHandler, ll)
+}
+
+func passwdHandler(cCtx *cli.Context, ll *logrus.Entry) (err error) {
+	var (
+		privateKeyBlock *pem.Block
+		passphrase      []byte
+	)
+	profilePath := cCtx.String("profile")
+	privateKeyPath := filepath.Join(profilePath, "private.pem")
+	if privateKeyBlock, err = profile.ReadPrivateKeyBlock(privateKeyPath, profilePassphrase(cCtx, profilePath, nil)); err != nil {
+		return err
+	}
+	if passphrase, err = readPassphrase(cCtx, NewPassphraseEnv, "New passphrase (empty for none): ", true); err != nil {
+		return err
+	}
+	if passphrase == nil {
+		return fmt.Errorf("no new passphrase: set %s or --passphrase-fd", NewPassphraseEnv)
+	}
+	if err = profile.WritePrivateKey(privateKeyPath, privateKeyBlock, passphrase); err != nil {
+		return err
+	}
+	if len(passphrase) == 0 {
+		ll.Warnln("Private key is stored unencrypted")
+	} else {
+		ll.Println("Changed passphrase")
+	}
+	return nil
+}
+
 func NewOnlineHandler(logger *logrus.Logger) cli.ActionFunc {
 	ll := logger.WithFields(logrus.Fields{
 		"component": "OnlineHandler",
@@ -168,24 +220,113 @@ func NewOnlineHandler(logger *logrus.Logger) cli.ActionFunc {
 }
 
 func onlineHandler(cCtx *cli.Context, ll *logrus.Entry, daemonClient api.DaemonClient) (err error) {
-	profilePath := cCtx.String("profile")
+	req := &api.OnlineRequest{
+		NatsUrl:      cCtx.String("nats-url"),
+		ProfilePath:  cCtx.String("profile"),
+		Jetstream:    cCtx.Bool("jetstream"),
+		DownloadsDir: cCtx.String("downloads"),
+		ContactsPath: cCtx.String("contacts"),
+		Reconnect: &api.ReconnectOptions{
+			MaxReconnects: int32(cCtx.Int("max-reconnects")),
+			Wait:          durationpb.New(cCtx.Duration("reconnect-wait")),
+			BufferSize:    int32(cCtx.Int("reconnect-buffer")),
+		},
+	}
+	if req.Credentials, err = natsCredentials(cCtx); err != nil {
+		return err
+	}
+	if isRemote(cCtx) {
+		// Paths are in the data directory of the remote daemon, which has
+		// its own defaults
+		if !cCtx.IsSet("profile") {
+			req.ProfilePath = ""
+		}
+		if !cCtx.IsSet("contacts") {
+			req.ContactsPath = ""
+		}
+		return remoteOnline(cCtx, ll, daemonClient, req)
+	}
+
 	var senderProfile profile.Profile
-	if senderProfile, err = profile.ReadProfile(profilePath); err != nil {
+	if senderProfile, err = profile.ReadProfile(req.ProfilePath, profilePassphrase(cCtx, req.ProfilePath, &req.Passphrase)); err != nil {
 		return err
 	}
+	req.SenderAddress = senderProfile.GetAddress()
 
-	natsUrl := cCtx.String("nats-url")
-	_, err = daemonClient.Online(cCtx.Context, &api.OnlineRequest{
-		NatsUrl:       natsUrl,
-		SenderAddress: senderProfile.GetAddress(),
-	})
+	if req.ProfilePath, err = filepath.Abs(req.ProfilePath); err != nil {
+		return fmt.Errorf("error resolving profile path: %s", err)
+	}
+	if req.DownloadsDir != "" {
+		if req.DownloadsDir, err = filepath.Abs(req.DownloadsDir); err != nil {
+			return fmt.Errorf("error resolving downloads path: %s", err)
+		}
+	}
+	if req.ContactsPath, err = filepath.Abs(req.ContactsPath); err != nil {
+		return fmt.Errorf("error resolving contacts path: %s", err)
+	}
+
+	if _, err = daemonClient.Online(cCtx.Context, req); err != nil {
+		return fmt.Errorf("error going online: %s", err)
+	}
+	return nil
+}
 
+// remoteOnline leaves reading the profile to the remote daemon, the passphrase
+// is sent once the daemon asks for it
+func remoteOnline(cCtx *cli.Context, ll *logrus.Entry, daemonClient api.DaemonClient, req *api.OnlineRequest) (err error) {
+	_, err = daemonClient.Online(cCtx.Context, req)
+	if natsdaemon.ErrorReason(err) == natsdaemon.ReasonPassphraseRequired {
+		e := status.Convert(err)
+		ll.Debugf("Daemon asks for passphrase: %s", e.Message())
+		name := req.ProfilePath
+		if name == "" {
+			name = "the profile of the daemon"
+		}
+		if req.Passphrase, err = readPassphrase(cCtx, PassphraseEnv, fmt.Sprintf("Passphrase of %s: ", name), false); err != nil {
+			return err
+		}
+		if req.Passphrase == nil {
+			return fmt.Errorf("error going online: %s", e.Message())
+		}
+		_, err = daemonClient.Online(cCtx.Context, req)
+	}
 	if err != nil {
 		return fmt.Errorf("error going online: %s", err)
 	}
 	return nil
 }
 
+// natsCredentials reads the nats flags of online, paths are made absolute as
+// the daemon reads the files, unless it is remote
+func natsCredentials(cCtx *cli.Context) (*api.NatsCredentials, error) {
+	credentials := &api.NatsCredentials{
+		User: cCtx.String("nats-user"),
+	}
+	for flag, field := range map[string]*string{
+		"nats-password-file": &credentials.PasswordFile,
+		"nats-token-file":    &credentials.TokenFile,
+		"nats-nkey":          &credentials.NkeySeedFile,
+		"nats-creds":         &credentials.CredsFile,
+		"tls-cert":           &credentials.TlsCertFile,
+		"tls-key":            &credentials.TlsKeyFile,
+		"tls-ca":             &credentials.TlsCaFile,
+	} {
+		if cCtx.String(flag) == "" {
+			continue
+		}
+		if isRemote(cCtx) {
+			*field = cCtx.String(flag)
+			continue
+		}
+		path, err := filepath.Abs(cCtx.String(flag))
+		if err != nil {
+			return nil, fmt.Errorf("error resolving --%s: %s", flag, err)
+		}
+		*field = path
+	}
+	return credentials, nil
+}
+
 func NewOfflineHandler(logger *logrus.Logger) cli.ActionFunc {
 	ll := logger.WithFields(logrus.Fields{
 		"component": "OfflineHandler",
@@ -208,11 +349,18 @@ func NewCreateChatHandler(logger *logrus.Logger) cli.ActionFunc {
 }
 
 func createChatHandler(cCtx *cli.Context, ll *logrus.Entry, daemonClient api.DaemonClient) (err error) {
-	recepientAddress := cCtx.String("recepient")
+	var recepient contacts.Contact
+	if recepient, err = resolveContact(cCtx, ll, "recepient"); err != nil {
+		return err
+	}
 
 	_, err = daemonClient.CreateChat(cCtx.Context, &api.ChatRequest{
-		RecepientAddress: recepientAddress,
+		RecepientAddress: recepient.Address,
+		PinnedPublicKey:  recepient.PublicKey,
 	})
+	if e, ok := status.FromError(err); ok && (e.Code() == codes.PermissionDenied) {
+		return fmt.Errorf("recepient failed to prove its identity: %s", e.Message())
+	}
 	return err
 }
 
@@ -224,10 +372,13 @@ func NewRmChatHandler(logger *logrus.Logger) cli.ActionFunc {
 }
 
 func rmChatHandler(cCtx *cli.Context, ll *logrus.Entry, daemonClient api.DaemonClient) (err error) {
-	recepientAddress := cCtx.String("recepient")
+	var recepient contacts.Contact
+	if recepient, err = resolveContact(cCtx, ll, "recepient"); err != nil {
+		return err
+	}
 
 	_, err = daemonClient.DeleteChat(cCtx.Context, &api.ChatRequest{
-		RecepientAddress: recepientAddress,
+		RecepientAddress: recepient.Address,
 	})
 	return err
 }
@@ -239,17 +390,86 @@ func NewOpenChatHandler(logger *logrus.Logger) cli.ActionFunc {
 	return WrapCliHandler(WrapCliDaemonHandler(openChatHandler), ll)
 }
 
+func statusString(status api.MessageStatus) string {
+	switch status {
+	case api.MessageStatus_DELIVERED:
+		return "delivered"
+	case api.MessageStatus_READ:
+		return "read"
+	}
+	return "sent"
+}
+
+func printEntry(entry *api.HistoryEntry, nameOf func(string) string) {
+	cmsg := entry.Message
+	switch {
+	case entry.Outgoing && (cmsg.RoomId == ""):
+		fmt.Printf("%s > %s (%s)\n", cmsg.Time.AsTime(), cmsg.Text, statusString(entry.Status))
+	case entry.Outgoing:
+		fmt.Printf("%s > %s\n", cmsg.Time.AsTime(), cmsg.Text)
+	case cmsg.RoomId != "":
+		fmt.Printf("%s < %s: %s\n", cmsg.Time.AsTime(), nameOf(cmsg.AuthorAddress), cmsg.Text)
+	default:
+		fmt.Printf("%s < %s\n", cmsg.Time.AsTime(), cmsg.Text)
+	}
+}
+
 func openChatHandler(cCtx *cli.Context, ll *logrus.Entry, daemonClient api.DaemonClient) (err error) {
+	roomID := cCtx.String("room")
+	if (cCtx.String("recepient") == "") == (roomID == "") {
+		return fmt.Errorf("exactly one of --recepient and --room must be set")
+	}
+	var recepientAddress string
+	if roomID == "" {
+		var recepient contacts.Contact
+		if recepient, err = resolveContact(cCtx, ll, "recepient"); err != nil {
+			return err
+		}
+		recepientAddress = recepient.Address
+		ll = ll.WithFields(logrus.Fields{"chat": recepientAddress, "peer": recepientAddress})
+	} else {
+		ll = ll.WithFields(logrus.Fields{"chat": roomID})
+	}
+	nameOf := contactNames(cCtx, ll)
+
+	if limit := cCtx.Uint("history"); limit > 0 {
+		var history *api.HistoryResponse
+		if history, err = daemonClient.History(cCtx.Context, &api.HistoryRequest{
+			RecepientAddress: recepientAddress,
+			RoomId:           roomID,
+			Limit:            uint32(limit),
+		}); err != nil {
+			return fmt.Errorf("failed to get history: %s", err)
+		}
+		for _, entry := range history.Entries {
+			printEntry(entry, nameOf)
+		}
+	}
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), natsdaemon.RecepientMetadataKey, recepientAddress)
+	if roomID != "" {
+		ctx = metadata.AppendToOutgoingContext(context.Background(), natsdaemon.RoomMetadataKey, roomID)
+	}
+
 	var daemonSendClient api.Daemon_SendClient
-	if daemonSendClient, err = daemonClient.Send(context.Background()); err != nil {
+	if daemonSendClient, err = daemonClient.Send(ctx); err != nil {
 		return fmt.Errorf("failed send: %s", err)
 	}
 
+	var (
+		mu      sync.Mutex
+		sent    = make(map[string]string)
+		console = newConsole()
+	)
 	g := errgroup.Group{}
 	g.Go(func() (err error) {
-		var cmsg *api.ChatMessage
+		var event *api.ChatEvent
 		for {
-			cmsg, err = daemonSendClient.Recv()
+			event, err = daemonSendClient.Recv()
+			if err == io.EOF {
+				ll.Debugln("Stream closed, exiting cli recv loop")
+				return nil
+			}
 			if err != nil {
 				if e, ok := status.FromError(err); ok && (e.Code() == codes.Canceled) {
 					ll.Debugf("Exiting cli recv loop: %s", err)
@@ -259,25 +479,86 @@ func openChatHandler(cCtx *cli.Context, ll *logrus.Entry, daemonClient api.Daemo
 				}
 			}
 
-			fmt.Printf("%s %s\n", cmsg.Time.AsTime(), cmsg.Text)
+			switch e := event.Event.(type) {
+			case *api.ChatEvent_Message:
+				if e.Message.RoomId != "" {
+					console.Printf("%s %s: %s\n", e.Message.Time.AsTime(), nameOf(e.Message.AuthorAddress), e.Message.Text)
+					continue
+				}
+				console.Printf("%s %s\n", e.Message.Time.AsTime(), e.Message.Text)
+				if _, err = daemonClient.MarkRead(cCtx.Context, &api.ReadRequest{
+					RecepientAddress: recepientAddress,
+					MessageIds:       []string{e.Message.Id},
+				}); err != nil {
+					ll.Warnf("Unable to mark message as read: %s", err)
+				}
+			case *api.ChatEvent_Receipt:
+				mu.Lock()
+				text, ok := sent[e.Receipt.MessageId]
+				mu.Unlock()
+				if ok {
+					console.Printf("%s %s: %s\n", e.Receipt.Time.AsTime(), statusString(e.Receipt.Status), text)
+				}
+			case *api.ChatEvent_Typing:
+				if e.Typing.Typing {
+					console.Printf("%s %s is typing...\n", e.Typing.Time.AsTime(), nameOf(e.Typing.AuthorAddress))
+				} else {
+					console.Printf("%s %s stopped typing\n", e.Typing.Time.AsTime(), nameOf(e.Typing.AuthorAddress))
+				}
+			case *api.ChatEvent_Room:
+				if e.Room.Left {
+					console.Printf("%s %s left the room\n", e.Room.Time.AsTime(), nameOf(e.Room.AuthorAddress))
+				}
+				for _, invited := range e.Room.InvitedAddresses {
+					console.Printf("%s %s invited %s\n", e.Room.Time.AsTime(), nameOf(e.Room.AuthorAddress), nameOf(invited))
+				}
+			case *api.ChatEvent_Security:
+				console.Fprintf(os.Stderr, "%s SECURITY WARNING from %s: %s\n",
+					e.Security.Time.AsTime(), nameOf(e.Security.AuthorAddress), e.Security.Reason)
+			case *api.ChatEvent_Connection:
+				printConnection(console, e.Connection)
+			}
 		}
 	})
 
 	g.Go(func() (err error) {
 		defer daemonSendClient.CloseSend()
-		scanner := bufio.NewScanner(os.Stdin)
-		for scanner.Scan() {
+		var lastTyping time.Time
+		sendLine := func(text string) (err error) {
 			cmsg := &api.ChatMessage{
-				Text: scanner.Text(),
+				Text: text,
 				Time: timestamppb.Now(),
 			}
-			if err = daemonSendClient.Send(cmsg); err != nil {
+			if cmsg.Id, err = natsdaemon.NewID(); err != nil {
+				return err
+			}
+			mu.Lock()
+			sent[cmsg.Id] = cmsg.Text
+			mu.Unlock()
+			if err = daemonSendClient.Send(&api.ChatInput{
+				Input: &api.ChatInput_Message{Message: cmsg},
+			}); err != nil {
 				return fmt.Errorf("Unexpected error sending message: %s", err)
 			}
+			lastTyping = time.Time{}
 			ll.Debugf("Sent message: %s", cmsg)
+			return nil
+		}
+		sendTyping := func() error {
+			// Typing is only sent in chats and at most once per interval
+			if (roomID != "") || (time.Since(lastTyping) < natsdaemon.TypingInterval) {
+				return nil
+			}
+			lastTyping = time.Now()
+			if err := daemonSendClient.Send(&api.ChatInput{
+				Input: &api.ChatInput_Typing{Typing: &api.Typing{}},
+			}); err != nil {
+				return fmt.Errorf("Unexpected error sending typing: %s", err)
+			}
+			return nil
 		}
-		if scanner.Err() != nil {
-			return fmt.Errorf("Got error from scanner: %s", err)
+		if err = console.ReadLines(sendLine, sendTyping); err != nil {
+			return err
 		}
 		ll.Debugln("Got EOF, exiting cli send loop")
 		return nil
@@ -288,3 +569,174 @@ func openChatHandler(cCtx *cli.Context, ll *logrus.Entry, daemonClient api.Daemo
 	}
 	return nil
 }
+
+func NewCreateRoomHandler(logger *logrus.Logger) cli.ActionFunc {
+	ll := logger.WithFields(logrus.Fields{
+		"component": "RoomHandler",
+	})
+	return WrapCliHandler(WrapCliDaemonHandler(createRoomHandler), ll)
+}
+
+func createRoomHandler(cCtx *cli.Context, ll *logrus.Entry, daemonClient api.DaemonClient) (err error) {
+	var room *api.Room
+	if room, err = daemonClient.CreateRoom(cCtx.Context, &api.CreateRoomRequest{
+		Name: cCtx.String("name"),
+	}); err != nil {
+		return fmt.Errorf("error creating room: %s", err)
+	}
+	fmt.Printf("Room id is:\n%s\n", room.RoomId)
+	return nil
+}
+
+func NewInviteHandler(logger *logrus.Logger) cli.ActionFunc {
+	ll := logger.WithFields(logrus.Fields{
+		"component": "RoomHandler",
+	})
+	return WrapCliHandler(WrapCliDaemonHandler(inviteHandler), ll)
+}
+
+func inviteHandler(cCtx *cli.Context, ll *logrus.Entry, daemonClient api.DaemonClient) (err error) {
+	var member contacts.Contact
+	if member, err = resolveContact(cCtx, ll, "member"); err != nil {
+		return err
+	}
+
+	_, err = daemonClient.InviteToRoom(cCtx.Context, &api.RoomInviteRequest{
+		RoomId:          cCtx.String("room"),
+		MemberAddress:   member.Address,
+		PinnedPublicKey: member.PublicKey,
+	})
+	if e, ok := status.FromError(err); ok && (e.Code() == codes.PermissionDenied) {
+		return fmt.Errorf("member failed to prove its identity: %s", e.Message())
+	}
+	return err
+}
+
+func NewLeaveRoomHandler(logger *logrus.Logger) cli.ActionFunc {
+	ll := logger.WithFields(logrus.Fields{
+		"component": "RoomHandler",
+	})
+	return WrapCliHandler(WrapCliDaemonHandler(leaveRoomHandler), ll)
+}
+
+func leaveRoomHandler(cCtx *cli.Context, ll *logrus.Entry, daemonClient api.DaemonClient) (err error) {
+	_, err = daemonClient.LeaveRoom(cCtx.Context, &api.RoomRequest{
+		RoomId: cCtx.String("room"),
+	})
+	return err
+}
+
+func NewRoomsHandler(logger *logrus.Logger) cli.ActionFunc {
+	ll := logger.WithFields(logrus.Fields{
+		"component": "RoomHandler",
+	})
+	return WrapCliHandler(WrapCliDaemonHandler(roomsHandler), ll)
+}
+
+func roomsHandler(cCtx *cli.Context, ll *logrus.Entry, daemonClient api.DaemonClient) (err error) {
+	nameOf := contactNames(cCtx, ll)
+	var list *api.RoomList
+	if list, err = daemonClient.ListRooms(cCtx.Context, &emptypb.Empty{}); err != nil {
+		return fmt.Errorf("error listing rooms: %s", err)
+	}
+	for _, room := range list.Rooms {
+		fmt.Printf("%s %s\n", room.RoomId, room.Name)
+		for _, member := range room.MemberAddresses {
+			fmt.Printf("  %s\n", nameOf(member))
+		}
+	}
+	return nil
+}
+
+func printConnection(console *console, event *api.ConnectionEvent) {
+	switch event.State {
+	case api.ConnectionState_DISCONNECTED:
+		console.Fprintf(os.Stderr, "%s connection to nats lost: %s, reconnecting\n", event.Time.AsTime(), event.Error)
+	case api.ConnectionState_RECONNECTED:
+		console.Fprintf(os.Stderr, "%s reconnected to nats\n", event.Time.AsTime())
+	case api.ConnectionState_CLOSED:
+		console.Fprintf(os.Stderr, "%s connection to nats closed, go offline and online again\n", event.Time.AsTime())
+	}
+}
+
+func NewWhoHandler(logger *logrus.Logger) cli.ActionFunc {
+	ll := logger.WithFields(logrus.Fields{
+		"component": "WhoHandler",
+	})
+	return WrapCliHandler(WrapCliDaemonHandler(whoHandler), ll)
+}
+
+func printPresence(name string, event *api.PresenceEvent) {
+	switch {
+	case event.Online:
+		fmt.Printf("%s online\n", name)
+	case event.LastSeen != nil:
+		fmt.Printf("%s offline, last seen %s\n", name, event.LastSeen.AsTime())
+	default:
+		fmt.Printf("%s offline, never seen\n", name)
+	}
+}
+
+func whoHandler(cCtx *cli.Context, ll *logrus.Entry, daemonClient api.DaemonClient) (err error) {
+	var book *contacts.Book
+	if book, err = contacts.Open(cCtx.String("contacts")); err != nil {
+		return err
+	}
+	var addresses []string
+	for _, arg := range cCtx.Args().Slice() {
+		var contact contacts.Contact
+		if contact, err = book.Resolve(arg); err != nil {
+			return err
+		}
+		warnLegacy(ll, contact.Address)
+		addresses = append(addresses, contact.Address)
+	}
+	if len(addresses) == 0 {
+		for _, contact := range book.List() {
+			addresses = append(addresses, contact.Address)
+		}
+	}
+	if len(addresses) == 0 {
+		return fmt.Errorf("no contacts to watch")
+	}
+
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+		watch  = cCtx.Bool("watch")
+	)
+	if watch {
+		ctx, cancel = context.WithCancel(cCtx.Context)
+	} else {
+		ctx, cancel = context.WithTimeout(cCtx.Context, cCtx.Duration("wait"))
+	}
+	defer cancel()
+
+	var stream api.Daemon_WatchPresenceClient
+	if stream, err = daemonClient.WatchPresence(ctx, &api.PresenceRequest{Addresses: addresses}); err != nil {
+		return fmt.Errorf("failed to watch presence: %s", err)
+	}
+	latest := make(map[string]*api.PresenceEvent)
+	for {
+		var event *api.PresenceEvent
+		if event, err = stream.Recv(); err != nil {
+			if e, ok := status.FromError(err); ok && ((e.Code() == codes.DeadlineExceeded) || (e.Code() == codes.Canceled)) {
+				break
+			}
+			return fmt.Errorf("Unexpected error from stream: %s", err)
+		}
+		if watch {
+			printPresence(book.NameOf(event.Address), event)
+		} else {
+			latest[event.Address] = event
+		}
+	}
+
+	for _, address := range addresses {
+		if event, ok := latest[address]; ok {
+			printPresence(book.NameOf(address), event)
+			delete(latest, address)
+		}
+	}
+	return nil
+}
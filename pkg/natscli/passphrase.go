@@ -0,0 +1,89 @@
+package natscli
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/aaletov/nats-chat/pkg/profile"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/term"
+)
+
+const (
+	PassphraseEnv        = "NATS_CHAT_PASSPHRASE"
+	NewPassphraseEnv     = "NATS_CHAT_NEW_PASSPHRASE"
+	ArchivePassphraseEnv = "NATS_CHAT_ARCHIVE_PASSPHRASE"
+)
+
+var (
+	passphraseOnce   sync.Once
+	passphraseReader *bufio.Reader
+)
+
+// readPassphraseFd reads the next line from the file descriptor given with
+// --passphrase-fd, so several passphrases can be passed one per line
+func readPassphraseFd(cCtx *cli.Context) ([]byte, error) {
+	passphraseOnce.Do(func() {
+		fd := cCtx.Int("passphrase-fd")
+		passphraseReader = bufio.NewReader(os.NewFile(uintptr(fd), fmt.Sprintf("fd%d", fd)))
+	})
+	line, err := passphraseReader.ReadString('\n')
+	if (err != nil) && (line == "") {
+		return nil, fmt.Errorf("error reading passphrase: %s", err)
+	}
+	return []byte(strings.TrimRight(line, "\r\n")), nil
+}
+
+func promptPassphrase(prompt string) ([]byte, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("error reading passphrase: %s", err)
+	}
+	return passphrase, nil
+}
+
+// readPassphrase takes the passphrase from env, the file descriptor given with
+// --passphrase-fd or prompts for it in the terminal, in that order. New
+// passphrases are prompted twice. It returns nil if there is no source.
+func readPassphrase(cCtx *cli.Context, env string, prompt string, confirm bool) ([]byte, error) {
+	if passphrase, ok := os.LookupEnv(env); ok {
+		return []byte(passphrase), nil
+	}
+	if cCtx.IsSet("passphrase-fd") {
+		return readPassphraseFd(cCtx)
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return nil, nil
+	}
+
+	passphrase, err := promptPassphrase(prompt)
+	if (err != nil) || !confirm || (len(passphrase) == 0) {
+		return passphrase, err
+	}
+	var repeated []byte
+	if repeated, err = promptPassphrase("Repeat passphrase: "); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(passphrase, repeated) {
+		return nil, fmt.Errorf("passphrases do not match")
+	}
+	return passphrase, nil
+}
+
+// profilePassphrase returns PassphraseFunc for the encrypted profile, the
+// passphrase it read is kept in read
+func profilePassphrase(cCtx *cli.Context, profilePath string, read *[]byte) profile.PassphraseFunc {
+	return func() ([]byte, error) {
+		passphrase, err := readPassphrase(cCtx, PassphraseEnv, fmt.Sprintf("Passphrase of %s: ", profilePath), false)
+		if read != nil {
+			*read = passphrase
+		}
+		return passphrase, err
+	}
+}
@@ -0,0 +1,103 @@
+package natscli
+
+import (
+	"crypto"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	api "github.com/aaletov/nats-chat/api/generated"
+	"github.com/aaletov/nats-chat/pkg/profile"
+	"github.com/aaletov/nats-chat/pkg/rotation"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+func NewRotateHandler(logger *logrus.Logger) cli.ActionFunc {
+	ll := logger.WithFields(logrus.Fields{
+		"component": "RotateHandler",
+	})
+	return WrapCliHandler(rotateHandler, ll)
+}
+
+// rotateHandler replaces the key of the profile, the old key pair is archived
+// next to the new one and the new private key keeps the old passphrase
+func rotateHandler(cCtx *cli.Context, ll *logrus.Entry) (err error) {
+	var (
+		oldProfile      profile.Profile
+		passphrase      []byte
+		newKey          crypto.Signer
+		privateKeyBlock *pem.Block
+		rmsg            *api.NatsRotation
+	)
+	profilePath := cCtx.String("profile")
+	if oldProfile, err = profile.ReadProfile(profilePath, profilePassphrase(cCtx, profilePath, &passphrase)); err != nil {
+		return err
+	}
+	if newKey, err = profile.GenerateKey(profile.KeyType(cCtx.String("type"))); err != nil {
+		return fmt.Errorf("error when generate key pair: %s", err)
+	}
+	if privateKeyBlock, err = profile.PrivateKeyBlock(newKey); err != nil {
+		return err
+	}
+	if rmsg, err = rotation.New(oldProfile, newKey); err != nil {
+		return err
+	}
+
+	// the new key pair is written and synced first, the old one is archived
+	// and the new one renamed into place, the statement is saved last. Any
+	// error restores the old key pair.
+	names := []string{"private", "public"}
+	temp := make(map[string]string, len(names))
+	defer func() {
+		for _, tmpPath := range temp {
+			os.Remove(tmpPath)
+		}
+	}()
+	if temp["private"], err = profile.WriteTempPrivateKey(filepath.Join(profilePath, "private.pem"), privateKeyBlock, passphrase); err != nil {
+		return err
+	}
+	if temp["public"], err = profile.WriteTempPublicKey(filepath.Join(profilePath, "public.pem"), newKey.Public()); err != nil {
+		return err
+	}
+
+	oldAddress := oldProfile.GetAddress()
+	current := func(name string) string {
+		return filepath.Join(profilePath, name+".pem")
+	}
+	archived := func(name string) string {
+		return filepath.Join(profilePath, fmt.Sprintf("%s.%s.pem", name, oldAddress))
+	}
+	var moved []string
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, name := range moved {
+			if restoreErr := os.Rename(archived(name), current(name)); restoreErr != nil {
+				ll.Errorf("Error restoring %s: %s", current(name), restoreErr)
+			}
+		}
+	}()
+	for _, name := range names {
+		if err = os.Rename(current(name), archived(name)); err != nil {
+			return fmt.Errorf("error archiving %s: %s", current(name), err)
+		}
+		moved = append(moved, name)
+	}
+	for _, name := range names {
+		if err = os.Rename(temp[name], current(name)); err != nil {
+			return fmt.Errorf("error writing %s: %s", current(name), err)
+		}
+		delete(temp, name)
+	}
+	if err = rotation.Save(profilePath, rmsg); err != nil {
+		return err
+	}
+
+	ll.Printf("Rotated %s key to %s key", oldProfile.GetKeyType(), cCtx.String("type"))
+	fmt.Printf("Your new address is:\n%s\n", rmsg.NewAddress)
+	fmt.Println("Go offline and online again to announce it to your contacts")
+	return nil
+}
@@ -0,0 +1,53 @@
+package natscli
+
+import (
+	"fmt"
+	"time"
+
+	api "github.com/aaletov/nats-chat/api/generated"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+func NewStatusHandler(logger *logrus.Logger) cli.ActionFunc {
+	ll := logger.WithFields(logrus.Fields{
+		"component": "StatusHandler",
+	})
+	return WrapCliHandler(WrapCliDaemonHandler(statusHandler), ll)
+}
+
+func statusHandler(cCtx *cli.Context, ll *logrus.Entry, daemonClient api.DaemonClient) (err error) {
+	nameOf := contactNames(cCtx, ll)
+	var status *api.StatusResponse
+	if status, err = daemonClient.Status(cCtx.Context, &emptypb.Empty{}); err != nil {
+		return fmt.Errorf("error getting status: %s", err)
+	}
+	fmt.Printf("daemon %s, up %s\n", status.Version, status.Uptime.AsDuration().Round(time.Second))
+	session := status.Session
+	if session == nil {
+		fmt.Println("offline")
+		return nil
+	}
+
+	fmt.Printf("online as %s since %s\n", session.SenderAddress, session.OnlineSince.AsTime())
+	inbox := ""
+	if session.Jetstream {
+		inbox = ", jetstream inbox"
+	}
+	fmt.Printf("nats %s at %s (%s)%s\n", session.NatsStatus, session.NatsUrl, session.NatsServer, inbox)
+	stats := session.Statistics
+	fmt.Printf("  messages in %d, out %d, bytes in %d, out %d, reconnects %d\n",
+		stats.InMsgs, stats.OutMsgs, stats.InBytes, stats.OutBytes, stats.Reconnects)
+
+	fmt.Printf("chats: %d\n", len(session.Chats))
+	for _, chat := range session.Chats {
+		fmt.Printf("  %s since %s, sent %d, received %d, opened %d\n",
+			nameOf(chat.RecepientAddress), chat.Created.AsTime(), chat.Sent, chat.Received, chat.Opened)
+	}
+	fmt.Printf("rooms: %d\n", len(session.Rooms))
+	for _, room := range session.Rooms {
+		fmt.Printf("  %s %s, %d members\n", room.RoomId, room.Name, len(room.MemberAddresses))
+	}
+	return nil
+}
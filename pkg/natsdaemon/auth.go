@@ -0,0 +1,90 @@
+package natsdaemon
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	api "github.com/aaletov/nats-chat/api/generated"
+	"github.com/nats-io/nats.go"
+)
+
+func readSecret(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("error reading secret: %s", err)
+	}
+	secret := strings.TrimSpace(string(data))
+	if secret == "" {
+		return "", fmt.Errorf("secret file %s is empty", path)
+	}
+	return secret, nil
+}
+
+// natsOptions returns options which authenticate the connection with creds, at
+// most one authentication method may be set
+func natsOptions(creds *api.NatsCredentials) ([]nats.Option, error) {
+	var options []nats.Option
+	if creds == nil {
+		return options, nil
+	}
+
+	methods := 0
+	for _, set := range []bool{
+		(creds.User != "") || (creds.PasswordFile != ""),
+		creds.TokenFile != "",
+		creds.NkeySeedFile != "",
+		creds.CredsFile != "",
+	} {
+		if set {
+			methods++
+		}
+	}
+	if methods > 1 {
+		return nil, errors.New("only one of user, token, nkey and creds may be set")
+	}
+
+	switch {
+	case (creds.User != "") || (creds.PasswordFile != ""):
+		if creds.User == "" {
+			return nil, errors.New("password requires user")
+		}
+		var password string
+		if creds.PasswordFile != "" {
+			var err error
+			if password, err = readSecret(creds.PasswordFile); err != nil {
+				return nil, err
+			}
+		}
+		options = append(options, nats.UserInfo(creds.User, password))
+	case creds.TokenFile != "":
+		token, err := readSecret(creds.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, nats.Token(token))
+	case creds.NkeySeedFile != "":
+		option, err := nats.NkeyOptionFromSeed(creds.NkeySeedFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading nkey seed: %s", err)
+		}
+		options = append(options, option)
+	case creds.CredsFile != "":
+		if _, err := os.Stat(creds.CredsFile); err != nil {
+			return nil, fmt.Errorf("error reading creds: %s", err)
+		}
+		options = append(options, nats.UserCredentials(creds.CredsFile))
+	}
+
+	if (creds.TlsCertFile == "") != (creds.TlsKeyFile == "") {
+		return nil, errors.New("tls certificate and key must be set together")
+	}
+	if creds.TlsCertFile != "" {
+		options = append(options, nats.ClientCert(creds.TlsCertFile, creds.TlsKeyFile))
+	}
+	if creds.TlsCaFile != "" {
+		options = append(options, nats.RootCAs(creds.TlsCaFile))
+	}
+	return options, nil
+}
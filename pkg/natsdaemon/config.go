@@ -0,0 +1,64 @@
+package natsdaemon
+
+import (
+	"context"
+	"time"
+
+	api "github.com/aaletov/nats-chat/api/generated"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	DefaultConnectTimeout = 30 * time.Second
+	DefaultOutageTimeout  = 30 * time.Second
+)
+
+// Config holds settings of the daemon which may be replaced while it runs,
+// they apply to requests made after the change
+type Config struct {
+	// NatsUrl and Credentials are used if online does not set them
+	NatsUrl     string
+	Credentials *api.NatsCredentials
+	// ConnectTimeout limits connecting to the nats server
+	ConnectTimeout time.Duration
+	// DialTimeout limits the handshake of createchat and invite, zero waits
+	// until the peer answers
+	DialTimeout time.Duration
+	// OutageTimeout is how long publishing to an inbox waits for the
+	// connection to come back
+	OutageTimeout time.Duration
+}
+
+func (d *daemon) Configure(config Config) {
+	d.configMu.Lock()
+	defer d.configMu.Unlock()
+	d.config = config
+	d.logger.Debugf("Configured: nats url %q, connect timeout %s, dial timeout %s, outage timeout %s",
+		config.NatsUrl, config.ConnectTimeout, config.DialTimeout, config.OutageTimeout)
+}
+
+func (d *daemon) getConfig() Config {
+	d.configMu.Lock()
+	defer d.configMu.Unlock()
+	return d.config
+}
+
+// onlineDefaults fills the nats url and credentials of req missing from it
+func (c Config) onlineDefaults(req *api.OnlineRequest) (natsUrl string, creds *api.NatsCredentials) {
+	natsUrl, creds = req.NatsUrl, req.Credentials
+	if natsUrl == "" {
+		natsUrl = c.NatsUrl
+	}
+	if proto.Size(creds) == 0 {
+		creds = c.Credentials
+	}
+	return natsUrl, creds
+}
+
+// dialContext limits ctx with the dial timeout
+func (c Config) dialContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.DialTimeout > 0 {
+		return context.WithTimeout(ctx, c.DialTimeout)
+	}
+	return context.WithCancel(ctx)
+}
@@ -0,0 +1,659 @@
+package natsdaemon
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	api "github.com/aaletov/nats-chat/api/generated"
+	"github.com/aaletov/nats-chat/pkg/envelope"
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	fileSubjectFmt     = "file.%s.%s"
+	fileChunkSize      = 128 * 1024
+	fileRequestTimeout = 5 * time.Second
+	fileRetries        = 3
+	partSuffix         = ".part"
+	// Offers are kept until they are answered, so offers beyond
+	// maxOffersPerChat in a chat or maxOffers in total are rejected and
+	// offers older than offerTTL expire
+	maxOffers           = 64
+	maxOffersPerChat    = 8
+	offerTTL            = time.Hour
+	offerExpiryInterval = time.Minute
+)
+
+var (
+	ErrOfferNotFound = errors.New("file offer not found")
+	errTooManyOffers = errors.New("too many pending offers")
+)
+
+// outgoingFile is a file offered by the daemon, its progress is reported to
+// the cli which sent it
+type outgoingFile struct {
+	file     *os.File
+	offer    *api.NatsFileOffer
+	progress chan *api.FileProgress
+}
+
+// fileOffers keeps offers received in all chats until they are answered, they
+// are keyed by ids assigned by the daemon as authors choose ids of their offers
+type fileOffers struct {
+	mu       sync.Mutex
+	offers   map[string]*fileOffer
+	watchers map[chan *fileOffer]struct{}
+	// Checksums of files being received, they share the partial download
+	receiving map[string]struct{}
+}
+
+type fileOffer struct {
+	chat *ChatConnection
+	// remoteID is the id of the offer chosen by its author
+	remoteID string
+	offer    *api.FileOffer
+}
+
+func newFileOffers() *fileOffers {
+	return &fileOffers{
+		offers:    make(map[string]*fileOffer),
+		watchers:  make(map[chan *fileOffer]struct{}),
+		receiving: make(map[string]struct{}),
+	}
+}
+
+// add keeps offer unless the same offer was already received in its chat, an
+// error is returned if the offer is over the limits
+func (f *fileOffers) add(offer *fileOffer) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	inChat := 0
+	for _, pending := range f.offers {
+		if pending.chat != offer.chat {
+			continue
+		}
+		if pending.remoteID == offer.remoteID {
+			return nil
+		}
+		inChat++
+	}
+	if len(f.offers) >= maxOffers {
+		return fmt.Errorf("%w: %d offers are pending", errTooManyOffers, len(f.offers))
+	}
+	if inChat >= maxOffersPerChat {
+		return fmt.Errorf("%w: %d offers of the chat are pending", errTooManyOffers, inChat)
+	}
+	f.offers[offer.offer.Id] = offer
+	for watcher := range f.watchers {
+		select {
+		case watcher <- offer:
+		default:
+		}
+	}
+	return nil
+}
+
+// expire removes offers received before the ttl and returns them
+func (f *fileOffers) expire(now time.Time) []*fileOffer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var expired []*fileOffer
+	for id, offer := range f.offers {
+		if now.Sub(offer.offer.Time.AsTime()) > offerTTL {
+			expired = append(expired, offer)
+			delete(f.offers, id)
+		}
+	}
+	return expired
+}
+
+// take removes the offer, so it is answered only once
+func (f *fileOffers) take(id string) (*fileOffer, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	offer, ok := f.offers[id]
+	delete(f.offers, id)
+	return offer, ok
+}
+
+// drop removes offers received in the closed chat
+func (f *fileOffers) drop(chat *ChatConnection) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for id, offer := range f.offers {
+		if offer.chat == chat {
+			delete(f.offers, id)
+		}
+	}
+}
+
+// receive marks the file as being received, it fails if the same file is
+// already being received
+func (f *fileOffers) receive(sum string) (done func(), err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.receiving[sum]; ok {
+		return nil, fmt.Errorf("file with checksum %s is already being received", sum)
+	}
+	f.receiving[sum] = struct{}{}
+	return func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		delete(f.receiving, sum)
+	}, nil
+}
+
+// watch returns pending offers and subscribes to the new ones until cancel is
+// called
+func (f *fileOffers) watch() (pending []*fileOffer, offers chan *fileOffer, cancel func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, offer := range f.offers {
+		pending = append(pending, offer)
+	}
+	offers = make(chan *fileOffer, eventsBacklog)
+	f.watchers[offers] = struct{}{}
+	return pending, offers, func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		delete(f.watchers, offers)
+	}
+}
+
+func (c *ChatConnection) publishFile(fmsg *api.NatsFile) error {
+	var (
+		err     error
+		payload []byte
+		data    []byte
+	)
+	if payload, err = proto.Marshal(fmsg); err != nil {
+		return fmt.Errorf("unable to marshal file message: %s", err)
+	}
+	if data, err = sealFor(c.senderKey, envelope.KindFile, c.RecepientAddress, c.recepientKey, payload); err != nil {
+		return err
+	}
+	return c.nc.Publish(fmt.Sprintf(fileSubjectFmt, c.RecepientAddress, c.SenderAddress), data)
+}
+
+// requestChunk asks the recepient for the chunk of the offered file at offset
+func (c *ChatConnection) requestChunk(id string, offset uint64) (*api.NatsFileChunk, error) {
+	var (
+		err     error
+		payload []byte
+		data    []byte
+		reply   *nats.Msg
+	)
+	fmsg := &api.NatsFile{
+		Payload: &api.NatsFile_Request{
+			Request: &api.NatsFileRequest{
+				Id:     id,
+				State:  api.FileState_TRANSFERRING,
+				Offset: offset,
+			},
+		},
+	}
+	if payload, err = proto.Marshal(fmsg); err != nil {
+		return nil, fmt.Errorf("unable to marshal file request: %s", err)
+	}
+	if data, err = sealFor(c.senderKey, envelope.KindFile, c.RecepientAddress, c.recepientKey, payload); err != nil {
+		return nil, err
+	}
+	subject := fmt.Sprintf(fileSubjectFmt, c.RecepientAddress, c.SenderAddress)
+	if reply, err = c.nc.Request(subject, data, fileRequestTimeout); err != nil {
+		return nil, fmt.Errorf("chunk request failed: %s", err)
+	}
+	if payload, err = c.open(envelope.KindChunk, reply.Data); err != nil {
+		return nil, err
+	}
+	chunk := &api.NatsFileChunk{}
+	if err = proto.Unmarshal(payload, chunk); err != nil {
+		return nil, fmt.Errorf("error unmarshalling chunk: %s", err)
+	}
+	sum := sha256.Sum256(chunk.Data)
+	switch {
+	case (chunk.Id != id) || (chunk.Offset != offset):
+		return nil, fmt.Errorf("got chunk %s at %d instead of %s at %d", chunk.Id, chunk.Offset, id, offset)
+	case len(chunk.Data) == 0:
+		return nil, fmt.Errorf("got empty chunk at %d", offset)
+	case !bytes.Equal(sum[:], chunk.Sha256):
+		return nil, fmt.Errorf("checksum mismatch of chunk at %d", offset)
+	}
+	return chunk, nil
+}
+
+func (c *ChatConnection) handleFile(msg *nats.Msg) {
+	ll := c.logger.WithFields(logrus.Fields{
+		"method": "handleFile",
+	})
+	var (
+		err     error
+		payload []byte
+	)
+	if payload, err = c.open(envelope.KindFile, msg.Data); err != nil {
+		ll.Warnf("Dropping file message: %s", err)
+		return
+	}
+	fmsg := &api.NatsFile{}
+	if err = proto.Unmarshal(payload, fmsg); err != nil {
+		ll.Errorf("Error unmarshalling file message: %s", err)
+		return
+	}
+
+	switch p := fmsg.Payload.(type) {
+	case *api.NatsFile_Offer:
+		name := filepath.Base(p.Offer.Name)
+		if (name == ".") || (name == "..") || (name == string(filepath.Separator)) || (len(p.Offer.Sha256) != sha256.Size) {
+			ll.Warnf("Dropping invalid offer of %q", p.Offer.Name)
+			return
+		}
+		var id string
+		if id, err = NewID(); err != nil {
+			ll.Error(err)
+			return
+		}
+		err = c.offers.add(&fileOffer{
+			chat:     c,
+			remoteID: p.Offer.Id,
+			offer: &api.FileOffer{
+				Time:          timestamppb.Now(),
+				Id:            id,
+				AuthorAddress: c.RecepientAddress,
+				Name:          name,
+				Size:          p.Offer.Size,
+				Sha256:        p.Offer.Sha256,
+			},
+		})
+		if err != nil {
+			ll.Warnf("Rejecting offer of %s: %s", name, err)
+			if err = c.endTransfer(p.Offer.Id, api.FileState_REJECTED, err.Error()); err != nil {
+				ll.Warnf("Unable to reject offer: %s", err)
+			}
+			return
+		}
+		ll.Debugf("Got offer of %s from %s", name, c.RecepientAddress)
+	case *api.NatsFile_Request:
+		c.serveFile(ll, msg, p.Request)
+	}
+}
+
+// serveFile replies to the request of the recepient for the offered file
+func (c *ChatConnection) serveFile(ll *logrus.Entry, msg *nats.Msg, req *api.NatsFileRequest) {
+	c.mu.Lock()
+	out, ok := c.outgoing[req.Id]
+	c.mu.Unlock()
+	if !ok {
+		ll.Warnf("Request for unknown file %s", req.Id)
+		return
+	}
+	progress := &api.FileProgress{
+		Id:     req.Id,
+		State:  req.State,
+		Offset: req.Offset,
+		Size:   out.offer.Size,
+		Error:  req.Error,
+	}
+	if req.State != api.FileState_TRANSFERRING {
+		select {
+		case out.progress <- progress:
+		case <-c.done:
+		}
+		return
+	}
+
+	var (
+		err     error
+		n       int
+		payload []byte
+		data    []byte
+	)
+	buf := make([]byte, fileChunkSize)
+	if n, err = out.file.ReadAt(buf, int64(req.Offset)); (err != nil) && (err != io.EOF) {
+		ll.Errorf("Unable to read %s: %s", out.file.Name(), err)
+		return
+	}
+	sum := sha256.Sum256(buf[:n])
+	chunk := &api.NatsFileChunk{
+		Id:     req.Id,
+		Offset: req.Offset,
+		Data:   buf[:n],
+		Sha256: sum[:],
+	}
+	if payload, err = proto.Marshal(chunk); err != nil {
+		ll.Errorf("Unable to marshal chunk: %s", err)
+		return
+	}
+	if data, err = sealFor(c.senderKey, envelope.KindChunk, c.RecepientAddress, c.recepientKey, payload); err != nil {
+		ll.Errorf("Unable to seal chunk: %s", err)
+		return
+	}
+	if err = msg.Respond(data); err != nil {
+		ll.Errorf("Unable to send chunk: %s", err)
+		return
+	}
+	progress.Offset += uint64(n)
+	select {
+	case out.progress <- progress:
+	default:
+	}
+}
+
+func fileChecksum(file *os.File) ([]byte, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(file, 0, 1<<62)); err != nil {
+		return nil, fmt.Errorf("unable to compute checksum: %s", err)
+	}
+	return h.Sum(nil), nil
+}
+
+// SendFile offers the file to the recepient and reports the progress to send
+// until the transfer is over or ctx is done
+func (c *ChatConnection) SendFile(ctx context.Context, path string, send func(*api.FileProgress) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("unable to open file: %s", err)
+	}
+	defer file.Close()
+	return c.offerFile(ctx, file, filepath.Base(path), send)
+}
+
+// offerFile offers the file under name like SendFile
+func (c *ChatConnection) offerFile(ctx context.Context, file *os.File, name string, send func(*api.FileProgress) error) error {
+	ll := c.logger.WithFields(logrus.Fields{
+		"method": "SendFile",
+	})
+	var (
+		err  error
+		info os.FileInfo
+		out  = &outgoingFile{file: file, progress: make(chan *api.FileProgress, eventsBacklog)}
+	)
+	if info, err = out.file.Stat(); err != nil {
+		return fmt.Errorf("unable to stat file: %s", err)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", name)
+	}
+	out.offer = &api.NatsFileOffer{
+		Name: name,
+		Size: uint64(info.Size()),
+	}
+	if out.offer.Sha256, err = fileChecksum(out.file); err != nil {
+		return err
+	}
+	if out.offer.Id, err = NewID(); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.outgoing[out.offer.Id] = out
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.outgoing, out.offer.Id)
+		c.mu.Unlock()
+	}()
+
+	if err = c.publishFile(&api.NatsFile{Payload: &api.NatsFile_Offer{Offer: out.offer}}); err != nil {
+		return fmt.Errorf("unable to publish offer: %s", err)
+	}
+	ll.Debugf("Offered %s to %s", name, c.RecepientAddress)
+	if err = send(&api.FileProgress{Id: out.offer.Id, State: api.FileState_OFFERED, Size: out.offer.Size}); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-c.done:
+			return fmt.Errorf("chat with %s was closed", c.RecepientAddress)
+		case progress := <-out.progress:
+			if err = send(progress); err != nil {
+				return err
+			}
+			if progress.State != api.FileState_TRANSFERRING {
+				ll.Debugf("Transfer of %s is over: %s", name, progress.State)
+				return nil
+			}
+		}
+	}
+}
+
+// receiveUpload writes the contents of the file streamed by a client to file,
+// the stream has to carry exactly size bytes
+func receiveUpload(srv api.Daemon_UploadFileServer, file *os.File, size uint64) error {
+	var (
+		err      error
+		upload   *api.FileUpload
+		received uint64
+	)
+	for {
+		if upload, err = srv.Recv(); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		data := upload.GetData()
+		if received+uint64(len(data)) > size {
+			return status.Errorf(codes.InvalidArgument, "upload is larger than %d bytes", size)
+		}
+		if _, err = file.Write(data); err != nil {
+			return fmt.Errorf("unable to write upload: %s", err)
+		}
+		received += uint64(len(data))
+	}
+	if received != size {
+		return status.Errorf(codes.InvalidArgument, "upload ended at %d of %d bytes", received, size)
+	}
+	return nil
+}
+
+// endTransfer tells the recepient the transfer is over
+func (c *ChatConnection) endTransfer(id string, state api.FileState, reason string) error {
+	return c.publishFile(&api.NatsFile{
+		Payload: &api.NatsFile_Request{
+			Request: &api.NatsFileRequest{
+				Id:    id,
+				State: state,
+				Error: reason,
+			},
+		},
+	})
+}
+
+// destination returns a path for name in dir which is not taken yet
+func destination(dir string, name string) string {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	path := filepath.Join(dir, name)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return path
+		}
+		path = filepath.Join(dir, fmt.Sprintf("%s (%d)%s", base, i, ext))
+	}
+}
+
+// receiveFile downloads the offered file into dir, the progress is reported
+// under the id assigned by the daemon. Partial downloads are named after the
+// checksum of the file, so the transfer resumes if the same file is offered
+// again.
+func (c *ChatConnection) receiveFile(ctx context.Context, remoteID string, offer *api.FileOffer, dir string, send func(*api.FileProgress) error) (err error) {
+	ll := c.logger.WithFields(logrus.Fields{
+		"method": "receiveFile",
+	})
+	var (
+		file     *os.File
+		info     os.FileInfo
+		chunk    *api.NatsFileChunk
+		sum      []byte
+		offset   uint64
+		received func()
+	)
+	progress := &api.FileProgress{
+		Id:    offer.Id,
+		State: api.FileState_TRANSFERRING,
+		Size:  offer.Size,
+	}
+	// Failures are reported to both the author and the cli
+	defer func() {
+		if err == nil {
+			return
+		}
+		if ctx.Err() != nil {
+			err = fmt.Errorf("transfer was cancelled")
+		}
+		if perr := c.endTransfer(remoteID, api.FileState_FAILED, err.Error()); perr != nil {
+			ll.Warnf("Unable to end transfer: %s", perr)
+		}
+		progress.State = api.FileState_FAILED
+		progress.Error = err.Error()
+		if serr := send(progress); serr == nil {
+			err = nil
+		}
+	}()
+
+	checksum := hex.EncodeToString(offer.Sha256)
+	if received, err = c.offers.receive(checksum); err != nil {
+		return err
+	}
+	defer received()
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("unable to create downloads directory: %s", err)
+	}
+	partPath := filepath.Join(dir, "."+checksum+partSuffix)
+	if file, err = os.OpenFile(partPath, os.O_RDWR|os.O_CREATE, 0600); err != nil {
+		return fmt.Errorf("unable to open %s: %s", partPath, err)
+	}
+	defer file.Close()
+	if info, err = file.Stat(); err != nil {
+		return fmt.Errorf("unable to stat %s: %s", partPath, err)
+	}
+	// Resume from the last complete chunk
+	if offset = uint64(info.Size()); offset > offer.Size {
+		offset = 0
+	}
+	if offset != offer.Size {
+		offset -= offset % fileChunkSize
+	}
+	if err = file.Truncate(int64(offset)); err != nil {
+		return fmt.Errorf("unable to truncate %s: %s", partPath, err)
+	}
+	if offset > 0 {
+		ll.Debugf("Resuming %s at %d", offer.Name, offset)
+	}
+
+	for offset < offer.Size {
+		for attempt := 1; ; attempt++ {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if chunk, err = c.requestChunk(remoteID, offset); err == nil {
+				break
+			}
+			if attempt == fileRetries {
+				return err
+			}
+			ll.Warnf("Retrying chunk at %d: %s", offset, err)
+		}
+		if _, err = file.WriteAt(chunk.Data, int64(offset)); err != nil {
+			return fmt.Errorf("unable to write %s: %s", partPath, err)
+		}
+		offset += uint64(len(chunk.Data))
+		progress.Offset = offset
+		if err = send(progress); err != nil {
+			return err
+		}
+	}
+
+	if sum, err = fileChecksum(file); err != nil {
+		return err
+	}
+	if !bytes.Equal(sum, offer.Sha256) {
+		os.Remove(partPath)
+		return fmt.Errorf("checksum mismatch of %s", offer.Name)
+	}
+	progress.Path = destination(dir, offer.Name)
+	if err = os.Rename(partPath, progress.Path); err != nil {
+		return fmt.Errorf("unable to save %s: %s", progress.Path, err)
+	}
+	if err = c.endTransfer(remoteID, api.FileState_DONE, ""); err != nil {
+		ll.Warnf("Unable to end transfer: %s", err)
+	}
+	progress.State = api.FileState_DONE
+	return send(progress)
+}
+
+// expireOffers rejects offers left unanswered for offerTTL until the session
+// is closed
+func (s *Session) expireOffers() {
+	ticker := time.NewTicker(offerExpiryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, offer := range s.offers.expire(now) {
+				s.logger.Debugf("Offer of %s from %s expired", offer.offer.Name, offer.offer.AuthorAddress)
+				if err := offer.chat.endTransfer(offer.remoteID, api.FileState_REJECTED, "offer expired"); err != nil {
+					s.logger.Warnf("Unable to reject expired offer: %s", err)
+				}
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// WatchFileOffers sends pending and new file offers to send until ctx is done
+// or the session is closed
+func (s *Session) WatchFileOffers(ctx context.Context, send func(*api.FileOffer) error) error {
+	pending, offers, cancel := s.offers.watch()
+	defer cancel()
+	for _, offer := range pending {
+		if err := send(offer.offer); err != nil {
+			return err
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-s.done:
+			return nil
+		case offer := <-offers:
+			if err := send(offer.offer); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// AnswerFileOffer rejects the offer or downloads the file reporting the
+// progress to send
+func (s *Session) AnswerFileOffer(ctx context.Context, id string, accept bool, send func(*api.FileProgress) error) error {
+	offer, ok := s.offers.take(id)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrOfferNotFound, id)
+	}
+	if !accept {
+		if err := offer.chat.endTransfer(offer.remoteID, api.FileState_REJECTED, ""); err != nil {
+			return err
+		}
+		return send(&api.FileProgress{Id: id, State: api.FileState_REJECTED, Size: offer.offer.Size})
+	}
+	return offer.chat.receiveFile(ctx, offer.remoteID, offer.offer, s.downloadsDir, send)
+}
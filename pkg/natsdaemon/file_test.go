@@ -0,0 +1,75 @@
+package natsdaemon
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	api "github.com/aaletov/nats-chat/api/generated"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func newTestOffer(chat *ChatConnection, remoteID string, received time.Time) *fileOffer {
+	return &fileOffer{
+		chat:     chat,
+		remoteID: remoteID,
+		offer: &api.FileOffer{
+			Time: timestamppb.New(received),
+			Id:   fmt.Sprintf("%p/%s", chat, remoteID),
+		},
+	}
+}
+
+func TestFileOffersLimits(t *testing.T) {
+	offers := newFileOffers()
+	now := time.Now()
+	chat := &ChatConnection{}
+	for i := 0; i < maxOffersPerChat; i++ {
+		if err := offers.add(newTestOffer(chat, fmt.Sprint(i), now)); err != nil {
+			t.Fatalf("add: %s", err)
+		}
+	}
+	if err := offers.add(newTestOffer(chat, "0", now)); err != nil {
+		t.Fatalf("add of a received offer: %s", err)
+	}
+	if err := offers.add(newTestOffer(chat, "extra", now)); !errors.Is(err, errTooManyOffers) {
+		t.Fatalf("got %v, expected %s in a chat", err, errTooManyOffers)
+	}
+
+	for len(offers.offers) < maxOffers {
+		other := &ChatConnection{}
+		for i := 0; (i < maxOffersPerChat) && (len(offers.offers) < maxOffers); i++ {
+			if err := offers.add(newTestOffer(other, fmt.Sprint(i), now)); err != nil {
+				t.Fatalf("add: %s", err)
+			}
+		}
+	}
+	if err := offers.add(newTestOffer(&ChatConnection{}, "extra", now)); !errors.Is(err, errTooManyOffers) {
+		t.Fatalf("got %v, expected %s in total", err, errTooManyOffers)
+	}
+}
+
+func TestFileOffersExpire(t *testing.T) {
+	offers := newFileOffers()
+	now := time.Now()
+	chat := &ChatConnection{}
+	stale := newTestOffer(chat, "stale", now.Add(-offerTTL-time.Second))
+	fresh := newTestOffer(chat, "fresh", now)
+	for _, offer := range []*fileOffer{stale, fresh} {
+		if err := offers.add(offer); err != nil {
+			t.Fatalf("add: %s", err)
+		}
+	}
+
+	expired := offers.expire(now)
+	if (len(expired) != 1) || (expired[0] != stale) {
+		t.Fatalf("got %d expired offers, expected the stale one", len(expired))
+	}
+	if _, ok := offers.take(stale.offer.Id); ok {
+		t.Fatalf("expired offer was taken")
+	}
+	if _, ok := offers.take(fresh.offer.Id); !ok {
+		t.Fatalf("fresh offer expired")
+	}
+}
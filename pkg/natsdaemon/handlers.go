@@ -2,32 +2,100 @@ package natsdaemon
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
 
 	api "github.com/aaletov/nats-chat/api/generated"
+	"github.com/aaletov/nats-chat/pkg/history"
+	"github.com/aaletov/nats-chat/pkg/profile"
+	"github.com/aaletov/nats-chat/pkg/rotation"
 	"github.com/hashicorp/go-multierror"
 	"github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/emptypb"
 )
 
+const (
+	RecepientMetadataKey = "recepient-address"
+	RoomMetadataKey      = "room-id"
+)
+
+// Reasons in the error details of Online failing on the passphrase, which tell
+// them apart from other failed preconditions
+const (
+	errorDomain              = "nats-chat"
+	ReasonPassphraseRequired = "PASSPHRASE_REQUIRED"
+	ReasonWrongPassphrase    = "WRONG_PASSPHRASE"
+)
+
+func passphraseError(err error) error {
+	reason := ReasonWrongPassphrase
+	if errors.Is(err, profile.ErrPassphraseRequired) {
+		reason = ReasonPassphraseRequired
+	}
+	st := status.Newf(codes.FailedPrecondition, "failed to read profile: %s", err)
+	if detailed, derr := st.WithDetails(&errdetails.ErrorInfo{Reason: reason, Domain: errorDomain}); derr == nil {
+		st = detailed
+	}
+	return st.Err()
+}
+
+// ErrorReason returns the reason in the error details of err, empty if it has
+// none
+func ErrorReason(err error) string {
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok && (info.Domain == errorDomain) {
+			return info.Reason
+		}
+	}
+	return ""
+}
+
 type daemon struct {
 	api.UnimplementedDaemonServer
+	mu      sync.Mutex
 	session *Session
-	chat    *ChatConnection
+	chats   map[string]*ChatConnection
+	history *history.Store
+	dataDir string
 	logger  *logrus.Entry
+	// configMu guards config
+	configMu sync.Mutex
+	config   Config
+	started  time.Time
 }
 
 type ShutdownableDaemonServer interface {
 	api.DaemonServer
 	Shutdown() error
+	Configure(config Config)
 }
 
-func NewDaemon(logger *logrus.Logger) ShutdownableDaemonServer {
+func NewDaemon(logger *logrus.Logger, dataDir string, config Config) (ShutdownableDaemonServer, error) {
+	var (
+		err   error
+		store *history.Store
+	)
+	if store, err = history.Open(filepath.Join(dataDir, "history.db")); err != nil {
+		return nil, err
+	}
 	return &daemon{
+		chats:   make(map[string]*ChatConnection),
+		history: store,
+		dataDir: dataDir,
 		logger: logger.WithFields(logrus.Fields{
 			"component": "DaemonServer",
 		}),
-	}
+		config:  config,
+		started: time.Now(),
+	}, nil
 }
 
 func (d *daemon) Online(ctx context.Context, req *api.OnlineRequest) (*emptypb.Empty, error) {
@@ -35,12 +103,68 @@ func (d *daemon) Online(ctx context.Context, req *api.OnlineRequest) (*emptypb.E
 		"method": "Online",
 	})
 	ll.Debugf("Processing request: %s", req)
-	var err error
+	var (
+		err           error
+		senderProfile profile.Profile
+		session       *Session
+	)
+	if _, err = d.getSession(); err == nil {
+		return &emptypb.Empty{}, status.Error(codes.FailedPrecondition, "daemon is already online, go offline first")
+	}
+	if isRemote(ctx) {
+		if err = d.remotePaths(req); err != nil {
+			return &emptypb.Empty{}, err
+		}
+	}
 
-	if d.session, err = Online(d.logger.Logger, req.NatsUrl, req.SenderAddress); err != nil {
+	passphrase := func() ([]byte, error) { return req.Passphrase, nil }
+	if senderProfile, err = profile.ReadProfile(req.ProfilePath, passphrase); err != nil {
+		if errors.Is(err, profile.ErrPassphraseRequired) || errors.Is(err, profile.ErrWrongPassphrase) {
+			return &emptypb.Empty{}, passphraseError(err)
+		}
+		return &emptypb.Empty{}, fmt.Errorf("failed to read profile: %s", err)
+	}
+	// Remote clients do not read the profile and leave the address empty
+	if (req.SenderAddress != "") && (senderProfile.GetAddress() != req.SenderAddress) {
+		return &emptypb.Empty{}, fmt.Errorf("profile %s does not belong to %s", req.ProfilePath, req.SenderAddress)
+	}
+	ll.Debugf("Read sender profile %s", req.ProfilePath)
+
+	config := d.getConfig()
+	natsUrl, credentials := config.onlineDefaults(req)
+	if natsUrl == "" {
+		return &emptypb.Empty{}, status.Error(codes.InvalidArgument, "nats url is not set")
+	}
+	opts := SessionOptions{
+		JetStream:      req.Jetstream,
+		History:        d.history,
+		DownloadsDir:   req.DownloadsDir,
+		ContactsPath:   req.ContactsPath,
+		ConnectTimeout: config.ConnectTimeout,
+		OutageTimeout:  config.OutageTimeout,
+	}
+	if opts.NatsOptions, err = natsOptions(credentials); err != nil {
+		return &emptypb.Empty{}, status.Errorf(codes.InvalidArgument, "invalid nats credentials: %s", err)
+	}
+	opts.NatsOptions = append(opts.NatsOptions, reconnectOptions(req.Reconnect)...)
+	if opts.Rotations, err = rotation.Load(req.ProfilePath); err != nil {
+		return &emptypb.Empty{}, fmt.Errorf("failed to read rotations: %s", err)
+	}
+	// Received files are saved to the data directory by default
+	if opts.DownloadsDir == "" {
+		opts.DownloadsDir = filepath.Join(d.dataDir, "downloads")
+	}
+	if session, err = Online(d.logger.Logger, natsUrl, senderProfile, opts); err != nil {
 		return &emptypb.Empty{}, fmt.Errorf("failed to initialize session: %s", err)
 	}
-	ll.Debugf("Initialized new session: %s", req.NatsUrl)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.session != nil {
+		session.Close()
+		return &emptypb.Empty{}, status.Error(codes.FailedPrecondition, "daemon is already online, go offline first")
+	}
+	d.session = session
+	ll.Debugf("Initialized new session: %s", natsUrl)
 
 	return &emptypb.Empty{}, nil
 }
@@ -48,12 +172,14 @@ func (d *daemon) Online(ctx context.Context, req *api.OnlineRequest) (*emptypb.E
 func shutdownDaemon(d *daemon) error {
 	var err *multierror.Error
 
-	if d.chat != nil {
-		err = multierror.Append(err, d.chat.Close())
-		d.chat = nil
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for recepient, chat := range d.chats {
+		err = multierror.Append(err, chat.Close())
+		delete(d.chats, recepient)
 	}
 	if d.session != nil {
-		err = multierror.Append(d.session.Close())
+		err = multierror.Append(err, d.session.Close())
 		d.session = nil
 	}
 
@@ -64,35 +190,356 @@ func (d *daemon) Offline(ctx context.Context, _ *emptypb.Empty) (*emptypb.Empty,
 	return &emptypb.Empty{}, shutdownDaemon(d)
 }
 
+// validateAddress rejects malformed addresses before they reach nats subjects
+func validateAddress(address string) error {
+	if err := profile.ValidateAddress(address); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return nil
+}
+
+// findChat looks up the chat with recepient, d.mu must be held. Chats are kept
+// under the current address of the peer, even if dialed by a legacy one.
+func (d *daemon) findChat(recepient string) (*ChatConnection, bool) {
+	if chat, ok := d.chats[recepient]; ok {
+		return chat, true
+	}
+	if profile.IsLegacyAddress(recepient) {
+		for _, chat := range d.chats {
+			if profile.BelongsTo(chat.recepientKey, recepient) {
+				return chat, true
+			}
+		}
+	}
+	return nil, false
+}
+
+func (d *daemon) getChat(recepient string) (*ChatConnection, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.findChat(recepient)
+}
+
 func (d *daemon) CreateChat(ctx context.Context, req *api.ChatRequest) (*emptypb.Empty, error) {
 	ll := d.logger.WithFields(logrus.Fields{
 		"method": "CreateChat",
+		"chat":   req.RecepientAddress,
+		"peer":   req.RecepientAddress,
 	})
-	var err error
-	if d.chat, err = d.session.Dial(req.RecepientAddress); err != nil {
+	if err := validateAddress(req.RecepientAddress); err != nil {
+		return &emptypb.Empty{}, err
+	}
+	if _, ok := d.getChat(req.RecepientAddress); ok {
+		return &emptypb.Empty{}, status.Errorf(codes.AlreadyExists, "chat with %s already exists", req.RecepientAddress)
+	}
+
+	var (
+		err     error
+		session *Session
+		chat    *ChatConnection
+	)
+	if session, err = d.getSession(); err != nil {
+		return &emptypb.Empty{}, err
+	}
+	ctx, cancel := d.getConfig().dialContext(ctx)
+	defer cancel()
+	if chat, err = session.Dial(ctx, req.RecepientAddress, req.PinnedPublicKey); err != nil {
+		if errors.Is(err, ErrHandshakeFailed) {
+			ll.Warnf("Handshake failed: %s", err)
+			return &emptypb.Empty{}, status.Error(codes.PermissionDenied, err.Error())
+		}
 		return &emptypb.Empty{}, err
 	}
 	ll.Debugf("Dialed successfully: %s", req.RecepientAddress)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.chats[chat.RecepientAddress]; ok {
+		chat.Close()
+		return &emptypb.Empty{}, status.Errorf(codes.AlreadyExists, "chat with %s already exists", req.RecepientAddress)
+	}
+	d.chats[chat.RecepientAddress] = chat
 	return &emptypb.Empty{}, nil
 }
 
 func (d *daemon) DeleteChat(ctx context.Context, req *api.ChatRequest) (*emptypb.Empty, error) {
 	ll := d.logger.WithFields(logrus.Fields{
 		"method": "DeleteChat",
+		"chat":   req.RecepientAddress,
+		"peer":   req.RecepientAddress,
 	})
-	if d.chat != nil {
-		err := d.chat.Close()
-		d.chat = nil
-		return &emptypb.Empty{}, err
+	d.mu.Lock()
+	chat, ok := d.findChat(req.RecepientAddress)
+	if ok {
+		delete(d.chats, chat.RecepientAddress)
+	}
+	d.mu.Unlock()
+
+	if ok {
+		return &emptypb.Empty{}, chat.Close()
 	}
 	ll.Debugf("Chat does not exist: %s", req.RecepientAddress)
 	return &emptypb.Empty{}, nil
 }
 
 func (d *daemon) Send(srv api.Daemon_SendServer) error {
-	return d.chat.Send(srv)
+	md, _ := metadata.FromIncomingContext(srv.Context())
+	if rooms := md.Get(RoomMetadataKey); len(rooms) > 0 {
+		return d.sendRoom(srv, rooms)
+	}
+	recepients := md.Get(RecepientMetadataKey)
+	if len(recepients) != 1 {
+		return status.Errorf(codes.InvalidArgument, "exactly one %s must be set in metadata", RecepientMetadataKey)
+	}
+	chat, ok := d.getChat(recepients[0])
+	if !ok {
+		return status.Errorf(codes.NotFound, "chat with %s does not exist", recepients[0])
+	}
+	return chat.Send(srv)
+}
+
+func (d *daemon) sendRoom(srv api.Daemon_SendServer, rooms []string) error {
+	if len(rooms) != 1 {
+		return status.Errorf(codes.InvalidArgument, "exactly one %s must be set in metadata", RoomMetadataKey)
+	}
+	var (
+		err     error
+		session *Session
+	)
+	if session, err = d.getSession(); err != nil {
+		return err
+	}
+	room, ok := session.getRoom(rooms[0])
+	if !ok {
+		return status.Errorf(codes.NotFound, "room %s does not exist", rooms[0])
+	}
+	return room.Send(srv)
+}
+
+func (d *daemon) getSession() (*Session, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.session == nil {
+		return nil, status.Error(codes.FailedPrecondition, "daemon is offline, go online first")
+	}
+	return d.session, nil
+}
+
+func (d *daemon) History(ctx context.Context, req *api.HistoryRequest) (*api.HistoryResponse, error) {
+	var (
+		err     error
+		session *Session
+		entries []*api.HistoryEntry
+	)
+	if session, err = d.getSession(); err != nil {
+		return nil, err
+	}
+	if entries, err = d.history.Query(session.senderAddress, req); err != nil {
+		return nil, err
+	}
+	return &api.HistoryResponse{Entries: entries}, nil
+}
+
+func roomError(err error) error {
+	switch {
+	case errors.Is(err, ErrRoomNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, ErrAlreadyMember):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, ErrHandshakeFailed):
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	return err
+}
+
+func (d *daemon) CreateRoom(ctx context.Context, req *api.CreateRoomRequest) (*api.Room, error) {
+	ll := d.logger.WithFields(logrus.Fields{
+		"method": "CreateRoom",
+	})
+	var (
+		err     error
+		session *Session
+		room    *Room
+	)
+	if session, err = d.getSession(); err != nil {
+		return nil, err
+	}
+	if room, err = session.CreateRoom(req.Name); err != nil {
+		return nil, err
+	}
+	ll.Debugf("Created room %s", room.ID)
+	return room.Info(), nil
+}
+
+func (d *daemon) InviteToRoom(ctx context.Context, req *api.RoomInviteRequest) (*emptypb.Empty, error) {
+	ll := d.logger.WithFields(logrus.Fields{
+		"method": "InviteToRoom",
+		"chat":   req.RoomId,
+		"peer":   req.MemberAddress,
+	})
+	var (
+		err     error
+		session *Session
+	)
+	if session, err = d.getSession(); err != nil {
+		return &emptypb.Empty{}, err
+	}
+	if err = validateAddress(req.MemberAddress); err != nil {
+		return &emptypb.Empty{}, err
+	}
+	ctx, cancel := d.getConfig().dialContext(ctx)
+	defer cancel()
+	if err = session.InviteToRoom(ctx, req.RoomId, req.MemberAddress, req.PinnedPublicKey); err != nil {
+		ll.Warnf("Unable to invite %s to room %s: %s", req.MemberAddress, req.RoomId, err)
+		return &emptypb.Empty{}, roomError(err)
+	}
+	ll.Debugf("Invited %s to room %s", req.MemberAddress, req.RoomId)
+	return &emptypb.Empty{}, nil
+}
+
+func (d *daemon) LeaveRoom(ctx context.Context, req *api.RoomRequest) (*emptypb.Empty, error) {
+	var (
+		err     error
+		session *Session
+	)
+	if session, err = d.getSession(); err != nil {
+		return &emptypb.Empty{}, err
+	}
+	return &emptypb.Empty{}, roomError(session.LeaveRoom(req.RoomId))
+}
+
+func (d *daemon) ListRooms(ctx context.Context, _ *emptypb.Empty) (*api.RoomList, error) {
+	var (
+		err     error
+		session *Session
+	)
+	if session, err = d.getSession(); err != nil {
+		return nil, err
+	}
+	list := &api.RoomList{}
+	for _, room := range session.Rooms() {
+		list.Rooms = append(list.Rooms, room.Info())
+	}
+	return list, nil
+}
+
+func (d *daemon) WatchPresence(req *api.PresenceRequest, srv api.Daemon_WatchPresenceServer) error {
+	var (
+		err     error
+		session *Session
+	)
+	if session, err = d.getSession(); err != nil {
+		return err
+	}
+	if len(req.Addresses) == 0 {
+		return status.Error(codes.InvalidArgument, "no addresses to watch")
+	}
+	for _, address := range req.Addresses {
+		if err = validateAddress(address); err != nil {
+			return err
+		}
+	}
+	return session.WatchPresence(srv.Context(), req.Addresses, srv.Send)
+}
+
+func (d *daemon) MarkRead(ctx context.Context, req *api.ReadRequest) (*emptypb.Empty, error) {
+	chat, ok := d.getChat(req.RecepientAddress)
+	if !ok {
+		return &emptypb.Empty{}, status.Errorf(codes.NotFound, "chat with %s does not exist", req.RecepientAddress)
+	}
+	return &emptypb.Empty{}, chat.MarkRead(req.MessageIds)
+}
+
+func (d *daemon) SendFile(req *api.SendFileRequest, srv api.Daemon_SendFileServer) error {
+	chat, ok := d.getChat(req.RecepientAddress)
+	if !ok {
+		return status.Errorf(codes.NotFound, "chat with %s does not exist", req.RecepientAddress)
+	}
+	path := req.Path
+	if isRemote(srv.Context()) {
+		var err error
+		if path, err = d.dataPath(path); err != nil {
+			return err
+		}
+	} else if !filepath.IsAbs(path) {
+		return status.Errorf(codes.InvalidArgument, "path %s is not absolute", path)
+	}
+	return chat.SendFile(srv.Context(), path, srv.Send)
+}
+
+// UploadFile offers a file streamed by the client, it is kept in the data
+// directory until the transfer is over
+func (d *daemon) UploadFile(srv api.Daemon_UploadFileServer) error {
+	var (
+		err    error
+		upload *api.FileUpload
+		file   *os.File
+	)
+	if upload, err = srv.Recv(); err != nil {
+		return err
+	}
+	header := upload.GetHeader()
+	if header == nil {
+		return status.Error(codes.InvalidArgument, "upload does not start with a header")
+	}
+	chat, ok := d.getChat(header.RecepientAddress)
+	if !ok {
+		return status.Errorf(codes.NotFound, "chat with %s does not exist", header.RecepientAddress)
+	}
+	name := filepath.Base(header.Name)
+	if (name == ".") || (name == "..") || (name == string(filepath.Separator)) {
+		return status.Errorf(codes.InvalidArgument, "invalid file name %q", header.Name)
+	}
+	uploadsDir := filepath.Join(d.dataDir, "uploads")
+	if err = os.MkdirAll(uploadsDir, 0700); err != nil {
+		return fmt.Errorf("unable to create uploads directory: %s", err)
+	}
+	if file, err = os.CreateTemp(uploadsDir, "upload-*"); err != nil {
+		return fmt.Errorf("unable to create upload: %s", err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	if err = receiveUpload(srv, file, header.Size); err != nil {
+		return err
+	}
+	return chat.offerFile(srv.Context(), file, name, srv.Send)
+}
+
+func (d *daemon) WatchFileOffers(_ *emptypb.Empty, srv api.Daemon_WatchFileOffersServer) error {
+	var (
+		err     error
+		session *Session
+	)
+	if session, err = d.getSession(); err != nil {
+		return err
+	}
+	return session.WatchFileOffers(srv.Context(), srv.Send)
+}
+
+func (d *daemon) AnswerFileOffer(req *api.FileAnswer, srv api.Daemon_AnswerFileOfferServer) error {
+	ll := d.logger.WithFields(logrus.Fields{
+		"method": "AnswerFileOffer",
+	})
+	var (
+		err     error
+		session *Session
+	)
+	if session, err = d.getSession(); err != nil {
+		return err
+	}
+	if err = session.AnswerFileOffer(srv.Context(), req.Id, req.Accept, srv.Send); err != nil {
+		ll.Warnf("Unable to answer offer %s: %s", req.Id, err)
+		if errors.Is(err, ErrOfferNotFound) {
+			return status.Error(codes.NotFound, err.Error())
+		}
+		return err
+	}
+	return nil
 }
 
 func (d *daemon) Shutdown() error {
-	return shutdownDaemon(d)
+	var err *multierror.Error
+	err = multierror.Append(err, shutdownDaemon(d))
+	err = multierror.Append(err, d.history.Close())
+	return err.ErrorOrNil()
 }
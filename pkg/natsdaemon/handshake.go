@@ -0,0 +1,261 @@
+package natsdaemon
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	api "github.com/aaletov/nats-chat/api/generated"
+	"github.com/aaletov/nats-chat/pkg/envelope"
+	"github.com/aaletov/nats-chat/pkg/profile"
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	nonceSize         = 32
+	challengeTimeout  = 30 * time.Second
+	responseContext   = "nats-chat-handshake-response"
+	proofContext      = "nats-chat-handshake-proof"
+	pingSubjectFmt    = "ping.%s"
+	onlineSubjectFmt  = "online.%s"
+	proofSubjectFmt   = "proof.%s"
+	handshakeInterval = 33 * time.Millisecond
+)
+
+var ErrHandshakeFailed = errors.New("handshake failed")
+
+type pendingChallenge struct {
+	author    string
+	publicKey crypto.PublicKey
+	expires   time.Time
+}
+
+func newNonce() ([]byte, error) {
+	nonce := make([]byte, nonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("error generating nonce: %s", err)
+	}
+	return nonce, nil
+}
+
+func (s *Session) handleChallenge(msg *nats.Msg) {
+	ll := s.logger.WithFields(logrus.Fields{
+		"method": "handleChallenge",
+	})
+	var (
+		err       error
+		publicKey crypto.PublicKey
+		challenge []byte
+		signature []byte
+		data      []byte
+	)
+	cmsg := &api.NatsChallenge{}
+	if err = proto.Unmarshal(msg.Data, cmsg); err != nil {
+		ll.Errorf("error unmarshalling challenge: %s", err)
+		return
+	}
+	ll = ll.WithFields(logrus.Fields{"peer": cmsg.AuthorAddress})
+	if publicKey, err = profile.VerifiedPublicKey(cmsg.AuthorAddress, cmsg.PublicKey); err != nil {
+		ll.Warnf("Ignoring challenge: %s", err)
+		return
+	}
+	if len(cmsg.Nonce) != nonceSize {
+		ll.Warnf("Ignoring challenge from %s: invalid nonce", cmsg.AuthorAddress)
+		return
+	}
+	if challenge, err = newNonce(); err != nil {
+		ll.Error(err)
+		return
+	}
+	if signature, err = envelope.SignData(s.senderProfile.GetPrivateKey(), responseContext,
+		[]byte(cmsg.AuthorAddress), []byte(s.senderAddress), cmsg.Nonce, challenge); err != nil {
+		ll.Error(err)
+		return
+	}
+
+	s.mu.Lock()
+	now := time.Now()
+	for key, pending := range s.pending {
+		if now.After(pending.expires) {
+			delete(s.pending, key)
+		}
+	}
+	s.pending[string(challenge)] = pendingChallenge{
+		author:    cmsg.AuthorAddress,
+		publicKey: publicKey,
+		expires:   now.Add(challengeTimeout),
+	}
+	s.mu.Unlock()
+
+	rmsg := &api.NatsChallengeResponse{
+		AuthorAddress: s.senderAddress,
+		PublicKey:     profile.MarshalPublicKey(s.senderProfile.GetPublicKey()),
+		Nonce:         cmsg.Nonce,
+		Challenge:     challenge,
+		Signature:     signature,
+	}
+	if data, err = proto.Marshal(rmsg); err != nil {
+		ll.Errorf("error marshalling challenge response: %s", err)
+		return
+	}
+	if err = s.nc.Publish(fmt.Sprintf(onlineSubjectFmt, cmsg.AuthorAddress), data); err != nil {
+		ll.Errorf("error publishing challenge response: %s", err)
+	}
+}
+
+func (s *Session) handleProof(msg *nats.Msg) {
+	ll := s.logger.WithFields(logrus.Fields{
+		"method": "handleProof",
+	})
+	pmsg := &api.NatsChallengeProof{}
+	if err := proto.Unmarshal(msg.Data, pmsg); err != nil {
+		ll.Errorf("error unmarshalling proof: %s", err)
+		return
+	}
+
+	s.mu.Lock()
+	pending, ok := s.pending[string(pmsg.Challenge)]
+	delete(s.pending, string(pmsg.Challenge))
+	s.mu.Unlock()
+
+	if !ok || time.Now().After(pending.expires) || (pending.author != pmsg.AuthorAddress) {
+		ll.Warnf("Ignoring proof from %s: unknown or expired challenge", pmsg.AuthorAddress)
+		return
+	}
+	if err := envelope.VerifyData(pending.publicKey, pmsg.Signature, proofContext,
+		[]byte(pmsg.AuthorAddress), []byte(s.senderAddress), pmsg.Challenge); err != nil {
+		ll.Warnf("Rejecting proof from %s: %s", pmsg.AuthorAddress, err)
+		return
+	}
+
+	s.mu.Lock()
+	s.verifiedPeers[pmsg.AuthorAddress] = pending.publicKey
+	s.mu.Unlock()
+	ll.Debugf("Peer %s proved ownership of its address", pmsg.AuthorAddress)
+	// The empty reply tells the peer that the handshake is complete
+	if err := msg.Respond(nil); err != nil {
+		ll.Errorf("error accepting proof: %s", err)
+	}
+}
+
+// verified reports whether peer proved ownership of its address in a
+// handshake it started with the sender
+func (s *Session) verified(peer string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.verifiedPeers[peer]
+	return ok
+}
+
+// handshake proves that recepient owns the key behind its address and proves
+// the same about the sender in return. It blocks until recepient answers and
+// accepts the proof of the sender.
+// If pinned is set, recepient has to present exactly that key. A legacy RSA
+// address is resolved to the current one, which is returned with the key.
+func (s *Session) handshake(ctx context.Context, recepient string, pinned []byte) (crypto.PublicKey, string, error) {
+	ll := s.logger.WithFields(logrus.Fields{
+		"method": "handshake",
+		"peer":   recepient,
+	})
+	var (
+		err       error
+		nonce     []byte
+		data      []byte
+		publicKey crypto.PublicKey
+		signature []byte
+	)
+	if nonce, err = newNonce(); err != nil {
+		return nil, "", err
+	}
+
+	legacy := profile.IsLegacyAddress(recepient)
+	responses := make(chan *api.NatsChallengeResponse, 1)
+	onlineSub, err := s.nc.Subscribe(fmt.Sprintf(onlineSubjectFmt, s.senderAddress), func(msg *nats.Msg) {
+		rmsg := &api.NatsChallengeResponse{}
+		if err := proto.Unmarshal(msg.Data, rmsg); err != nil {
+			return
+		}
+		if (!legacy && (rmsg.AuthorAddress != recepient)) || (string(rmsg.Nonce) != string(nonce)) {
+			return
+		}
+		select {
+		case responses <- rmsg:
+		default:
+		}
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("error subscribing to sender online: %s", err)
+	}
+	defer onlineSub.Unsubscribe()
+
+	cmsg := &api.NatsChallenge{
+		AuthorAddress: s.senderAddress,
+		PublicKey:     profile.MarshalPublicKey(s.senderProfile.GetPublicKey()),
+		Nonce:         nonce,
+	}
+	if data, err = proto.Marshal(cmsg); err != nil {
+		return nil, "", fmt.Errorf("error marshalling challenge: %s", err)
+	}
+
+	var rmsg *api.NatsChallengeResponse
+	ticker := time.NewTicker(handshakeInterval)
+	defer ticker.Stop()
+	recepientPing := fmt.Sprintf(pingSubjectFmt, recepient)
+	for rmsg == nil {
+		select {
+		case <-ticker.C:
+			s.nc.Publish(recepientPing, data)
+			ll.Debugf("Pinged %s\n", recepient)
+		case rmsg = <-responses:
+		case <-ctx.Done():
+			return nil, "", ctx.Err()
+		}
+	}
+
+	if legacy {
+		// The peer answers with its current address, which has to belong to
+		// the same key as the legacy one
+		if publicKey, err = profile.VerifiedPublicKey(rmsg.AuthorAddress, rmsg.PublicKey); err != nil {
+			return nil, "", fmt.Errorf("%w: %s", ErrHandshakeFailed, err)
+		}
+		if !profile.BelongsTo(publicKey, recepient) {
+			return nil, "", fmt.Errorf("%w: %s answered for %s", ErrHandshakeFailed, rmsg.AuthorAddress, recepient)
+		}
+		ll.Debugf("Resolved legacy address %s to %s", recepient, rmsg.AuthorAddress)
+		recepient = rmsg.AuthorAddress
+	} else if publicKey, err = profile.VerifiedPublicKey(recepient, rmsg.PublicKey); err != nil {
+		return nil, "", fmt.Errorf("%w: %s", ErrHandshakeFailed, err)
+	}
+	if (pinned != nil) && !bytes.Equal(rmsg.PublicKey, pinned) {
+		return nil, "", fmt.Errorf("%w: %s presented a key other than pinned", ErrHandshakeFailed, recepient)
+	}
+	if err = envelope.VerifyData(publicKey, rmsg.Signature, responseContext,
+		[]byte(s.senderAddress), []byte(recepient), nonce, rmsg.Challenge); err != nil {
+		return nil, "", fmt.Errorf("%w: %s did not prove ownership of its address: %s", ErrHandshakeFailed, recepient, err)
+	}
+	ll.Debugf("Got valid challenge response from %s", recepient)
+
+	if signature, err = envelope.SignData(s.senderProfile.GetPrivateKey(), proofContext,
+		[]byte(s.senderAddress), []byte(recepient), rmsg.Challenge); err != nil {
+		return nil, "", err
+	}
+	pmsg := &api.NatsChallengeProof{
+		AuthorAddress: s.senderAddress,
+		Challenge:     rmsg.Challenge,
+		Signature:     signature,
+	}
+	if data, err = proto.Marshal(pmsg); err != nil {
+		return nil, "", fmt.Errorf("error marshalling proof: %s", err)
+	}
+	if _, err = s.nc.RequestWithContext(ctx, fmt.Sprintf(proofSubjectFmt, recepient), data); err != nil {
+		return nil, "", fmt.Errorf("%w: %s did not accept proof: %s", ErrHandshakeFailed, recepient, err)
+	}
+	return publicKey, recepient, nil
+}
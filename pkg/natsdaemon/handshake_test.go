@@ -0,0 +1,199 @@
+package natsdaemon
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	api "github.com/aaletov/nats-chat/api/generated"
+	"github.com/aaletov/nats-chat/pkg/envelope"
+	"github.com/aaletov/nats-chat/pkg/profile"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/proto"
+)
+
+const handshakeTestTimeout = 5 * time.Second
+
+// runServer starts an embedded nats server, which is shut down with the test
+func runServer(t *testing.T, jetStream bool) *server.Server {
+	t.Helper()
+	opts := test.DefaultTestOptions
+	opts.Port = -1
+	opts.JetStream = jetStream
+	opts.StoreDir = t.TempDir()
+	srv := test.RunServer(&opts)
+	t.Cleanup(srv.Shutdown)
+	return srv
+}
+
+func newTestProfile(t *testing.T, keyType profile.KeyType) profile.Profile {
+	t.Helper()
+	privateKey, err := profile.GenerateKey(keyType)
+	if err != nil {
+		t.Fatalf("error generating key: %s", err)
+	}
+	p, err := profile.NewProfile(privateKey)
+	if err != nil {
+		t.Fatalf("error creating profile: %s", err)
+	}
+	return p
+}
+
+func goOnline(t *testing.T, srv *server.Server, p profile.Profile) *Session {
+	t.Helper()
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	s, err := Online(logger, srv.ClientURL(), p, SessionOptions{})
+	if err != nil {
+		t.Fatalf("error going online: %s", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// impersonate answers challenges sent to address with a response claiming
+// publicKey and signed by signer, proofs are accepted without checking
+func impersonate(t *testing.T, srv *server.Server, address string, publicKey crypto.PublicKey, signer crypto.Signer) {
+	t.Helper()
+	nc, err := nats.Connect(srv.ClientURL())
+	if err != nil {
+		t.Fatalf("error connecting: %s", err)
+	}
+	t.Cleanup(nc.Close)
+	_, err = nc.Subscribe(fmt.Sprintf(pingSubjectFmt, address), func(msg *nats.Msg) {
+		cmsg := &api.NatsChallenge{}
+		if err := proto.Unmarshal(msg.Data, cmsg); err != nil {
+			return
+		}
+		challenge, err := newNonce()
+		if err != nil {
+			return
+		}
+		signature, err := envelope.SignData(signer, responseContext,
+			[]byte(cmsg.AuthorAddress), []byte(address), cmsg.Nonce, challenge)
+		if err != nil {
+			return
+		}
+		data, _ := proto.Marshal(&api.NatsChallengeResponse{
+			AuthorAddress: address,
+			PublicKey:     profile.MarshalPublicKey(publicKey),
+			Nonce:         cmsg.Nonce,
+			Challenge:     challenge,
+			Signature:     signature,
+		})
+		nc.Publish(fmt.Sprintf(onlineSubjectFmt, cmsg.AuthorAddress), data)
+	})
+	if err != nil {
+		t.Fatalf("error subscribing to ping: %s", err)
+	}
+	_, err = nc.Subscribe(fmt.Sprintf(proofSubjectFmt, address), func(msg *nats.Msg) {
+		msg.Respond(nil)
+	})
+	if err != nil {
+		t.Fatalf("error subscribing to proof: %s", err)
+	}
+	if err = nc.Flush(); err != nil {
+		t.Fatalf("error flushing: %s", err)
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	srv := runServer(t, false)
+	alice := goOnline(t, srv, newTestProfile(t, profile.KeyTypeEd25519))
+	bobProfile := newTestProfile(t, profile.KeyTypeEd25519)
+	bob := goOnline(t, srv, bobProfile)
+	mallory := newTestProfile(t, profile.KeyTypeEd25519)
+
+	tests := []struct {
+		name   string
+		pinned []byte
+		valid  bool
+	}{
+		{
+			name:  "unpinned",
+			valid: true,
+		},
+		{
+			name:   "pinned key",
+			pinned: profile.MarshalPublicKey(bobProfile.GetPublicKey()),
+			valid:  true,
+		},
+		{
+			name:   "wrong pinned key",
+			pinned: profile.MarshalPublicKey(mallory.GetPublicKey()),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bob.mu.Lock()
+			delete(bob.verifiedPeers, alice.senderAddress)
+			bob.mu.Unlock()
+
+			ctx, cancel := context.WithTimeout(context.Background(), handshakeTestTimeout)
+			defer cancel()
+			publicKey, address, err := alice.handshake(ctx, bob.senderAddress, tt.pinned)
+			if !tt.valid {
+				if !errors.Is(err, ErrHandshakeFailed) {
+					t.Fatalf("got %v, expected %s", err, ErrHandshakeFailed)
+				}
+				if bob.verified(alice.senderAddress) {
+					t.Fatalf("peer verified the sender of a failed handshake")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("handshake: %s", err)
+			}
+			if address != bob.senderAddress {
+				t.Fatalf("got address %s, expected %s", address, bob.senderAddress)
+			}
+			if !profile.BelongsTo(publicKey, bob.senderAddress) {
+				t.Fatalf("handshake returned a key of another address")
+			}
+			if !bob.verified(alice.senderAddress) {
+				t.Fatalf("peer did not verify the sender")
+			}
+		})
+	}
+}
+
+func TestHandshakeWrongKey(t *testing.T) {
+	bob := newTestProfile(t, profile.KeyTypeEd25519)
+	mallory := newTestProfile(t, profile.KeyTypeEd25519)
+	tests := []struct {
+		name      string
+		publicKey crypto.PublicKey
+		signer    crypto.Signer
+	}{
+		{
+			name:      "key of another address",
+			publicKey: mallory.GetPublicKey(),
+			signer:    mallory.GetPrivateKey(),
+		},
+		{
+			name:      "signed by another key",
+			publicKey: bob.GetPublicKey(),
+			signer:    mallory.GetPrivateKey(),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := runServer(t, false)
+			alice := goOnline(t, srv, newTestProfile(t, profile.KeyTypeEd25519))
+			impersonate(t, srv, bob.GetAddress(), tt.publicKey, tt.signer)
+
+			ctx, cancel := context.WithTimeout(context.Background(), handshakeTestTimeout)
+			defer cancel()
+			if _, _, err := alice.handshake(ctx, bob.GetAddress(), nil); !errors.Is(err, ErrHandshakeFailed) {
+				t.Fatalf("got %v, expected %s", err, ErrHandshakeFailed)
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+package natsdaemon
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	api "github.com/aaletov/nats-chat/api/generated"
+	"github.com/aaletov/nats-chat/pkg/metrics"
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	inboxMaxAge = 30 * 24 * time.Hour
+	// inboxMaxDeliver bounds redeliveries of a message the chat was closed
+	// before, malformed and forged messages are terminated right away
+	inboxMaxDeliver = 16
+	fetchBatchSize  = 1
+	fetchMaxWait    = time.Second
+)
+
+func inboxStreamName(address string) string {
+	return fmt.Sprintf("INBOX_%s", address)
+}
+
+// ensureInbox creates the durable inbox stream, which stores every chat
+// message sent to address until its daemon consumes it
+func ensureInbox(js nats.JetStreamContext, address string) error {
+	name := inboxStreamName(address)
+	_, err := js.StreamInfo(name)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, nats.ErrStreamNotFound) {
+		return fmt.Errorf("error getting inbox stream info: %s", err)
+	}
+	_, err = js.AddStream(&nats.StreamConfig{
+		Name:      name,
+		Subjects:  []string{fmt.Sprintf("chat.%s.*", address)},
+		Retention: nats.WorkQueuePolicy,
+		Storage:   nats.FileStorage,
+		MaxAge:    inboxMaxAge,
+	})
+	if err != nil {
+		return fmt.Errorf("error creating inbox stream: %s", err)
+	}
+	return nil
+}
+
+func hasInbox(js nats.JetStreamContext, address string) bool {
+	_, err := js.StreamInfo(inboxStreamName(address))
+	return err == nil
+}
+
+// subscribeInbox binds to the durable consumer of messages sent by recepient,
+// creating it if needed. The consumer is not deleted on unsubscribe, so messages
+// sent while the chat is closed are replayed on the next subscribe.
+func subscribeInbox(js nats.JetStreamContext, senderAddress string, recepient string) (*nats.Subscription, error) {
+	stream := inboxStreamName(senderAddress)
+	durable := recepient
+	subject := fmt.Sprintf("chat.%s.%s", senderAddress, recepient)
+	config := &nats.ConsumerConfig{
+		Durable:       durable,
+		FilterSubject: subject,
+		AckPolicy:     nats.AckExplicitPolicy,
+		DeliverPolicy: nats.DeliverAllPolicy,
+		MaxDeliver:    inboxMaxDeliver,
+	}
+	info, err := js.ConsumerInfo(stream, durable)
+	switch {
+	case errors.Is(err, nats.ErrConsumerNotFound):
+		_, err = js.AddConsumer(stream, config)
+	case (err == nil) && (info.Config.MaxDeliver != inboxMaxDeliver):
+		// Consumers created before the limit redeliver forever
+		_, err = js.UpdateConsumer(stream, config)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error creating inbox consumer: %s", err)
+	}
+	return js.PullSubscribe(subject, durable, nats.Bind(stream, durable))
+}
+
+func consumeInbox(ll *logrus.Entry, sub *nats.Subscription, handler nats.MsgHandler, done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		msgs, err := sub.Fetch(fetchBatchSize, nats.MaxWait(fetchMaxWait))
+		if errors.Is(err, nats.ErrTimeout) {
+			continue
+		}
+		if errors.Is(err, nats.ErrConnectionClosed) || errors.Is(err, nats.ErrBadSubscription) {
+			ll.Debugf("Stopped consuming inbox: %s", err)
+			return
+		}
+		if err != nil {
+			// The durable consumer resumes where it stopped once the
+			// connection is reestablished
+			ll.Debugf("Unable to fetch inbox: %s", err)
+			select {
+			case <-done:
+				return
+			case <-time.After(fetchMaxWait):
+			}
+			continue
+		}
+		for _, msg := range msgs {
+			handler(msg)
+		}
+	}
+}
+
+// drainInboxes consumes messages of every peer that has a consumer on the
+// inbox, they are taken from the stream without a handshake with the peer
+func (s *Session) drainInboxes() error {
+	var peers []string
+	for peer := range s.js.ConsumerNames(inboxStreamName(s.senderAddress)) {
+		peers = append(peers, peer)
+	}
+	for _, peer := range peers {
+		if err := s.drainInbox(peer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// drainInbox consumes messages sent by peer until the session is closed,
+// unless they are consumed already
+func (s *Session) drainInbox(peer string) error {
+	s.mu.Lock()
+	_, ok := s.inboxes[peer]
+	s.mu.Unlock()
+	if ok {
+		return nil
+	}
+	sub, err := subscribeInbox(s.js, s.senderAddress, peer)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if _, ok = s.inboxes[peer]; ok {
+		s.mu.Unlock()
+		return sub.Unsubscribe()
+	}
+	s.inboxes[peer] = sub
+	s.mu.Unlock()
+
+	ll := s.logger.WithFields(logrus.Fields{
+		"method": "drainInbox",
+		"peer":   peer,
+	})
+	events := make(chan IncomingEvent)
+	replayed := func(cmsg *api.ChatMessage) bool {
+		return s.replayed(peer, cmsg)
+	}
+	delivered := func(cmsg *api.ChatMessage) {}
+	handler := NewIncomingMsgHandler(ll, s.senderProfile, peer, events, s.done, replayed, delivered)
+	go consumeInbox(ll, sub, handler, s.done)
+	go s.routeInbox(ll, peer, events)
+	ll.Debugf("Draining inbox messages from %s", peer)
+	return nil
+}
+
+// routeInbox passes events from the inbox of peer to the open chat with it,
+// messages received while no chat is open are saved to history
+func (s *Session) routeInbox(ll *logrus.Entry, peer string, events <-chan IncomingEvent) {
+	for {
+		select {
+		case <-s.done:
+			return
+		case incoming := <-events:
+			if c := s.chatWith(peer); (c != nil) && c.deliverIncoming(incoming) {
+				continue
+			}
+			s.saveInbox(ll, peer, incoming.Event.GetMessage())
+		}
+	}
+}
+
+func (s *Session) chatWith(peer string) *ChatConnection {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.chats {
+		if c.RecepientAddress == peer {
+			return c
+		}
+	}
+	return nil
+}
+
+// deliverIncoming waits for the chat to take the event, false is returned if
+// the chat is closed before
+func (c *ChatConnection) deliverIncoming(incoming IncomingEvent) bool {
+	select {
+	case c.incomingChan <- incoming:
+	case <-c.done:
+		return false
+	case <-c.session.done:
+		return false
+	}
+	if cmsg := incoming.Event.GetMessage(); cmsg != nil {
+		c.delivered(cmsg)
+	}
+	return true
+}
+
+func (s *Session) saveInbox(ll *logrus.Entry, peer string, cmsg *api.ChatMessage) {
+	if cmsg == nil {
+		return
+	}
+	s.seen.add(peer, cmsg.Id)
+	metrics.MessagesReceived.WithLabelValues(peer).Inc()
+	if s.history == nil {
+		ll.Warnf("Dropping message %q received while no chat is open, history is disabled", cmsg.Id)
+		return
+	}
+	if _, err := s.history.Append(s.senderAddress, peer, false, cmsg); err != nil {
+		ll.Errorf("Unable to save message to history: %s", err)
+		return
+	}
+	ll.Debugf("Saved message %q received while no chat is open", cmsg.Id)
+}
@@ -0,0 +1,297 @@
+package natsdaemon
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	api "github.com/aaletov/nats-chat/api/generated"
+	"github.com/aaletov/nats-chat/pkg/envelope"
+	"github.com/aaletov/nats-chat/pkg/history"
+	"github.com/aaletov/nats-chat/pkg/profile"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	inboxOwner = "alice"
+	inboxPeer  = "bob"
+)
+
+func runJetStream(t *testing.T) (*server.Server, nats.JetStreamContext) {
+	t.Helper()
+	srv := runServer(t, true)
+	nc, err := nats.Connect(srv.ClientURL())
+	if err != nil {
+		t.Fatalf("error connecting: %s", err)
+	}
+	t.Cleanup(nc.Close)
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatalf("error getting JetStream context: %s", err)
+	}
+	return srv, js
+}
+
+func publishInbox(t *testing.T, js nats.JetStreamContext, data ...string) {
+	t.Helper()
+	subject := fmt.Sprintf("chat.%s.%s", inboxOwner, inboxPeer)
+	for _, d := range data {
+		if _, err := js.Publish(subject, []byte(d)); err != nil {
+			t.Fatalf("error publishing %q: %s", d, err)
+		}
+	}
+}
+
+// consume runs consumeInbox until n messages are received and acked, messages
+// fetched after them are handed back to the consumer
+func consume(t *testing.T, sub *nats.Subscription, n int) []string {
+	t.Helper()
+	received := make(chan string, n)
+	count := 0
+	handler := func(msg *nats.Msg) {
+		if count >= n {
+			msg.Nak()
+			return
+		}
+		count++
+		msg.AckSync()
+		received <- string(msg.Data)
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		consumeInbox(logrus.NewEntry(logrus.New()), sub, handler, done)
+		close(stopped)
+	}()
+	defer func() {
+		close(done)
+		<-stopped
+	}()
+
+	var data []string
+	timeout := time.After(10 * time.Second)
+	for len(data) < n {
+		select {
+		case d := <-received:
+			data = append(data, d)
+		case <-timeout:
+			t.Fatalf("received %v, expected %d messages", data, n)
+		}
+	}
+	return data
+}
+
+func equal(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestInboxRoundTrip(t *testing.T) {
+	_, js := runJetStream(t)
+	if hasInbox(js, inboxOwner) {
+		t.Fatalf("inbox exists before ensureInbox")
+	}
+	if err := ensureInbox(js, inboxOwner); err != nil {
+		t.Fatalf("ensureInbox: %s", err)
+	}
+	if err := ensureInbox(js, inboxOwner); err != nil {
+		t.Fatalf("ensureInbox on existing stream: %s", err)
+	}
+	if !hasInbox(js, inboxOwner) {
+		t.Fatalf("inbox missing after ensureInbox")
+	}
+
+	// Sent while the owner is offline
+	publishInbox(t, js, "one", "two")
+
+	sub, err := subscribeInbox(js, inboxOwner, inboxPeer)
+	if err != nil {
+		t.Fatalf("subscribeInbox: %s", err)
+	}
+	if got := consume(t, sub, 2); !equal(got, []string{"one", "two"}) {
+		t.Fatalf("got %v, expected [one two]", got)
+	}
+	if err = sub.Unsubscribe(); err != nil {
+		t.Fatalf("error unsubscribing: %s", err)
+	}
+
+	info, err := js.StreamInfo(inboxStreamName(inboxOwner))
+	if err != nil {
+		t.Fatalf("error getting stream info: %s", err)
+	}
+	if info.State.Msgs != 0 {
+		t.Fatalf("%d messages left in the work queue after ack", info.State.Msgs)
+	}
+}
+
+func TestInboxResume(t *testing.T) {
+	_, js := runJetStream(t)
+	if err := ensureInbox(js, inboxOwner); err != nil {
+		t.Fatalf("ensureInbox: %s", err)
+	}
+	publishInbox(t, js, "one", "two", "three")
+
+	sub, err := subscribeInbox(js, inboxOwner, inboxPeer)
+	if err != nil {
+		t.Fatalf("subscribeInbox: %s", err)
+	}
+	// Only the first message is consumed before the chat is closed
+	if got := consume(t, sub, 1); !equal(got, []string{"one"}) {
+		t.Fatalf("got %v, expected [one]", got)
+	}
+	if err = sub.Unsubscribe(); err != nil {
+		t.Fatalf("error unsubscribing: %s", err)
+	}
+
+	// Sent while the chat is closed
+	publishInbox(t, js, "four")
+
+	if sub, err = subscribeInbox(js, inboxOwner, inboxPeer); err != nil {
+		t.Fatalf("subscribeInbox on existing consumer: %s", err)
+	}
+	defer sub.Unsubscribe()
+	if got := consume(t, sub, 3); !equal(got, []string{"two", "three", "four"}) {
+		t.Fatalf("got %v, expected [two three four]", got)
+	}
+}
+
+// countDeliveries runs consumeInbox with handler for the given duration and
+// returns the number of messages fetched
+func countDeliveries(t *testing.T, sub *nats.Subscription, handler nats.MsgHandler, duration time.Duration) int {
+	t.Helper()
+	var count atomic.Int32
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		consumeInbox(logrus.NewEntry(logrus.New()), sub, func(msg *nats.Msg) {
+			count.Add(1)
+			handler(msg)
+		}, done)
+		close(stopped)
+	}()
+	time.Sleep(duration)
+	close(done)
+	<-stopped
+	return int(count.Load())
+}
+
+func TestInboxMaxDeliver(t *testing.T) {
+	_, js := runJetStream(t)
+	if err := ensureInbox(js, inboxOwner); err != nil {
+		t.Fatalf("ensureInbox: %s", err)
+	}
+	publishInbox(t, js, "one")
+
+	sub, err := subscribeInbox(js, inboxOwner, inboxPeer)
+	if err != nil {
+		t.Fatalf("subscribeInbox: %s", err)
+	}
+	defer sub.Unsubscribe()
+	nak := func(msg *nats.Msg) { msg.Nak() }
+	if got := countDeliveries(t, sub, nak, 3*time.Second); got != inboxMaxDeliver {
+		t.Fatalf("message delivered %d times, expected %d", got, inboxMaxDeliver)
+	}
+}
+
+func TestInboxTermMalformed(t *testing.T) {
+	_, js := runJetStream(t)
+	if err := ensureInbox(js, inboxOwner); err != nil {
+		t.Fatalf("ensureInbox: %s", err)
+	}
+	publishInbox(t, js, "not a message")
+
+	sub, err := subscribeInbox(js, inboxOwner, inboxPeer)
+	if err != nil {
+		t.Fatalf("subscribeInbox: %s", err)
+	}
+	defer sub.Unsubscribe()
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	done := make(chan struct{})
+	defer close(done)
+	handler := NewIncomingMsgHandler(logrus.NewEntry(logger), newTestProfile(t, profile.KeyTypeEd25519), inboxPeer,
+		make(chan IncomingEvent), done,
+		func(*api.ChatMessage) bool { return false },
+		func(*api.ChatMessage) {})
+	if got := countDeliveries(t, sub, handler, 3*fetchMaxWait); got != 1 {
+		t.Fatalf("malformed message delivered %d times, expected 1", got)
+	}
+}
+
+func TestDrainInboxOnline(t *testing.T) {
+	srv, js := runJetStream(t)
+	alice := newTestProfile(t, profile.KeyTypeEd25519)
+	bob := newTestProfile(t, profile.KeyTypeEd25519)
+	if err := ensureInbox(js, alice.GetAddress()); err != nil {
+		t.Fatalf("ensureInbox: %s", err)
+	}
+	// The consumer is left by a chat opened before
+	sub, err := subscribeInbox(js, alice.GetAddress(), bob.GetAddress())
+	if err != nil {
+		t.Fatalf("subscribeInbox: %s", err)
+	}
+	if err = sub.Unsubscribe(); err != nil {
+		t.Fatalf("error unsubscribing: %s", err)
+	}
+
+	// Sent while alice is offline, bob never comes online
+	payload, err := proto.Marshal(&api.ChatMessage{Id: "1", Text: "hello"})
+	if err != nil {
+		t.Fatalf("error marshalling message: %s", err)
+	}
+	data, err := sealFor(bob.GetPrivateKey(), envelope.KindMessage, alice.GetAddress(), alice.GetPublicKey(), payload)
+	if err != nil {
+		t.Fatalf("sealFor: %s", err)
+	}
+	if _, err = js.Publish(fmt.Sprintf("chat.%s.%s", alice.GetAddress(), bob.GetAddress()), data); err != nil {
+		t.Fatalf("error publishing: %s", err)
+	}
+
+	store, err := history.Open(filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatalf("error opening history: %s", err)
+	}
+	defer store.Close()
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	s, err := Online(logger, srv.ClientURL(), alice, SessionOptions{JetStream: true, History: store})
+	if err != nil {
+		t.Fatalf("error going online: %s", err)
+	}
+	defer s.Close()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		found, err := store.Has(alice.GetAddress(), bob.GetAddress(), "1")
+		if err != nil {
+			t.Fatalf("Has: %s", err)
+		}
+		if found {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("message was not drained from the inbox")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	info, err := js.StreamInfo(inboxStreamName(alice.GetAddress()))
+	if err != nil {
+		t.Fatalf("error getting stream info: %s", err)
+	}
+	if info.State.Msgs != 0 {
+		t.Fatalf("%d messages left in the inbox", info.State.Msgs)
+	}
+}
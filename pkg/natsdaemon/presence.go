@@ -0,0 +1,281 @@
+package natsdaemon
+
+import (
+	"context"
+	"crypto"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	api "github.com/aaletov/nats-chat/api/generated"
+	"github.com/aaletov/nats-chat/pkg/envelope"
+	"github.com/aaletov/nats-chat/pkg/profile"
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	presenceInterval        = 10 * time.Second
+	presenceTimeout         = 3 * presenceInterval
+	presenceContext         = "nats-chat-presence"
+	presenceSubjectFmt      = "presence.%s"
+	presenceQuerySubjectFmt = "presence.query.%s"
+	// maxPresencePeers bounds the peers whose last seen time is kept, the
+	// least recently seen one is forgotten first
+	maxPresencePeers = 4096
+)
+
+func presenceDigestParts(pmsg *api.NatsPresence) [][]byte {
+	var (
+		t      [8]byte
+		online = []byte{0}
+	)
+	binary.BigEndian.PutUint64(t[:], uint64(pmsg.Time.AsTime().UnixNano()))
+	if pmsg.Online {
+		online[0] = 1
+	}
+	return [][]byte{[]byte(pmsg.AuthorAddress), t[:], online}
+}
+
+// signedPresence is the last online presence published by the session, it is
+// republished to queries instead of signing a new one while it is fresh
+type signedPresence struct {
+	mu     sync.Mutex
+	data   []byte
+	signed time.Time
+}
+
+func (p *signedPresence) get() []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if time.Since(p.signed) > presenceInterval {
+		return nil
+	}
+	return p.data
+}
+
+func (p *signedPresence) set(data []byte, signed time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.data = data
+	p.signed = signed
+}
+
+func (s *Session) publishPresence(online bool) error {
+	var (
+		err  error
+		data []byte
+	)
+	pmsg := &api.NatsPresence{
+		AuthorAddress: s.senderAddress,
+		PublicKey:     profile.MarshalPublicKey(s.senderProfile.GetPublicKey()),
+		Time:          timestamppb.Now(),
+		Online:        online,
+	}
+	if pmsg.Signature, err = envelope.SignData(s.senderProfile.GetPrivateKey(), presenceContext,
+		presenceDigestParts(pmsg)...); err != nil {
+		return err
+	}
+	if data, err = proto.Marshal(pmsg); err != nil {
+		return fmt.Errorf("error marshalling presence: %s", err)
+	}
+	if online {
+		s.lastPresence.set(data, pmsg.Time.AsTime())
+	} else {
+		s.lastPresence.set(nil, time.Time{})
+	}
+	return s.nc.Publish(fmt.Sprintf(presenceSubjectFmt, s.senderAddress), data)
+}
+
+// heartbeat publishes presence until the session is closed
+func (s *Session) heartbeat() {
+	ticker := time.NewTicker(presenceInterval)
+	defer ticker.Stop()
+	for {
+		if err := s.publishPresence(true); err != nil {
+			s.logger.Warnf("Unable to publish presence: %s", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// handlePresenceQuery answers with the last presence while it is fresh, so
+// queries do not cost a signature each
+func (s *Session) handlePresenceQuery(msg *nats.Msg) {
+	if data := s.lastPresence.get(); data != nil {
+		if err := s.nc.Publish(fmt.Sprintf(presenceSubjectFmt, s.senderAddress), data); err != nil {
+			s.logger.Warnf("Unable to publish presence: %s", err)
+		}
+		return
+	}
+	if err := s.publishPresence(true); err != nil {
+		s.logger.Warnf("Unable to publish presence: %s", err)
+	}
+}
+
+func verifyPresence(data []byte) (*api.NatsPresence, error) {
+	var (
+		err       error
+		publicKey crypto.PublicKey
+	)
+	pmsg := &api.NatsPresence{}
+	if err = proto.Unmarshal(data, pmsg); err != nil {
+		return nil, fmt.Errorf("error unmarshalling presence: %s", err)
+	}
+	if publicKey, err = profile.VerifiedPublicKey(pmsg.AuthorAddress, pmsg.PublicKey); err != nil {
+		return nil, err
+	}
+	if err = envelope.VerifyData(publicKey, pmsg.Signature, presenceContext, presenceDigestParts(pmsg)...); err != nil {
+		return nil, err
+	}
+	if age := time.Since(pmsg.Time.AsTime()); (age > presenceTimeout) || (age < -presenceTimeout) {
+		return nil, fmt.Errorf("stale presence of %s", pmsg.AuthorAddress)
+	}
+	return pmsg, nil
+}
+
+type presenceState struct {
+	online   bool
+	lastSeen time.Time
+}
+
+// handlePresence records the last seen time of every peer that publishes a
+// verified heartbeat, whether or not its presence is watched
+func (s *Session) handlePresence(msg *nats.Msg) {
+	pmsg, err := verifyPresence(msg.Data)
+	if err != nil {
+		s.logger.Debugf("Ignoring presence: %s", err)
+		return
+	}
+	if msg.Subject != fmt.Sprintf(presenceSubjectFmt, pmsg.AuthorAddress) {
+		s.logger.Debugf("Ignoring presence of %s published to %s", pmsg.AuthorAddress, msg.Subject)
+		return
+	}
+	if pmsg.AuthorAddress == s.senderAddress {
+		return
+	}
+	s.recordPresence(pmsg)
+}
+
+func (s *Session) recordPresence(pmsg *api.NatsPresence) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seen := pmsg.Time.AsTime()
+	state, ok := s.presence[pmsg.AuthorAddress]
+	if ok && seen.Before(state.lastSeen) {
+		return
+	}
+	if !ok && (len(s.presence) >= maxPresencePeers) {
+		var oldest string
+		for address, state := range s.presence {
+			if (oldest == "") || state.lastSeen.Before(s.presence[oldest].lastSeen) {
+				oldest = address
+			}
+		}
+		delete(s.presence, oldest)
+	}
+	s.presence[pmsg.AuthorAddress] = presenceState{
+		online:   pmsg.Online,
+		lastSeen: seen,
+	}
+}
+
+func (s *Session) presenceOf(address string) presenceState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := s.presence[address]
+	if state.online && (time.Since(state.lastSeen) > presenceTimeout) {
+		state.online = false
+	}
+	return state
+}
+
+func (p presenceState) event(address string) *api.PresenceEvent {
+	event := &api.PresenceEvent{
+		Address: address,
+		Online:  p.online,
+	}
+	if !p.lastSeen.IsZero() {
+		event.LastSeen = timestamppb.New(p.lastSeen)
+	}
+	return event
+}
+
+// WatchPresence sends presence of addresses to send until ctx is done or the
+// session is closed
+func (s *Session) WatchPresence(ctx context.Context, addresses []string, send func(*api.PresenceEvent) error) error {
+	ll := s.logger.WithFields(logrus.Fields{
+		"method": "WatchPresence",
+	})
+	heartbeats := make(chan *api.NatsPresence, len(addresses))
+	handler := func(msg *nats.Msg) {
+		pmsg, err := verifyPresence(msg.Data)
+		if err != nil {
+			ll.Warnf("Ignoring presence: %s", err)
+			return
+		}
+		select {
+		case heartbeats <- pmsg:
+		case <-ctx.Done():
+		case <-s.done:
+		}
+	}
+
+	states := make(map[string]presenceState, len(addresses))
+	for _, address := range addresses {
+		subject := fmt.Sprintf(presenceSubjectFmt, address)
+		sub, err := s.nc.Subscribe(subject, handler)
+		if err != nil {
+			return fmt.Errorf("error subscribing to presence: %s", err)
+		}
+		defer sub.Unsubscribe()
+
+		states[address] = s.presenceOf(address)
+		if err = send(states[address].event(address)); err != nil {
+			return err
+		}
+		s.nc.Publish(fmt.Sprintf(presenceQuerySubjectFmt, address), nil)
+	}
+
+	ticker := time.NewTicker(presenceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-s.done:
+			return nil
+		case pmsg := <-heartbeats:
+			state, ok := states[pmsg.AuthorAddress]
+			if !ok {
+				continue
+			}
+			changed := state.online != pmsg.Online
+			state.online = pmsg.Online
+			state.lastSeen = pmsg.Time.AsTime()
+			states[pmsg.AuthorAddress] = state
+			if changed {
+				if err := send(state.event(pmsg.AuthorAddress)); err != nil {
+					return err
+				}
+			}
+		case now := <-ticker.C:
+			for address, state := range states {
+				if state.online && (now.Sub(state.lastSeen) > presenceTimeout) {
+					state.online = false
+					states[address] = state
+					if err := send(state.event(address)); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package natsdaemon
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/aaletov/nats-chat/pkg/profile"
+	"github.com/sirupsen/logrus"
+)
+
+func TestPresenceLastSeen(t *testing.T) {
+	srv := runServer(t, false)
+	alice := goOnline(t, srv, newTestProfile(t, profile.KeyTypeEd25519))
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	// bob is seen by the heartbeat published when going online, nobody
+	// watches its presence
+	bob, err := Online(logger, srv.ClientURL(), newTestProfile(t, profile.KeyTypeEd25519), SessionOptions{})
+	if err != nil {
+		t.Fatalf("error going online: %s", err)
+	}
+
+	deadline := time.Now().Add(handshakeTestTimeout)
+	for {
+		state := alice.presenceOf(bob.senderAddress)
+		if state.online && !state.lastSeen.IsZero() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("heartbeat of the peer was not recorded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err = bob.Close(); err != nil {
+		t.Fatalf("error closing session: %s", err)
+	}
+	for {
+		state := alice.presenceOf(bob.senderAddress)
+		if !state.online {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("offline notice of the peer was not recorded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	alice.mu.Lock()
+	_, ok := alice.presence[alice.senderAddress]
+	alice.mu.Unlock()
+	if ok {
+		t.Fatalf("own heartbeat was recorded")
+	}
+}
@@ -0,0 +1,133 @@
+package natsdaemon
+
+import (
+	"crypto"
+	"fmt"
+
+	api "github.com/aaletov/nats-chat/api/generated"
+	"github.com/aaletov/nats-chat/pkg/envelope"
+	"github.com/aaletov/nats-chat/pkg/profile"
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const receiptSubjectFmt = "receipt.%s.%s"
+
+// sendReceipt tells the recepient status of the messages it sent
+func (c *ChatConnection) sendReceipt(status api.MessageStatus, ids ...string) error {
+	var (
+		err     error
+		payload []byte
+		data    []byte
+	)
+	if len(ids) == 0 {
+		return nil
+	}
+	rmsg := &api.NatsReceipt{
+		Time:       timestamppb.Now(),
+		MessageIds: ids,
+		Status:     status,
+	}
+	if payload, err = proto.Marshal(rmsg); err != nil {
+		return fmt.Errorf("unable to marshal receipt: %s", err)
+	}
+	if data, err = sealFor(c.senderKey, envelope.KindReceipt, c.RecepientAddress, c.recepientKey, payload); err != nil {
+		return err
+	}
+	if err = c.nc.Publish(fmt.Sprintf(receiptSubjectFmt, c.RecepientAddress, c.SenderAddress), data); err != nil {
+		return fmt.Errorf("unable to publish receipt: %s", err)
+	}
+	return nil
+}
+
+// MarkRead sends read receipts for the messages displayed by the cli
+func (c *ChatConnection) MarkRead(ids []string) error {
+	return c.sendReceipt(api.MessageStatus_READ, ids...)
+}
+
+// open decrypts data sent by the recepient outside of the chat subject and
+// returns its payload if it is signed by the recepient as kind
+func (c *ChatConnection) open(kind envelope.Kind, data []byte) ([]byte, error) {
+	var (
+		err       error
+		plaintext []byte
+		publicKey crypto.PublicKey
+		author    string
+	)
+	emsg := &api.NatsEncrypted{}
+	if err = proto.Unmarshal(data, emsg); err != nil {
+		return nil, fmt.Errorf("error unmarshalling encrypted message: %s", err)
+	}
+	if plaintext, err = envelope.Open(c.senderKey, emsg); err != nil {
+		return nil, err
+	}
+	smsg := &api.NatsSigned{}
+	if err = proto.Unmarshal(plaintext, smsg); err != nil {
+		return nil, fmt.Errorf("error unmarshalling signed message: %s", err)
+	}
+	if publicKey, err = envelope.Verify(smsg, kind, c.SenderAddress); err != nil {
+		return nil, err
+	}
+	if author, err = profile.AddressOf(publicKey); err != nil {
+		return nil, err
+	}
+	if author != c.RecepientAddress {
+		return nil, fmt.Errorf("message signed by %s", author)
+	}
+	return smsg.Payload, nil
+}
+
+func (c *ChatConnection) handleReceipt(msg *nats.Msg) {
+	ll := c.logger.WithFields(logrus.Fields{
+		"method": "handleReceipt",
+	})
+	var (
+		err     error
+		payload []byte
+	)
+	if payload, err = c.open(envelope.KindReceipt, msg.Data); err != nil {
+		ll.Warnf("Dropping receipt: %s", err)
+		return
+	}
+	rmsg := &api.NatsReceipt{}
+	if err = proto.Unmarshal(payload, rmsg); err != nil {
+		ll.Errorf("Error unmarshalling receipt: %s", err)
+		return
+	}
+
+	for _, id := range rmsg.MessageIds {
+		if c.history != nil {
+			if err = c.history.SetStatus(c.SenderAddress, c.RecepientAddress, id, rmsg.Status); err != nil {
+				ll.Errorf("Unable to save status: %s", err)
+			}
+		}
+		c.deliverEvent(&api.ChatEvent{
+			Event: &api.ChatEvent_Receipt{
+				Receipt: &api.Receipt{
+					Time:          rmsg.Time,
+					AuthorAddress: c.RecepientAddress,
+					MessageId:     id,
+					Status:        rmsg.Status,
+				},
+			},
+		})
+	}
+}
+
+// deliverEvent passes receipts and typing to the opened chat, events received
+// while the chat is not opened are dropped
+func (c *ChatConnection) deliverEvent(event *api.ChatEvent) {
+	c.mu.Lock()
+	opened := c.opened
+	c.mu.Unlock()
+	if opened == 0 {
+		return
+	}
+	select {
+	case c.eventChan <- event:
+	default:
+		c.logger.Warnf("Events backlog of %s is full, dropping event", c.RecepientAddress)
+	}
+}
@@ -0,0 +1,165 @@
+package natsdaemon
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	api "github.com/aaletov/nats-chat/api/generated"
+	"github.com/aaletov/nats-chat/pkg/metrics"
+	"github.com/aaletov/nats-chat/pkg/profile"
+	"github.com/nats-io/nats.go"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const defaultReconnectWait = 2 * time.Second
+
+// reconnectOptions returns options of the reconnect behaviour, the daemon
+// reconnects without a limit by default
+func reconnectOptions(ropts *api.ReconnectOptions) []nats.Option {
+	var (
+		options       []nats.Option
+		maxReconnects = -1
+		wait          = defaultReconnectWait
+	)
+	if ropts != nil {
+		if ropts.MaxReconnects != 0 {
+			maxReconnects = int(ropts.MaxReconnects)
+		}
+		if (ropts.Wait != nil) && (ropts.Wait.AsDuration() > 0) {
+			wait = ropts.Wait.AsDuration()
+		}
+		if ropts.BufferSize > 0 {
+			options = append(options, nats.ReconnectBufSize(int(ropts.BufferSize)))
+		}
+	}
+	return append(options, nats.MaxReconnects(maxReconnects), nats.ReconnectWait(wait))
+}
+
+func newConnectionEvent(state api.ConnectionState, err error) *api.ChatEvent {
+	event := &api.ConnectionEvent{
+		Time:  timestamppb.Now(),
+		State: state,
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	return &api.ChatEvent{
+		Event: &api.ChatEvent_Connection{Connection: event},
+	}
+}
+
+// broadcastConnection passes the connection state to every opened chat and
+// room
+func (s *Session) broadcastConnection(state api.ConnectionState, err error) {
+	event := newConnectionEvent(state, err)
+	s.mu.Lock()
+	chats := make([]*ChatConnection, 0, len(s.chats))
+	for chat := range s.chats {
+		chats = append(chats, chat)
+	}
+	rooms := make([]*Room, 0, len(s.rooms))
+	for _, room := range s.rooms {
+		rooms = append(rooms, room)
+	}
+	s.mu.Unlock()
+
+	for _, chat := range chats {
+		chat.deliverEvent(event)
+	}
+	for _, room := range rooms {
+		room.deliver(event)
+	}
+}
+
+func (s *Session) handleDisconnect(nc *nats.Conn, err error) {
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+	s.logger.Warnf("Disconnected from the nats server: %v", err)
+	s.connMu.Lock()
+	select {
+	case <-s.connected:
+		s.connected = make(chan struct{})
+	default:
+	}
+	s.connMu.Unlock()
+	s.broadcastConnection(api.ConnectionState_DISCONNECTED, err)
+}
+
+// handleReconnect resumes the session, subscriptions are restored by nats and
+// peers of the open chats are dialed again
+func (s *Session) handleReconnect(nc *nats.Conn) {
+	s.logger.Printf("Reconnected to the nats server: %s", nc.ConnectedUrl())
+	metrics.NatsReconnects.Inc()
+	s.connMu.Lock()
+	select {
+	case <-s.connected:
+	default:
+		close(s.connected)
+	}
+	s.connMu.Unlock()
+	s.broadcastConnection(api.ConnectionState_RECONNECTED, nil)
+
+	if err := s.publishPresence(true); err != nil {
+		s.logger.Warnf("Unable to publish presence: %s", err)
+	}
+	s.mu.Lock()
+	for chat := range s.chats {
+		go chat.redial()
+	}
+	s.mu.Unlock()
+}
+
+func (s *Session) handleClosed(nc *nats.Conn) {
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+	s.logger.Errorf("Connection to the nats server is closed: %v", nc.LastError())
+	s.broadcastConnection(api.ConnectionState_CLOSED, nc.LastError())
+}
+
+// waitConnected blocks while the connection is being reestablished, it returns
+// false if the outage lasts longer than the outage timeout or done is closed
+func (s *Session) waitConnected(done <-chan struct{}) bool {
+	s.connMu.Lock()
+	connected := s.connected
+	s.connMu.Unlock()
+	timer := time.NewTimer(s.outageTimeout)
+	defer timer.Stop()
+	select {
+	case <-connected:
+		return true
+	case <-done:
+	case <-s.done:
+	case <-timer.C:
+	}
+	return false
+}
+
+// redial repeats the handshake after a reconnect, the peer has to present the
+// same key as before
+func (c *ChatConnection) redial() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c.mu.Lock()
+	if c.cancelRedial != nil {
+		c.cancelRedial()
+	}
+	c.cancelRedial = cancel
+	c.mu.Unlock()
+
+	pinned := profile.MarshalPublicKey(c.recepientKey)
+	if _, _, err := c.session.handshake(ctx, c.RecepientAddress, pinned); err != nil {
+		if errors.Is(err, ErrHandshakeFailed) {
+			c.logger.Warnf("Unable to dial %s again: %s", c.RecepientAddress, err)
+			c.deliverEvent(newSecurityEvent(c.RecepientAddress, err.Error()))
+		}
+		return
+	}
+	c.logger.Debugf("Dialed %s again", c.RecepientAddress)
+}
@@ -0,0 +1,193 @@
+package natsdaemon
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	api "github.com/aaletov/nats-chat/api/generated"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func readCertPool(caFile string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading CA: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates in %s", caFile)
+	}
+	return pool, nil
+}
+
+// ServerCredentials returns TLS credentials of the TCP listener, clients have
+// to present a certificate signed by a CA from clientCAFile
+func ServerCredentials(certFile string, keyFile string, clientCAFile string) (credentials.TransportCredentials, error) {
+	if (certFile == "") || (keyFile == "") || (clientCAFile == "") {
+		return nil, errors.New("certificate, key and client CA are required to listen on TCP")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading certificate: %s", err)
+	}
+	var clientCAs *x509.CertPool
+	if clientCAs, err = readCertPool(clientCAFile); err != nil {
+		return nil, err
+	}
+	return credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+		MinVersion:   tls.VersionTLS12,
+	}), nil
+}
+
+// ClientCredentials returns TLS credentials of the CLI for a remote daemon,
+// the daemon certificate is verified with caFile or the system roots if empty
+func ClientCredentials(certFile string, keyFile string, caFile string) (credentials.TransportCredentials, error) {
+	if (certFile == "") || (keyFile == "") {
+		return nil, errors.New("client certificate and key are required to connect to a remote daemon")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading client certificate: %s", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if caFile != "" {
+		if config.RootCAs, err = readCertPool(caFile); err != nil {
+			return nil, err
+		}
+	}
+	return credentials.NewTLS(config), nil
+}
+
+// Fingerprint is the hex SHA-256 of the DER certificate
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// ClientAuthorizer admits remote clients by the common name or the fingerprint
+// of their verified certificate, any verified client is admitted if no names
+// are allowed
+type ClientAuthorizer struct {
+	logger  *logrus.Entry
+	allowed map[string]bool
+}
+
+func NewClientAuthorizer(logger *logrus.Logger, allowed []string) *ClientAuthorizer {
+	a := &ClientAuthorizer{
+		logger: logger.WithFields(logrus.Fields{
+			"component": "ClientAuthorizer",
+		}),
+		allowed: make(map[string]bool),
+	}
+	for _, name := range allowed {
+		a.allowed[strings.ToLower(strings.ReplaceAll(name, ":", ""))] = true
+	}
+	return a
+}
+
+func (a *ClientAuthorizer) authorize(ctx context.Context, method string) error {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return status.Error(codes.Unauthenticated, "no peer")
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || (len(info.State.VerifiedChains) == 0) || (len(info.State.VerifiedChains[0]) == 0) {
+		return status.Error(codes.Unauthenticated, "no verified client certificate")
+	}
+	cert := info.State.VerifiedChains[0][0]
+	fingerprint := Fingerprint(cert)
+	if (len(a.allowed) > 0) && !a.allowed[fingerprint] && !a.allowed[strings.ToLower(cert.Subject.CommonName)] {
+		a.logger.Warnf("Denied %s to %q (%s) from %s", method, cert.Subject.CommonName, fingerprint, p.Addr)
+		return status.Errorf(codes.PermissionDenied, "client %q is not allowed", cert.Subject.CommonName)
+	}
+	a.logger.Debugf("Allowed %s to %q from %s", method, cert.Subject.CommonName, p.Addr)
+	return nil
+}
+
+func (a *ClientAuthorizer) UnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := a.authorize(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (a *ClientAuthorizer) StreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := a.authorize(ss.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+// isRemote reports whether the request was made by a client connected over
+// TCP, such clients present a certificate
+func isRemote(ctx context.Context) bool {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return false
+	}
+	_, ok = p.AuthInfo.(credentials.TLSInfo)
+	return ok
+}
+
+// dataPath resolves path of a remote client, relative paths are in the data
+// directory and remote clients can't reach files outside of it
+func (d *daemon) dataPath(path string) (string, error) {
+	dataDir, err := filepath.Abs(d.dataDir)
+	if err != nil {
+		return "", fmt.Errorf("error resolving data directory: %s", err)
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dataDir, path)
+	}
+	path = filepath.Clean(path)
+	rel, err := filepath.Rel(dataDir, path)
+	if (err != nil) || (rel == "..") || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", status.Errorf(codes.PermissionDenied, "%s is outside of the data directory of the daemon", path)
+	}
+	return path, nil
+}
+
+// remotePaths resolves paths of the online request of a remote client, by
+// default the data directory is the profile and holds the contact book like
+// the profile of a local client
+func (d *daemon) remotePaths(req *api.OnlineRequest) (err error) {
+	if req.ProfilePath == "" {
+		req.ProfilePath = "."
+	}
+	if req.ContactsPath == "" {
+		req.ContactsPath = "contacts.json"
+	}
+	paths := []*string{&req.ProfilePath, &req.DownloadsDir, &req.ContactsPath}
+	if creds := req.Credentials; creds != nil {
+		paths = append(paths, &creds.PasswordFile, &creds.TokenFile, &creds.NkeySeedFile,
+			&creds.CredsFile, &creds.TlsCertFile, &creds.TlsKeyFile, &creds.TlsCaFile)
+	}
+	for _, path := range paths {
+		if *path == "" {
+			continue
+		}
+		if *path, err = d.dataPath(*path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
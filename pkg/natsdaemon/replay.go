@@ -0,0 +1,73 @@
+package natsdaemon
+
+import (
+	"sync"
+
+	api "github.com/aaletov/nats-chat/api/generated"
+)
+
+// seenCapacity is the number of message ids kept in memory, older ids are
+// looked up in history if it is enabled
+const seenCapacity = 4096
+
+// seenMessages remembers ids of the last messages received in every chat, so a
+// captured message published again is dropped
+type seenMessages struct {
+	mu    sync.Mutex
+	ids   map[string]struct{}
+	order []string
+	next  int
+}
+
+func newSeenMessages(capacity int) *seenMessages {
+	return &seenMessages{
+		ids:   make(map[string]struct{}, capacity),
+		order: make([]string, capacity),
+	}
+}
+
+func seenKey(chat string, id string) string {
+	return chat + "/" + id
+}
+
+func (s *seenMessages) has(chat string, id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.ids[seenKey(chat, id)]
+	return ok
+}
+
+// add remembers id, forgetting the oldest id once capacity is reached
+func (s *seenMessages) add(chat string, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := seenKey(chat, id)
+	if _, ok := s.ids[key]; ok {
+		return
+	}
+	delete(s.ids, s.order[s.next])
+	s.order[s.next] = key
+	s.next = (s.next + 1) % len(s.order)
+	s.ids[key] = struct{}{}
+}
+
+// replayed reports whether cmsg was already received in the chat with peer,
+// which is the recepient address or the history key of a room. Messages
+// without id can't be told apart from replays and are reported as replayed.
+func (s *Session) replayed(peer string, cmsg *api.ChatMessage) bool {
+	if cmsg.Id == "" {
+		return true
+	}
+	if s.seen.has(peer, cmsg.Id) {
+		return true
+	}
+	if s.history == nil {
+		return false
+	}
+	found, err := s.history.Has(s.senderAddress, peer, cmsg.Id)
+	if err != nil {
+		s.logger.Errorf("Unable to look up message in history: %s", err)
+		return false
+	}
+	return found
+}
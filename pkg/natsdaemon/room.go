@@ -0,0 +1,550 @@
+package natsdaemon
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	api "github.com/aaletov/nats-chat/api/generated"
+	"github.com/aaletov/nats-chat/pkg/envelope"
+	"github.com/aaletov/nats-chat/pkg/history"
+	"github.com/aaletov/nats-chat/pkg/profile"
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	roomBacklog    = 64
+	roomSubjectFmt = "room.%s.%s"
+	// Invites are joined automatically, so they are ignored once the sender
+	// is in maxRooms rooms or in maxRoomsPerInviter rooms joined by invite of
+	// the same member
+	maxRooms           = 64
+	maxRoomsPerInviter = 8
+)
+
+var (
+	ErrRoomNotFound  = errors.New("room not found")
+	ErrAlreadyMember = errors.New("already a member of the room")
+)
+
+// sealFor signs payload of kind for recepient and encrypts it to the
+// recepient's key
+func sealFor(senderKey crypto.Signer, kind envelope.Kind, recepient string, recepientKey crypto.PublicKey, payload []byte) ([]byte, error) {
+	var (
+		err       error
+		smsg      *api.NatsSigned
+		emsg      *api.NatsEncrypted
+		plaintext []byte
+		data      []byte
+	)
+	if smsg, err = envelope.Sign(senderKey, kind, recepient, payload); err != nil {
+		return nil, fmt.Errorf("unable to sign message: %s", err)
+	}
+	if plaintext, err = proto.Marshal(smsg); err != nil {
+		return nil, fmt.Errorf("unable to marshal signed message: %s", err)
+	}
+	if emsg, err = envelope.Seal(recepientKey, plaintext); err != nil {
+		return nil, fmt.Errorf("unable to encrypt message: %s", err)
+	}
+	if data, err = proto.Marshal(emsg); err != nil {
+		return nil, fmt.Errorf("unable to marshal encrypted message: %s", err)
+	}
+	return data, nil
+}
+
+type Room struct {
+	logger  *logrus.Entry
+	ID      string
+	Name    string
+	session *Session
+	// inviter is the member who invited the sender, empty if the sender
+	// created the room
+	inviter      string
+	mu           sync.Mutex
+	members      map[string]crypto.PublicKey
+	opened       int
+	incomingChan chan *api.ChatEvent
+	done         chan struct{}
+}
+
+func newRoom(s *Session, id string, name string) *Room {
+	return &Room{
+		logger: s.logger.Logger.WithFields(logrus.Fields{
+			"component": "Room",
+			"chat":      id,
+		}),
+		ID:           id,
+		Name:         name,
+		session:      s,
+		members:      map[string]crypto.PublicKey{s.senderAddress: s.senderProfile.GetPublicKey()},
+		incomingChan: make(chan *api.ChatEvent, roomBacklog),
+		done:         make(chan struct{}),
+	}
+}
+
+func (r *Room) Info() *api.Room {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	addresses := make([]string, 0, len(r.members))
+	for address := range r.members {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	return &api.Room{
+		RoomId:          r.ID,
+		Name:            r.Name,
+		MemberAddresses: addresses,
+	}
+}
+
+func (r *Room) isMember(address string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.members[address]
+	return ok
+}
+
+// others returns keys of every member except the sender
+func (r *Room) others() map[string]crypto.PublicKey {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	others := make(map[string]crypto.PublicKey, len(r.members))
+	for address, key := range r.members {
+		if address != r.session.senderAddress {
+			others[address] = key
+		}
+	}
+	return others
+}
+
+func (r *Room) membership(leave bool) *api.NatsRoomMembership {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	members := make([]*api.NatsRoomMember, 0, len(r.members))
+	for address, key := range r.members {
+		members = append(members, &api.NatsRoomMember{
+			Address:   address,
+			PublicKey: profile.MarshalPublicKey(key),
+		})
+	}
+	return &api.NatsRoomMembership{
+		RoomId:  r.ID,
+		Name:    r.Name,
+		Members: members,
+		Leave:   leave,
+	}
+}
+
+func (r *Room) broadcast(rmsg *api.NatsRoomMessage, recepients map[string]crypto.PublicKey) error {
+	var (
+		err     error
+		payload []byte
+		data    []byte
+	)
+	if payload, err = proto.Marshal(rmsg); err != nil {
+		return fmt.Errorf("unable to marshal room message: %s", err)
+	}
+	for address, key := range recepients {
+		if data, err = sealFor(r.session.senderProfile.GetPrivateKey(), envelope.KindRoom, address, key, payload); err != nil {
+			return err
+		}
+		if err = r.session.nc.Publish(fmt.Sprintf(roomSubjectFmt, r.ID, address), data); err != nil {
+			return fmt.Errorf("unable to publish room message: %s", err)
+		}
+	}
+	return nil
+}
+
+// Invite adds member to the room and sends the updated membership to every
+// member of the room including the invited one
+func (r *Room) Invite(member string, publicKey crypto.PublicKey) error {
+	r.mu.Lock()
+	if _, ok := r.members[member]; ok {
+		r.mu.Unlock()
+		return ErrAlreadyMember
+	}
+	r.members[member] = publicKey
+	r.mu.Unlock()
+
+	rmsg := &api.NatsRoomMessage{
+		Payload: &api.NatsRoomMessage_Membership{Membership: r.membership(false)},
+	}
+	return r.broadcast(rmsg, r.others())
+}
+
+// Leave notifies other members that the sender left the room
+func (r *Room) Leave() error {
+	rmsg := &api.NatsRoomMessage{
+		Payload: &api.NatsRoomMessage_Membership{Membership: r.membership(true)},
+	}
+	return r.broadcast(rmsg, r.others())
+}
+
+// deliver passes event to the opened room, messages received while the room
+// is not opened are only kept in history
+func (r *Room) deliver(event *api.ChatEvent) {
+	r.mu.Lock()
+	opened := r.opened
+	r.mu.Unlock()
+	if opened == 0 {
+		return
+	}
+	select {
+	case r.incomingChan <- event:
+	default:
+		r.logger.Warnf("Room %s backlog is full, dropping event", r.ID)
+	}
+}
+
+func newRoomEvent(roomID string, author string, invited []string, left bool) *api.ChatEvent {
+	return &api.ChatEvent{
+		Event: &api.ChatEvent_Room{
+			Room: &api.RoomEvent{
+				Time:             timestamppb.Now(),
+				RoomId:           roomID,
+				AuthorAddress:    author,
+				InvitedAddresses: invited,
+				Left:             left,
+			},
+		},
+	}
+}
+
+// apply updates members of the room with the membership sent by author and
+// returns addresses of the added members
+func (r *Room) apply(author string, membership *api.NatsRoomMembership) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if membership.Leave {
+		delete(r.members, author)
+		return nil, nil
+	}
+
+	added := make(map[string]crypto.PublicKey)
+	for _, member := range membership.Members {
+		if _, ok := r.members[member.Address]; ok {
+			continue
+		}
+		publicKey, err := profile.VerifiedPublicKey(member.Address, member.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		added[member.Address] = publicKey
+	}
+	addresses := make([]string, 0, len(added))
+	for address, publicKey := range added {
+		r.members[address] = publicKey
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	return addresses, nil
+}
+
+func (r *Room) saveHistory(outgoing bool, cmsg *api.ChatMessage) {
+	if r.session.history == nil {
+		return
+	}
+	if _, err := r.session.history.Append(r.session.senderAddress, history.RoomKey(r.ID), outgoing, cmsg); err != nil {
+		r.logger.Errorf("Unable to save message to history: %s", err)
+	}
+}
+
+func (r *Room) Send(srv api.Daemon_SendServer) error {
+	ll := r.logger.WithFields(logrus.Fields{
+		"method": "Send",
+	})
+	r.mu.Lock()
+	r.opened++
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		r.opened--
+		r.mu.Unlock()
+	}()
+
+	eof := make(chan struct{}, 1)
+	g := errgroup.Group{}
+	g.Go(func() (err error) {
+		for {
+			select {
+			case <-eof:
+				ll.Debugln("Got EOF from cli, exiting server send loop")
+				return nil
+			case <-r.done:
+				ll.Debugln("Room was closed, exiting server send loop")
+				return nil
+			case event := <-r.incomingChan:
+				if err = srv.Send(event); err != nil {
+					return fmt.Errorf("Unable to send message: %s\n", err)
+				}
+				ll.Debugf("Sent event to cli: %s", event)
+			}
+		}
+	})
+
+	g.Go(func() (err error) {
+		var input *api.ChatInput
+		defer func() { eof <- struct{}{} }()
+		for {
+			input, err = srv.Recv()
+			if err != nil {
+				if err == io.EOF {
+					ll.Debugln("Got eof from client")
+					return nil
+				}
+				return fmt.Errorf("Unable to get message: %s", err)
+			}
+			// Typing is only sent in chats
+			cmsg := input.GetMessage()
+			if cmsg == nil {
+				continue
+			}
+			if cmsg.Id == "" {
+				if cmsg.Id, err = NewID(); err != nil {
+					return err
+				}
+			}
+			cmsg.AuthorAddress = r.session.senderAddress
+			cmsg.RoomId = r.ID
+			rmsg := &api.NatsRoomMessage{
+				Payload: &api.NatsRoomMessage_Message{Message: cmsg},
+			}
+			if err = r.broadcast(rmsg, r.others()); err != nil {
+				return err
+			}
+			ll.Debugf("Published message to room %s: %s", r.ID, cmsg)
+			r.saveHistory(true, cmsg)
+		}
+	})
+
+	return g.Wait()
+}
+
+func (r *Room) Close() {
+	close(r.done)
+}
+
+// handleRoom receives messages published to room.*.<sender> and dispatches
+// them to the rooms
+func (s *Session) handleRoom(msg *nats.Msg) {
+	ll := s.logger.WithFields(logrus.Fields{
+		"method": "handleRoom",
+	})
+	var (
+		err       error
+		plaintext []byte
+		publicKey crypto.PublicKey
+		author    string
+	)
+	tokens := strings.Split(msg.Subject, ".")
+	if len(tokens) != 3 {
+		ll.Warnf("Ignoring message on %s", msg.Subject)
+		return
+	}
+	roomID := tokens[1]
+	ll = ll.WithFields(logrus.Fields{"chat": roomID})
+
+	emsg := &api.NatsEncrypted{}
+	if err = proto.Unmarshal(msg.Data, emsg); err != nil {
+		ll.Errorf("Error unmarshalling encrypted message: %s", err)
+		return
+	}
+	if plaintext, err = envelope.Open(s.senderProfile.GetPrivateKey(), emsg); err != nil {
+		ll.Warnf("Error decrypting message to room %s: %s", roomID, err)
+		return
+	}
+	smsg := &api.NatsSigned{}
+	if err = proto.Unmarshal(plaintext, smsg); err != nil {
+		ll.Errorf("Error unmarshalling signed message: %s", err)
+		return
+	}
+	if publicKey, err = envelope.Verify(smsg, envelope.KindRoom, s.senderAddress); err != nil {
+		ll.Warnf("Dropping message to room %s: %s", roomID, err)
+		return
+	}
+	if author, err = profile.AddressOf(publicKey); err != nil {
+		ll.Errorf("Error getting address of author: %s", err)
+		return
+	}
+	ll = ll.WithFields(logrus.Fields{"peer": author})
+	rmsg := &api.NatsRoomMessage{}
+	if err = proto.Unmarshal(smsg.Payload, rmsg); err != nil {
+		ll.Errorf("Error unmarshalling room message: %s", err)
+		return
+	}
+
+	room, ok := s.getRoom(roomID)
+	if !ok {
+		if membership := rmsg.GetMembership(); membership != nil {
+			s.joinRoom(ll, roomID, author, membership)
+		} else {
+			ll.Debugf("Ignoring message to unknown room %s", roomID)
+		}
+		return
+	}
+	if !room.isMember(author) {
+		ll.Warnf("Dropping message to room %s from non-member %s", roomID, author)
+		room.deliver(newSecurityEvent(author, fmt.Sprintf("dropped message to room %s from non-member", roomID)))
+		return
+	}
+
+	switch p := rmsg.Payload.(type) {
+	case *api.NatsRoomMessage_Membership:
+		if p.Membership.RoomId != roomID {
+			room.deliver(newSecurityEvent(author, "dropped membership of another room"))
+			return
+		}
+		var added []string
+		if added, err = room.apply(author, p.Membership); err != nil {
+			ll.Warnf("Dropping membership of room %s: %s", roomID, err)
+			room.deliver(newSecurityEvent(author, fmt.Sprintf("dropped membership: %s", err)))
+			return
+		}
+		if p.Membership.Leave || (len(added) > 0) {
+			room.deliver(newRoomEvent(roomID, author, added, p.Membership.Leave))
+		}
+	case *api.NatsRoomMessage_Message:
+		cmsg := p.Message
+		if (cmsg.AuthorAddress != author) || (cmsg.RoomId != roomID) {
+			ll.Warnf("Dropping message to room %s signed by %s", roomID, author)
+			room.deliver(newSecurityEvent(author, fmt.Sprintf("dropped message claiming to be from %s", cmsg.AuthorAddress)))
+			return
+		}
+		if s.replayed(history.RoomKey(roomID), cmsg) {
+			ll.Warnf("Dropping replayed message %q to room %s", cmsg.Id, roomID)
+			return
+		}
+		s.seen.add(history.RoomKey(roomID), cmsg.Id)
+		room.saveHistory(false, cmsg)
+		room.deliver(&api.ChatEvent{Event: &api.ChatEvent_Message{Message: cmsg}})
+	}
+}
+
+// joinRoom creates the room the sender was invited to by author
+func (s *Session) joinRoom(ll *logrus.Entry, roomID string, author string, membership *api.NatsRoomMembership) {
+	if membership.Leave || (membership.RoomId != roomID) {
+		return
+	}
+	listed := map[string]bool{}
+	for _, member := range membership.Members {
+		listed[member.Address] = true
+	}
+	if !listed[author] || !listed[s.senderAddress] {
+		ll.Warnf("Ignoring invite to room %s from %s: not a member", roomID, author)
+		return
+	}
+	// Inviting starts a handshake, so the inviter has proved its address
+	if !s.verified(author) {
+		ll.Warnf("Ignoring invite to room %s from %s: no handshake", roomID, author)
+		return
+	}
+
+	room := newRoom(s, roomID, membership.Name)
+	room.inviter = author
+	if _, err := room.apply(author, membership); err != nil {
+		ll.Warnf("Ignoring invite to room %s from %s: %s", roomID, author, err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.rooms[roomID]; ok {
+		return
+	}
+	if len(s.rooms) >= maxRooms {
+		ll.Warnf("Ignoring invite to room %s from %s: already in %d rooms", roomID, author, len(s.rooms))
+		return
+	}
+	invited := 0
+	for _, r := range s.rooms {
+		if r.inviter == author {
+			invited++
+		}
+	}
+	if invited >= maxRoomsPerInviter {
+		ll.Warnf("Ignoring invite to room %s from %s: already in %d rooms it invited to", roomID, author, invited)
+		return
+	}
+	s.rooms[roomID] = room
+	ll.Printf("Joined room %s invited by %s", roomID, author)
+}
+
+func (s *Session) getRoom(roomID string) (*Room, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	room, ok := s.rooms[roomID]
+	return room, ok
+}
+
+func (s *Session) Rooms() []*Room {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rooms := make([]*Room, 0, len(s.rooms))
+	for _, room := range s.rooms {
+		rooms = append(rooms, room)
+	}
+	return rooms
+}
+
+func (s *Session) CreateRoom(name string) (*Room, error) {
+	var (
+		err    error
+		roomID string
+	)
+	if roomID, err = NewID(); err != nil {
+		return nil, err
+	}
+	room := newRoom(s, roomID, name)
+
+	s.mu.Lock()
+	s.rooms[roomID] = room
+	s.mu.Unlock()
+	return room, nil
+}
+
+// InviteToRoom proves that member owns its address and invites it to the room
+func (s *Session) InviteToRoom(ctx context.Context, roomID string, member string, pinned []byte) error {
+	var (
+		err       error
+		publicKey crypto.PublicKey
+		current   string
+	)
+	room, ok := s.getRoom(roomID)
+	if !ok {
+		return ErrRoomNotFound
+	}
+	if room.isMember(member) {
+		return ErrAlreadyMember
+	}
+	if publicKey, current, err = s.handshake(ctx, member, pinned); err != nil {
+		return fmt.Errorf("unable to invite %s: %w", member, err)
+	}
+	if current != member {
+		s.moveContacts(member, publicKey, current, publicKey)
+		if room.isMember(current) {
+			return ErrAlreadyMember
+		}
+	}
+	return room.Invite(current, publicKey)
+}
+
+func (s *Session) LeaveRoom(roomID string) error {
+	s.mu.Lock()
+	room, ok := s.rooms[roomID]
+	delete(s.rooms, roomID)
+	s.mu.Unlock()
+	if !ok {
+		return ErrRoomNotFound
+	}
+	defer room.Close()
+	return room.Leave()
+}
@@ -0,0 +1,141 @@
+package natsdaemon
+
+import (
+	"crypto"
+	"fmt"
+
+	api "github.com/aaletov/nats-chat/api/generated"
+	"github.com/aaletov/nats-chat/pkg/contacts"
+	"github.com/aaletov/nats-chat/pkg/profile"
+	"github.com/aaletov/nats-chat/pkg/rotation"
+	"github.com/nats-io/nats.go"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	rotationSubjectFmt      = "rotation.%s"
+	rotationQuerySubjectFmt = "rotation.query.%s"
+)
+
+// subscribeRotations receives statements of contacts and answers queries for
+// statements of the former addresses of the session
+func (s *Session) subscribeRotations() error {
+	var (
+		err error
+		sub *nats.Subscription
+	)
+	senderRotation := fmt.Sprintf(rotationSubjectFmt, s.senderAddress)
+	if sub, err = s.nc.Subscribe(senderRotation, s.handleRotation); err != nil {
+		return fmt.Errorf("error subscribing to rotations: %s", err)
+	}
+	s.rotationSubs = append(s.rotationSubs, sub)
+
+	for _, rmsg := range s.rotations {
+		oldQuery := fmt.Sprintf(rotationQuerySubjectFmt, rmsg.OldAddress)
+		if sub, err = s.nc.Subscribe(oldQuery, s.handleRotationQuery); err != nil {
+			return fmt.Errorf("error subscribing to rotation query: %s", err)
+		}
+		s.rotationSubs = append(s.rotationSubs, sub)
+	}
+	return nil
+}
+
+// publishRotations publishes every statement in order, so contacts that missed
+// several rotations follow the whole chain
+func (s *Session) publishRotations(to string) error {
+	for _, rmsg := range s.rotations {
+		data, err := proto.Marshal(rmsg)
+		if err != nil {
+			return fmt.Errorf("error marshalling rotation: %s", err)
+		}
+		if err = s.nc.Publish(fmt.Sprintf(rotationSubjectFmt, to), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleRotationQuery answers with the statements to the address in the query
+func (s *Session) handleRotationQuery(msg *nats.Msg) {
+	asker := string(msg.Data)
+	if !profile.IsAddress(asker) {
+		s.logger.Debugf("Ignoring rotation query from %q", asker)
+		return
+	}
+	if err := s.publishRotations(asker); err != nil {
+		s.logger.Warnf("Unable to publish rotations to %s: %s", asker, err)
+	}
+}
+
+// announceRotations publishes statements of the session to every contact and
+// asks contacts whether they rotated their keys while the session was offline
+func (s *Session) announceRotations() {
+	if s.contactsPath == "" {
+		return
+	}
+	book, err := contacts.Open(s.contactsPath)
+	if err != nil {
+		s.logger.Warnf("Unable to read contacts: %s", err)
+		return
+	}
+	for _, contact := range book.List() {
+		if err = s.publishRotations(contact.Address); err != nil {
+			s.logger.Warnf("Unable to publish rotations to %s: %s", contact.Name, err)
+		}
+		query := fmt.Sprintf(rotationQuerySubjectFmt, contact.Address)
+		if err = s.nc.Publish(query, []byte(s.senderAddress)); err != nil {
+			s.logger.Warnf("Unable to query rotation of %s: %s", contact.Name, err)
+		}
+	}
+}
+
+// handleRotation moves contacts to the new address once the statement is
+// verified
+func (s *Session) handleRotation(msg *nats.Msg) {
+	var (
+		err    error
+		oldKey crypto.PublicKey
+		newKey crypto.PublicKey
+	)
+	rmsg := &api.NatsRotation{}
+	if err = proto.Unmarshal(msg.Data, rmsg); err != nil {
+		s.logger.Errorf("Error unmarshalling rotation: %s", err)
+		return
+	}
+	if oldKey, newKey, err = rotation.Verify(rmsg); err != nil {
+		s.logger.Warnf("Dropping rotation of %s: %s", rmsg.OldAddress, err)
+		return
+	}
+	s.moveContacts(rmsg.OldAddress, oldKey, rmsg.NewAddress, newKey)
+}
+
+// moveContacts updates the contact book after a contact moved from oldAddress
+// to newAddress, either by rotating its key or by upgrading a legacy address
+func (s *Session) moveContacts(oldAddress string, oldKey crypto.PublicKey, newAddress string, newKey crypto.PublicKey) {
+	if s.contactsPath == "" {
+		return
+	}
+	var (
+		err   error
+		book  *contacts.Book
+		moved []string
+	)
+	s.contactsMu.Lock()
+	defer s.contactsMu.Unlock()
+	if book, err = contacts.Open(s.contactsPath); err != nil {
+		s.logger.Warnf("Unable to read contacts: %s", err)
+		return
+	}
+	if moved, err = book.Move(oldAddress, oldKey, newAddress, newKey); err != nil {
+		s.logger.Warnf("Refusing to move %s: %s", oldAddress, err)
+		return
+	}
+	if len(moved) == 0 {
+		return
+	}
+	if err = book.Save(); err != nil {
+		s.logger.Errorf("Unable to save contacts: %s", err)
+		return
+	}
+	s.logger.Printf("Contacts %v moved from %s to %s", moved, oldAddress, newAddress)
+}
@@ -1,31 +1,147 @@
 package natsdaemon
 
 import (
-	"errors"
+	"context"
+	"crypto"
+	"crypto/rand"
 	"fmt"
 	"io"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	api "github.com/aaletov/nats-chat/api/generated"
+	"github.com/aaletov/nats-chat/pkg/envelope"
+	"github.com/aaletov/nats-chat/pkg/history"
+	"github.com/aaletov/nats-chat/pkg/metrics"
+	"github.com/aaletov/nats-chat/pkg/profile"
+	"github.com/aaletov/nats-chat/pkg/tracing"
+	"github.com/btcsuite/btcutil/base58"
 	"github.com/hashicorp/go-multierror"
 	"github.com/nats-io/nats.go"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/sync/errgroup"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
+const (
+	idSize        = 16
+	eventsBacklog = 64
+)
+
+// NewID generates ids of rooms and messages
+func NewID() (string, error) {
+	id := make([]byte, idSize)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return "", fmt.Errorf("error generating id: %s", err)
+	}
+	return base58.Encode(id), nil
+}
+
 type Session struct {
 	logger        *logrus.Entry
 	nc            *nats.Conn
+	senderProfile profile.Profile
 	senderAddress string
 	pingSub       *nats.Subscription
+	legacyPingSub *nats.Subscription
+	proofSub      *nats.Subscription
+	roomSub       *nats.Subscription
+	querySub      *nats.Subscription
+	presenceSub   *nats.Subscription
+	done          chan struct{}
+	js            nats.JetStreamContext
+	inboxes       map[string]*nats.Subscription
+	history       *history.Store
+	mu            sync.Mutex
+	pending       map[string]pendingChallenge
+	verifiedPeers map[string]crypto.PublicKey
+	rooms         map[string]*Room
+	presence      map[string]presenceState
+	lastPresence  signedPresence
+	offers        *fileOffers
+	seen          *seenMessages
+	downloadsDir  string
+	contactsPath  string
+	contactsMu    sync.Mutex
+	rotations     []*api.NatsRotation
+	rotationSubs  []*nats.Subscription
+	chats         map[*ChatConnection]struct{}
+	connMu        sync.Mutex
+	connected     chan struct{}
+	outageTimeout time.Duration
+	started       time.Time
 }
 
-func Online(logger *logrus.Logger, natsUrl string, senderAddress string) (*Session, error) {
+type SessionOptions struct {
+	// JetStream enables durable inbox stream, so messages sent while the daemon
+	// is offline are delivered after it goes online
+	JetStream bool
+	// History stores every message sent or received in chats, disabled if nil
+	History *history.Store
+	// DownloadsDir is where accepted files are saved
+	DownloadsDir string
+	// ContactsPath is the contact book updated when contacts rotate their keys,
+	// rotations are ignored if empty
+	ContactsPath string
+	// Rotations are statements of the former keys of the profile announced to
+	// contacts
+	Rotations []*api.NatsRotation
+	// NatsOptions are passed to nats.Connect, such as authentication and TLS
+	NatsOptions []nats.Option
+	// ConnectTimeout limits connecting to the nats server, DefaultConnectTimeout
+	// if zero
+	ConnectTimeout time.Duration
+	// OutageTimeout is how long publishing to an inbox waits for the
+	// connection to come back, DefaultOutageTimeout if zero
+	OutageTimeout time.Duration
+}
+
+func Online(logger *logrus.Logger, natsUrl string, senderProfile profile.Profile, opts SessionOptions) (*Session, error) {
 	ll := logger.WithFields(logrus.Fields{
 		"method": "Online",
 	})
-	options := []nats.Option{nats.Timeout(30 * time.Second)}
+	senderAddress := senderProfile.GetAddress()
+	s := &Session{
+		logger:        logger.WithFields(logrus.Fields{"component": "Session"}),
+		senderProfile: senderProfile,
+		senderAddress: senderAddress,
+		history:       opts.History,
+		pending:       make(map[string]pendingChallenge),
+		verifiedPeers: make(map[string]crypto.PublicKey),
+		inboxes:       make(map[string]*nats.Subscription),
+		rooms:         make(map[string]*Room),
+		presence:      make(map[string]presenceState),
+		offers:        newFileOffers(),
+		seen:          newSeenMessages(seenCapacity),
+		downloadsDir:  opts.DownloadsDir,
+		contactsPath:  opts.ContactsPath,
+		rotations:     opts.Rotations,
+		chats:         make(map[*ChatConnection]struct{}),
+		outageTimeout: opts.OutageTimeout,
+		started:       time.Now(),
+		connected:     make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	close(s.connected)
+	connectTimeout := opts.ConnectTimeout
+	if connectTimeout <= 0 {
+		connectTimeout = DefaultConnectTimeout
+	}
+	if s.outageTimeout <= 0 {
+		s.outageTimeout = DefaultOutageTimeout
+	}
+
+	options := append([]nats.Option{nats.Timeout(connectTimeout)}, opts.NatsOptions...)
+	options = append(options,
+		nats.DisconnectErrHandler(s.handleDisconnect),
+		nats.ReconnectHandler(s.handleReconnect),
+		nats.ClosedHandler(s.handleClosed),
+	)
 	var (
 		err error
 		nc  *nats.Conn
@@ -33,157 +149,460 @@ func Online(logger *logrus.Logger, natsUrl string, senderAddress string) (*Sessi
 	if nc, err = nats.Connect(natsUrl, options...); err != nil {
 		return nil, fmt.Errorf("error connecting to nats instance: %s", err)
 	}
+	s.nc = nc
 	ll.Println("Connected to the nats server")
 
-	senderPing := fmt.Sprintf("ping.%s", senderAddress)
-	sub, err := nc.Subscribe(senderPing, func(msg *nats.Msg) {
-		var (
-			err        error
-			pmsg       *api.NatsPing = &api.NatsPing{}
-			marshalled []byte
-		)
-		if err = proto.Unmarshal(msg.Data, pmsg); err != nil {
-			ll.Printf("error unmarshalling ping message: %s\n", err)
+	if opts.JetStream {
+		if s.js, err = nc.JetStream(); err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("error getting jetstream context: %s", err)
 		}
-		recepientOnline := fmt.Sprintf("online.%s", pmsg.AuthorAddress)
-		omsg := &api.NatsOnline{AuthorAddress: senderAddress, IsOnline: true}
-		if marshalled, err = proto.Marshal(omsg); err != nil {
-			ll.Printf("error marshalling online message: %s\n", err)
+		if err = ensureInbox(s.js, senderAddress); err != nil {
+			nc.Close()
+			return nil, err
+		}
+		ll.Printf("Using inbox stream: %s\n", inboxStreamName(senderAddress))
+		if err = s.drainInboxes(); err != nil {
+			nc.Close()
+			return nil, err
 		}
-		nc.Publish(recepientOnline, marshalled)
-		msg.Ack()
-	})
-	if err != nil {
-		return nil, fmt.Errorf("error subscribing to ping: %s", err)
 	}
 
+	senderPing := fmt.Sprintf(pingSubjectFmt, senderAddress)
+	if s.pingSub, err = nc.Subscribe(senderPing, s.handleChallenge); err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("error subscribing to ping: %s", err)
+	}
 	ll.Printf("Subscribed at sender ping: %s\n", senderPing)
-	return &Session{
-		logger:        logger.WithFields(logrus.Fields{"component": "Session"}),
-		nc:            nc,
-		senderAddress: senderAddress,
-		pingSub:       sub,
-	}, nil
+
+	// Peers that know only the legacy address of an RSA key are answered with
+	// the current one
+	if senderProfile.GetKeyType() == profile.KeyTypeRSA {
+		var legacyAddress string
+		if legacyAddress, err = profile.LegacyAddressOf(senderProfile.GetPublicKey()); err != nil {
+			nc.Close()
+			return nil, err
+		}
+		legacyPing := fmt.Sprintf(pingSubjectFmt, legacyAddress)
+		if s.legacyPingSub, err = nc.Subscribe(legacyPing, s.handleChallenge); err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("error subscribing to legacy ping: %s", err)
+		}
+	}
+
+	senderProof := fmt.Sprintf(proofSubjectFmt, senderAddress)
+	if s.proofSub, err = nc.Subscribe(senderProof, s.handleProof); err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("error subscribing to proof: %s", err)
+	}
+	ll.Printf("Subscribed at sender proof: %s\n", senderProof)
+
+	senderRooms := fmt.Sprintf(roomSubjectFmt, "*", senderAddress)
+	if s.roomSub, err = nc.Subscribe(senderRooms, s.handleRoom); err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("error subscribing to rooms: %s", err)
+	}
+	ll.Printf("Subscribed at sender rooms: %s\n", senderRooms)
+
+	senderQuery := fmt.Sprintf(presenceQuerySubjectFmt, senderAddress)
+	if s.querySub, err = nc.Subscribe(senderQuery, s.handlePresenceQuery); err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("error subscribing to presence query: %s", err)
+	}
+	if s.presenceSub, err = nc.Subscribe(fmt.Sprintf(presenceSubjectFmt, "*"), s.handlePresence); err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("error subscribing to presence: %s", err)
+	}
+	if err = s.subscribeRotations(); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	go s.heartbeat()
+	go s.announceRotations()
+	go s.expireOffers()
+	ll.Printf("Publishing presence at: %s\n", fmt.Sprintf(presenceSubjectFmt, senderAddress))
+
+	return s, nil
 }
 
 func (s *Session) Close() (err error) {
 	defer s.nc.Close()
-	return s.pingSub.Unsubscribe()
+	close(s.done)
+	var merr *multierror.Error
+	merr = multierror.Append(merr, s.querySub.Unsubscribe())
+	merr = multierror.Append(merr, s.presenceSub.Unsubscribe())
+	merr = multierror.Append(merr, s.publishPresence(false))
+	merr = multierror.Append(merr, s.nc.Flush())
+	merr = multierror.Append(merr, s.pingSub.Unsubscribe())
+	if s.legacyPingSub != nil {
+		merr = multierror.Append(merr, s.legacyPingSub.Unsubscribe())
+	}
+	merr = multierror.Append(merr, s.proofSub.Unsubscribe())
+	merr = multierror.Append(merr, s.roomSub.Unsubscribe())
+	for _, sub := range s.rotationSubs {
+		merr = multierror.Append(merr, sub.Unsubscribe())
+	}
+	s.mu.Lock()
+	for peer, sub := range s.inboxes {
+		merr = multierror.Append(merr, sub.Unsubscribe())
+		delete(s.inboxes, peer)
+	}
+	s.mu.Unlock()
+
+	s.mu.Lock()
+	for roomID, room := range s.rooms {
+		room.Close()
+		delete(s.rooms, roomID)
+	}
+	s.mu.Unlock()
+	return merr.ErrorOrNil()
+}
+
+func newSecurityEvent(author string, reason string) *api.ChatEvent {
+	return &api.ChatEvent{
+		Event: &api.ChatEvent_Security{
+			Security: &api.SecurityEvent{
+				Time:          timestamppb.Now(),
+				AuthorAddress: author,
+				Reason:        reason,
+			},
+		},
+	}
 }
 
-func NewIncomingMsgHandler(logger *logrus.Logger, incomingChan chan *api.ChatMessage) nats.MsgHandler {
+// IncomingEvent is an event from nats with the context of its receive span
+type IncomingEvent struct {
+	Context context.Context
+	Event   *api.ChatEvent
+}
+
+// NewIncomingMsgHandler passes messages from recepient to incomingChan and
+// calls delivered for every message taken from it, messages for which
+// replayed returns true are dropped
+func NewIncomingMsgHandler(logger *logrus.Entry, senderProfile profile.Profile, recepient string, incomingChan chan<- IncomingEvent, done <-chan struct{}, replayed func(*api.ChatMessage) bool, delivered func(*api.ChatMessage)) nats.MsgHandler {
 	return func(msg *nats.Msg) {
+		var (
+			err       error
+			plaintext []byte
+			publicKey crypto.PublicKey
+			author    string
+		)
+		ctx, span := tracing.Tracer().Start(tracing.Extract(context.Background(), msg), "nats.receive",
+			trace.WithSpanKind(trace.SpanKindConsumer),
+			trace.WithAttributes(
+				attribute.String("messaging.system", "nats"),
+				attribute.String("messaging.source.name", msg.Subject),
+				attribute.String("natschat.peer", recepient),
+			))
+		defer span.End()
+		ll := logger.WithFields(tracing.Fields(ctx))
+		fail := func(reason string) {
+			span.SetStatus(codes.Error, reason)
+		}
+		deliver := func(event *api.ChatEvent) bool {
+			select {
+			case incomingChan <- IncomingEvent{Context: ctx, Event: event}:
+				return true
+			case <-done:
+				return false
+			}
+		}
+
+		emsg := &api.NatsEncrypted{}
+		if err = proto.Unmarshal(msg.Data, emsg); err != nil {
+			ll.Errorf("Error unmarshalling encrypted message: %s", err)
+			fail("unmarshal encrypted")
+			metrics.UnmarshalFailures.WithLabelValues(metrics.StageEncrypted).Inc()
+			msg.Term()
+			return
+		}
+		if plaintext, err = envelope.Open(senderProfile.GetPrivateKey(), emsg); err != nil {
+			ll.Warnf("Error decrypting message: %s", err)
+			fail("decrypt")
+			deliver(newSecurityEvent(recepient, fmt.Sprintf("unable to decrypt message: %s", err)))
+			msg.Term()
+			return
+		}
+		smsg := &api.NatsSigned{}
+		if err = proto.Unmarshal(plaintext, smsg); err != nil {
+			ll.Errorf("Error unmarshalling signed message: %s", err)
+			fail("unmarshal signed")
+			metrics.UnmarshalFailures.WithLabelValues(metrics.StageSigned).Inc()
+			msg.Term()
+			return
+		}
+		if publicKey, err = envelope.Verify(smsg, envelope.KindMessage, senderProfile.GetAddress()); err != nil {
+			ll.Warnf("Dropping message: %s", err)
+			fail("verify")
+			deliver(newSecurityEvent(recepient, fmt.Sprintf("dropped message: %s", err)))
+			msg.Term()
+			return
+		}
+		if author, err = profile.AddressOf(publicKey); err != nil {
+			ll.Errorf("Error getting address of author: %s", err)
+			fail("author")
+			msg.Term()
+			return
+		}
+		if author != recepient {
+			ll.Warnf("Dropping message signed by %s", author)
+			fail("author")
+			deliver(newSecurityEvent(recepient, fmt.Sprintf("dropped message signed by %s", author)))
+			msg.Term()
+			return
+		}
 		cmsg := &api.ChatMessage{}
-		if err := proto.Unmarshal(msg.Data, cmsg); err != nil {
-			logger.Fatalf("Error unmarshalling message: %s", err)
+		if err = proto.Unmarshal(smsg.Payload, cmsg); err != nil {
+			ll.Errorf("Error unmarshalling message: %s", err)
+			fail("unmarshal message")
+			metrics.UnmarshalFailures.WithLabelValues(metrics.StageMessage).Inc()
+			msg.Term()
+			return
+		}
+		span.SetAttributes(attribute.String("natschat.message_id", cmsg.Id))
+		if replayed(cmsg) {
+			ll.Warnf("Dropping replayed message %q", cmsg.Id)
+			fail("replayed")
+			msg.Term()
+			return
+		}
+		ll.Debugf("Got message from nats in handler: %s", cmsg)
+		if !deliver(&api.ChatEvent{Event: &api.ChatEvent_Message{Message: cmsg}}) {
+			ll.Debugln("Chat was closed before message was delivered")
+			fail("chat closed")
 			msg.Nak()
 			return
 		}
-		logger.Debugf("Got message from nats in handler: %s", cmsg)
-		incomingChan <- cmsg
 		msg.Ack()
-		logger.Debugln("Acknowledged nats")
+		ll.Debugln("Acknowledged nats")
+		delivered(cmsg)
 	}
 }
 
-// func ProccessOutcomingChan(nc *nats.Conn, recepient string, outcomingChan chan api.ChatMessage) {
-// 	recepientChat := fmt.Sprintf("chat.%s", c.RecepientAddress)
-// 	for cmsg := <- outcomingChan {
-// 		nc.Publish(recepient, cmsg)
-// 	}
-// }
+// Dial opens a chat with recepient, the latency is observed by the dial
+// duration metric
+func (s *Session) Dial(ctx context.Context, recepient string, pinned []byte) (*ChatConnection, error) {
+	start := time.Now()
+	c, err := s.dial(ctx, recepient, pinned)
+	metrics.ObserveDial(start, err)
+	return c, err
+}
 
-func (s *Session) Dial(recepient string) (*ChatConnection, error) {
+func (s *Session) dial(ctx context.Context, recepient string, pinned []byte) (*ChatConnection, error) {
 	ll := s.logger.WithFields(logrus.Fields{
 		"method": "Dial",
+		"chat":   recepient,
+		"peer":   recepient,
 	})
-	senderOnline := fmt.Sprintf("online.%s", s.senderAddress)
-	senderChat := fmt.Sprintf("chat.%s", s.senderAddress)
-	recepientPing := fmt.Sprintf("ping.%s", recepient)
-
-	var err error
-	online := make(chan bool)
-	onlineSub, err := s.nc.Subscribe(senderOnline, func(msg *nats.Msg) {
-		omsg := &api.NatsOnline{}
-		if err := proto.Unmarshal(msg.Data, omsg); err != nil {
-			msg.Nak()
-			return
-		}
-		if omsg.AuthorAddress != recepient {
-			msg.Nak()
-			return
-		}
-		online <- omsg.IsOnline
-		msg.Ack()
-	})
-	if err != nil {
-		return nil, fmt.Errorf("error subscribing to sender online: %s", err)
+	var (
+		err          error
+		recepientKey crypto.PublicKey
+		current      string
+	)
+	if recepientKey, current, err = s.handshake(ctx, recepient, pinned); err != nil {
+		return nil, fmt.Errorf("unable to dial %s: %w", recepient, err)
 	}
-	ll.Debugf("Subscribed at sender online: %s\n", senderOnline)
-
-	incomingChan := make(chan *api.ChatMessage)
-	chatSub, _ := s.nc.Subscribe(senderChat, NewIncomingMsgHandler(ll.Logger, incomingChan))
-	ll.Debugf("Subscribed at sender chat %s\n", senderChat)
-
-	ticker := time.NewTicker(33 * time.Millisecond)
-	err = func() error {
-		pmsg := &api.NatsPing{AuthorAddress: s.senderAddress}
-		var (
-			err  error
-			data []byte
-		)
-		if data, err = proto.Marshal(pmsg); err != nil {
-			ll.Debugf("error marshal ping message: %s\n", err)
-		}
-		for {
-			select {
-			case <-ticker.C:
-				s.nc.Publish(recepientPing, data)
-				ll.Debugf("Pinged %s\n", recepient)
-			case isOnline := <-online:
-				ticker.Stop()
-				if !isOnline {
-					return errors.New("Recepient went offline")
-				}
-				ll.Debugf("Got online from %s", recepient)
-				return nil
-			}
-		}
-	}()
-	if err != nil {
-		return nil, fmt.Errorf("unable to dial %s: %s", recepient, err)
+	ll.Debugf("Completed handshake with %s", recepient)
+	if current != recepient {
+		s.moveContacts(recepient, recepientKey, current, recepientKey)
+		recepient = current
 	}
+	senderChat := fmt.Sprintf("chat.%s.%s", s.senderAddress, recepient)
 
-	return &ChatConnection{
+	c := &ChatConnection{
 		logger: s.logger.Logger.WithFields(logrus.Fields{
 			"component": "ChatConnection",
+			"chat":      recepient,
+			"peer":      recepient,
 		}),
 		SenderAddress:    s.senderAddress,
+		senderKey:        s.senderProfile.GetPrivateKey(),
 		RecepientAddress: recepient,
-		incomingChan:     incomingChan,
-		onlineSub:        onlineSub,
-		chatSub:          chatSub,
+		recepientKey:     recepientKey,
+		incomingChan:     make(chan IncomingEvent),
+		eventChan:        make(chan *api.ChatEvent, eventsBacklog),
+		done:             make(chan struct{}),
+		outgoing:         make(map[string]*outgoingFile),
+		offers:           s.offers,
+		session:          s,
+		created:          time.Now(),
 		nc:               s.nc,
-	}, nil
+		history:          s.history,
+	}
+
+	senderReceipt := fmt.Sprintf(receiptSubjectFmt, s.senderAddress, recepient)
+	if c.receiptSub, err = s.nc.Subscribe(senderReceipt, c.handleReceipt); err != nil {
+		return nil, fmt.Errorf("error subscribing to receipts: %s", err)
+	}
+	senderTyping := fmt.Sprintf(typingSubjectFmt, s.senderAddress, recepient)
+	if c.typingSub, err = s.nc.Subscribe(senderTyping, c.handleTyping); err != nil {
+		c.receiptSub.Unsubscribe()
+		return nil, fmt.Errorf("error subscribing to typing: %s", err)
+	}
+	senderFile := fmt.Sprintf(fileSubjectFmt, s.senderAddress, recepient)
+	if c.fileSub, err = s.nc.Subscribe(senderFile, c.handleFile); err != nil {
+		c.receiptSub.Unsubscribe()
+		c.typingSub.Unsubscribe()
+		return nil, fmt.Errorf("error subscribing to files: %s", err)
+	}
+
+	if s.js != nil {
+		// The inbox is consumed by the session, which passes messages to the
+		// chat once it is open
+		if err = s.drainInbox(recepient); err != nil {
+			c.receiptSub.Unsubscribe()
+			c.typingSub.Unsubscribe()
+			c.fileSub.Unsubscribe()
+			return nil, fmt.Errorf("error subscribing to inbox: %s", err)
+		}
+		ll.Debugf("Consuming inbox messages from %s\n", recepient)
+	} else {
+		replayed := func(cmsg *api.ChatMessage) bool {
+			return s.replayed(recepient, cmsg)
+		}
+		handler := NewIncomingMsgHandler(c.logger.WithFields(logrus.Fields{"method": "handleMessage"}), s.senderProfile, recepient, c.incomingChan, c.done, replayed, c.delivered)
+		if c.chatSub, err = s.nc.Subscribe(senderChat, handler); err != nil {
+			c.receiptSub.Unsubscribe()
+			c.typingSub.Unsubscribe()
+			c.fileSub.Unsubscribe()
+			return nil, fmt.Errorf("error subscribing to sender chat: %s", err)
+		}
+		ll.Debugf("Subscribed at sender chat %s\n", senderChat)
+	}
+
+	if (s.js != nil) && hasInbox(s.js, recepient) {
+		c.js = s.js
+		ll.Debugf("Publishing to inbox of %s", recepient)
+	}
+	s.mu.Lock()
+	s.chats[c] = struct{}{}
+	s.mu.Unlock()
+	return c, nil
 }
 
 type ChatConnection struct {
 	logger           *logrus.Entry
 	SenderAddress    string
+	senderKey        crypto.Signer
 	RecepientAddress string
-	incomingChan     chan *api.ChatMessage
-	onlineSub        *nats.Subscription
+	recepientKey     crypto.PublicKey
+	incomingChan     chan IncomingEvent
+	eventChan        chan *api.ChatEvent
+	done             chan struct{}
 	chatSub          *nats.Subscription
+	receiptSub       *nats.Subscription
+	typingSub        *nats.Subscription
+	fileSub          *nats.Subscription
+	mu               sync.Mutex
+	opened           int
+	typingTimer      *time.Timer
+	outgoing         map[string]*outgoingFile
+	offers           *fileOffers
+	cancelRedial     context.CancelFunc
+	session          *Session
 	nc               *nats.Conn
+	js               nats.JetStreamContext
+	history          *history.Store
+	created          time.Time
+	sent             atomic.Uint64
+	received         atomic.Uint64
+}
+
+// delivered counts a message taken by the chat and tells the recepient about
+// it
+func (c *ChatConnection) delivered(cmsg *api.ChatMessage) {
+	c.session.seen.add(c.RecepientAddress, cmsg.Id)
+	c.received.Add(1)
+	metrics.MessagesReceived.WithLabelValues(c.RecepientAddress).Inc()
+	if err := c.sendReceipt(api.MessageStatus_DELIVERED, cmsg.Id); err != nil {
+		c.logger.Errorf("Unable to send delivery receipt: %s", err)
+	}
+}
+
+func (c *ChatConnection) saveHistory(outgoing bool, cmsg *api.ChatMessage) {
+	if c.history == nil {
+		return
+	}
+	if _, err := c.history.Append(c.SenderAddress, c.RecepientAddress, outgoing, cmsg); err != nil {
+		c.logger.Errorf("Unable to save message to history: %s", err)
+	}
+}
+
+// publish sends data to the inbox of the recepient if it has one, opts are
+// applied to the inbox. Messages are buffered by the connection while it is
+// reestablished, publishing to the inbox waits for it instead.
+func (c *ChatConnection) publish(ctx context.Context, subject string, data []byte, opts ...nats.PubOpt) (err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "nats.publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "nats"),
+			attribute.String("messaging.destination.name", subject),
+			attribute.Bool("natschat.inbox", c.js != nil),
+		))
+	defer func() {
+		if err != nil {
+			metrics.PublishErrors.WithLabelValues(c.RecepientAddress).Inc()
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+	msg := &nats.Msg{Subject: subject, Data: data}
+	tracing.Inject(ctx, msg)
+	if c.js == nil {
+		return c.nc.PublishMsg(msg)
+	}
+	for {
+		if _, err = c.js.PublishMsg(msg, opts...); (err == nil) || !c.nc.IsReconnecting() {
+			return err
+		}
+		c.logger.Debugf("Waiting for the connection to publish to %s", subject)
+		if !c.session.waitConnected(c.done) {
+			return err
+		}
+	}
+}
+
+func (c *ChatConnection) sendMessage(ctx context.Context, subject string, cmsg *api.ChatMessage) (err error) {
+	var data []byte
+	if cmsg.Id == "" {
+		if cmsg.Id, err = NewID(); err != nil {
+			return err
+		}
+	}
+	if data, err = proto.Marshal(cmsg); err != nil {
+		return fmt.Errorf("unable to marshal message: %s\n", err)
+	}
+	if data, err = sealFor(c.senderKey, envelope.KindMessage, c.RecepientAddress, c.recepientKey, data); err != nil {
+		return err
+	}
+	// The id lets the inbox drop the message if it is published again after
+	// an outage
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("natschat.message_id", cmsg.Id))
+	if err = c.publish(ctx, subject, data, nats.MsgId(cmsg.Id)); err != nil {
+		return fmt.Errorf("unable to publish message: %s\n", err)
+	}
+	c.sent.Add(1)
+	metrics.MessagesSent.WithLabelValues(c.RecepientAddress).Inc()
+	c.saveHistory(true, cmsg)
+	return nil
 }
 
 func (c *ChatConnection) Send(srv api.Daemon_SendServer) error {
 	ll := c.logger.WithFields(logrus.Fields{
 		"method": "Send",
 	})
-	recepientChat := fmt.Sprintf("chat.%s", c.RecepientAddress)
+	recepientChat := fmt.Sprintf("chat.%s.%s", c.RecepientAddress, c.SenderAddress)
+	c.mu.Lock()
+	c.opened++
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.opened--
+		c.mu.Unlock()
+	}()
 
-	eof := make(chan struct{})
+	eof := make(chan struct{}, 1)
 	g := errgroup.Group{}
 	g.Go(func() (err error) {
 		for {
@@ -191,25 +610,40 @@ func (c *ChatConnection) Send(srv api.Daemon_SendServer) error {
 			case <-eof:
 				ll.Debugln("Got EOF from cli, exiting server send loop")
 				return nil
-			case cmsg := <-c.incomingChan:
-				ll.Debugf("Got message from nats: %s", cmsg)
-				srv.Context()
-				if err = srv.Send(cmsg); err != nil {
+			case <-c.done:
+				ll.Debugln("Chat was closed, exiting server send loop")
+				return nil
+			case incoming := <-c.incomingChan:
+				event := incoming.Event
+				_, span := tracing.Tracer().Start(incoming.Context, "deliver",
+					trace.WithAttributes(attribute.String("natschat.peer", c.RecepientAddress)))
+				ll := ll.WithFields(tracing.Fields(incoming.Context))
+				ll.Debugf("Got event from nats: %s", event)
+				if err = srv.Send(event); err != nil {
+					span.RecordError(err)
+					span.SetStatus(codes.Error, err.Error())
+					span.End()
 					return fmt.Errorf("Unable to send message: %s\n", err)
 				}
-				ll.Debugf("Sent message to cli: %s", cmsg)
+				span.End()
+				ll.Debugf("Sent event to cli: %s", event)
+				if cmsg := event.GetMessage(); cmsg != nil {
+					c.stopTyping(false)
+					c.saveHistory(false, cmsg)
+				}
+			case event := <-c.eventChan:
+				if err = srv.Send(event); err != nil {
+					return fmt.Errorf("Unable to send event: %s\n", err)
+				}
 			}
 		}
 	})
 
 	g.Go(func() (err error) {
-		var (
-			cmsg *api.ChatMessage
-			data []byte
-		)
+		var input *api.ChatInput
 		defer func() { eof <- struct{}{} }()
 		for {
-			cmsg, err = srv.Recv()
+			input, err = srv.Recv()
 			if err != nil {
 				if err == io.EOF {
 					ll.Debugln("Got eof from client")
@@ -217,16 +651,26 @@ func (c *ChatConnection) Send(srv api.Daemon_SendServer) error {
 				}
 				return fmt.Errorf("Unable to get message: %s", err)
 			}
-			ll.Debugf("Got message from cli: %s", cmsg)
+			ll.Debugf("Got input from cli: %s", input)
 
-			if data, err = proto.Marshal(cmsg); err != nil {
-				return fmt.Errorf("unable to marshal message: %s\n", err)
+			switch i := input.Input.(type) {
+			case *api.ChatInput_Message:
+				ctx, span := tracing.Tracer().Start(srv.Context(), "Send",
+					trace.WithSpanKind(trace.SpanKindServer),
+					trace.WithAttributes(attribute.String("natschat.peer", c.RecepientAddress)))
+				if err = c.sendMessage(ctx, recepientChat, i.Message); err != nil {
+					span.SetStatus(codes.Error, err.Error())
+					span.End()
+					return err
+				}
+				span.End()
+				ll.WithFields(tracing.Fields(ctx)).Debugf("Published message: %s", i.Message)
+			case *api.ChatInput_Typing:
+				if err = c.sendTyping(); err != nil {
+					ll.Warnf("Unable to publish typing: %s", err)
+				}
 			}
-			c.nc.Publish(recepientChat, data)
-			ll.Debugf("Published message: %s", cmsg)
 		}
-		ll.Debugln("Exiting server recv loop")
-		return nil
 	})
 
 	if err := g.Wait(); err != nil {
@@ -240,16 +684,23 @@ func (c *ChatConnection) Close() (err error) {
 		"method": "Close",
 	})
 	ll.Printf("Closing ChatConnection %s\n", c.RecepientAddress)
-	recepientOnline := fmt.Sprintf("online.%s", c.RecepientAddress)
-	offlineMsg := &api.NatsOnline{IsOnline: false, AuthorAddress: c.SenderAddress}
-	data, err := proto.Marshal(offlineMsg)
-	if err != nil {
-		return err
+	close(c.done)
+	c.session.mu.Lock()
+	delete(c.session.chats, c)
+	c.session.mu.Unlock()
+	c.mu.Lock()
+	if c.cancelRedial != nil {
+		c.cancelRedial()
 	}
+	c.mu.Unlock()
+	c.stopTyping(false)
+	c.offers.drop(c)
 	var merr *multierror.Error
-	merr = multierror.Append(c.nc.Publish(recepientOnline, data))
-	merr = multierror.Append(err, c.onlineSub.Unsubscribe())
-	merr = multierror.Append(merr, c.chatSub.Unsubscribe())
-	close(c.incomingChan)
+	merr = multierror.Append(merr, c.receiptSub.Unsubscribe())
+	merr = multierror.Append(merr, c.typingSub.Unsubscribe())
+	merr = multierror.Append(merr, c.fileSub.Unsubscribe())
+	if c.chatSub != nil {
+		merr = multierror.Append(merr, c.chatSub.Unsubscribe())
+	}
 	return merr.ErrorOrNil()
 }
@@ -0,0 +1,78 @@
+package natsdaemon
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	api "github.com/aaletov/nats-chat/api/generated"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Version of the daemon, set at build with
+// -ldflags "-X github.com/aaletov/nats-chat/pkg/natsdaemon.Version=<version>"
+var Version = "dev"
+
+func (c *ChatConnection) Status() *api.ChatStatus {
+	c.mu.Lock()
+	opened := c.opened
+	c.mu.Unlock()
+	return &api.ChatStatus{
+		RecepientAddress: c.RecepientAddress,
+		Created:          timestamppb.New(c.created),
+		Sent:             c.sent.Load(),
+		Received:         c.received.Load(),
+		Inbox:            c.js != nil,
+		Opened:           int32(opened),
+	}
+}
+
+func (s *Session) Status() *api.SessionStatus {
+	stats := s.nc.Stats()
+	status := &api.SessionStatus{
+		SenderAddress: s.senderAddress,
+		OnlineSince:   timestamppb.New(s.started),
+		NatsUrl:       s.nc.ConnectedUrl(),
+		NatsServer:    s.nc.ConnectedServerName(),
+		NatsStatus:    s.nc.Status().String(),
+		Jetstream:     s.js != nil,
+		Statistics: &api.NatsStatistics{
+			InMsgs:     stats.InMsgs,
+			OutMsgs:    stats.OutMsgs,
+			InBytes:    stats.InBytes,
+			OutBytes:   stats.OutBytes,
+			Reconnects: stats.Reconnects,
+		},
+	}
+
+	s.mu.Lock()
+	chats := make([]*ChatConnection, 0, len(s.chats))
+	for chat := range s.chats {
+		chats = append(chats, chat)
+	}
+	s.mu.Unlock()
+	for _, chat := range chats {
+		status.Chats = append(status.Chats, chat.Status())
+	}
+	sort.Slice(status.Chats, func(i, j int) bool {
+		return status.Chats[i].RecepientAddress < status.Chats[j].RecepientAddress
+	})
+	for _, room := range s.Rooms() {
+		status.Rooms = append(status.Rooms, room.Info())
+	}
+	return status
+}
+
+func (d *daemon) Status(ctx context.Context, _ *emptypb.Empty) (*api.StatusResponse, error) {
+	response := &api.StatusResponse{
+		Version: Version,
+		Started: timestamppb.New(d.started),
+		Uptime:  durationpb.New(time.Since(d.started)),
+	}
+	if session, err := d.getSession(); err == nil {
+		response.Session = session.Status()
+	}
+	return response, nil
+}
@@ -0,0 +1,97 @@
+package natsdaemon
+
+import (
+	"fmt"
+	"time"
+
+	api "github.com/aaletov/nats-chat/api/generated"
+	"github.com/aaletov/nats-chat/pkg/envelope"
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// TypingInterval is how often the cli repeats typing while the user types
+	TypingInterval   = 2 * time.Second
+	typingTimeout    = 3 * TypingInterval
+	typingSubjectFmt = "typing.%s.%s"
+)
+
+func (c *ChatConnection) sendTyping() error {
+	var (
+		err     error
+		payload []byte
+		data    []byte
+	)
+	if payload, err = proto.Marshal(&api.NatsTyping{Time: timestamppb.Now()}); err != nil {
+		return fmt.Errorf("unable to marshal typing: %s", err)
+	}
+	if data, err = sealFor(c.senderKey, envelope.KindTyping, c.RecepientAddress, c.recepientKey, payload); err != nil {
+		return err
+	}
+	return c.nc.Publish(fmt.Sprintf(typingSubjectFmt, c.RecepientAddress, c.SenderAddress), data)
+}
+
+func newTypingEvent(author string, typing bool) *api.ChatEvent {
+	return &api.ChatEvent{
+		Event: &api.ChatEvent_Typing{
+			Typing: &api.TypingEvent{
+				Time:          timestamppb.Now(),
+				AuthorAddress: author,
+				Typing:        typing,
+			},
+		},
+	}
+}
+
+func (c *ChatConnection) handleTyping(msg *nats.Msg) {
+	ll := c.logger.WithFields(logrus.Fields{
+		"method": "handleTyping",
+	})
+	var (
+		err     error
+		payload []byte
+	)
+	if payload, err = c.open(envelope.KindTyping, msg.Data); err != nil {
+		ll.Warnf("Dropping typing: %s", err)
+		return
+	}
+	tmsg := &api.NatsTyping{}
+	if err = proto.Unmarshal(payload, tmsg); err != nil {
+		ll.Errorf("Error unmarshalling typing: %s", err)
+		return
+	}
+	if time.Since(tmsg.Time.AsTime()) > typingTimeout {
+		ll.Debugf("Dropping stale typing of %s", c.RecepientAddress)
+		return
+	}
+
+	c.mu.Lock()
+	started := c.typingTimer == nil
+	if started {
+		c.typingTimer = time.AfterFunc(typingTimeout, func() { c.stopTyping(true) })
+	} else {
+		c.typingTimer.Reset(typingTimeout)
+	}
+	c.mu.Unlock()
+	if started {
+		c.deliverEvent(newTypingEvent(c.RecepientAddress, true))
+	}
+}
+
+// stopTyping expires typing of the recepient, notify is unset when typing is
+// superseded by a message
+func (c *ChatConnection) stopTyping(notify bool) {
+	c.mu.Lock()
+	stopped := c.typingTimer != nil
+	if stopped {
+		c.typingTimer.Stop()
+		c.typingTimer = nil
+	}
+	c.mu.Unlock()
+	if stopped && notify {
+		c.deliverEvent(newTypingEvent(c.RecepientAddress, false))
+	}
+}
@@ -0,0 +1,243 @@
+package profile
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Private keys encrypted with a passphrase are stored in a PEM block of
+// encryptedKeyType. Its bytes are the PEM block of the plain key sealed with
+// AES-256-GCM under a key derived from the passphrase with scrypt, the
+// parameters of which are kept in the headers. The type and the headers are
+// the additional data of GCM.
+const (
+	encryptedKeyType = "NATS-CHAT ENCRYPTED PRIVATE KEY"
+	kdfScrypt        = "scrypt"
+	scryptN          = 1 << 15
+	scryptR          = 8
+	scryptP          = 1
+	derivedKeySize   = 32
+	saltSize         = 16
+)
+
+// Limits of the scrypt parameters read from a block, they bound the memory of
+// deriving the key to 256 MiB
+const (
+	maxScryptN = 1 << 18
+	maxScryptR = 8
+	maxScryptP = 4
+)
+
+var (
+	ErrWrongPassphrase    = errors.New("wrong passphrase")
+	ErrPassphraseRequired = errors.New("private key is encrypted, passphrase required")
+)
+
+// PassphraseFunc is called to get the passphrase of an encrypted private key
+type PassphraseFunc func() ([]byte, error)
+
+func newKeyGCM(passphrase []byte, salt []byte, n, r, p int) (cipher.AEAD, error) {
+	var (
+		err   error
+		key   []byte
+		block cipher.Block
+	)
+	if key, err = scrypt.Key(passphrase, salt, n, r, p, derivedKeySize); err != nil {
+		return nil, fmt.Errorf("error deriving key: %s", err)
+	}
+	if block, err = aes.NewCipher(key); err != nil {
+		return nil, fmt.Errorf("error creating cipher: %s", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// additionalData authenticates the type and the headers of the block, which is
+// sealed with every header except the nonce
+func additionalData(block *pem.Block) []byte {
+	keys := make([]string, 0, len(block.Headers))
+	for key := range block.Headers {
+		if key != "Nonce" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	buf.WriteString(block.Type)
+	for _, key := range keys {
+		fmt.Fprintf(&buf, "\n%s: %s", key, block.Headers[key])
+	}
+	return buf.Bytes()
+}
+
+// SealBlock encrypts data with the passphrase into a PEM block of blockType,
+// headers are added to the block and authenticated along with it
+func SealBlock(blockType string, headers map[string]string, data []byte, passphrase []byte) (*pem.Block, error) {
+	var (
+		err error
+		gcm cipher.AEAD
+	)
+	salt := make([]byte, saltSize)
+	if _, err = io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, fmt.Errorf("error generating salt: %s", err)
+	}
+	if gcm, err = newKeyGCM(passphrase, salt, scryptN, scryptR, scryptP); err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("error generating nonce: %s", err)
+	}
+	block := &pem.Block{
+		Type: blockType,
+		Headers: map[string]string{
+			"Kdf":      kdfScrypt,
+			"Scrypt-N": strconv.Itoa(scryptN),
+			"Scrypt-R": strconv.Itoa(scryptR),
+			"Scrypt-P": strconv.Itoa(scryptP),
+			"Salt":     hex.EncodeToString(salt),
+		},
+	}
+	for key, value := range headers {
+		block.Headers[key] = value
+	}
+	block.Bytes = gcm.Seal(nil, nonce, data, additionalData(block))
+	block.Headers["Nonce"] = hex.EncodeToString(nonce)
+	return block, nil
+}
+
+// EncryptPrivateKeyBlock encrypts the PEM block of a private key, the block is
+// returned as is if passphrase is empty
+func EncryptPrivateKeyBlock(block *pem.Block, passphrase []byte) (*pem.Block, error) {
+	if len(passphrase) == 0 {
+		return block, nil
+	}
+	return SealBlock(encryptedKeyType, nil, pem.EncodeToMemory(block), passphrase)
+}
+
+// IsEncrypted reports whether the PEM block holds an encrypted private key
+func IsEncrypted(block *pem.Block) bool {
+	return block.Type == encryptedKeyType
+}
+
+// OpenBlock decrypts the data of the PEM block sealed with SealBlock
+func OpenBlock(block *pem.Block, passphrase []byte) ([]byte, error) {
+	if kdf := block.Headers["Kdf"]; kdf != kdfScrypt {
+		return nil, fmt.Errorf("unsupported kdf: %q", kdf)
+	}
+	var (
+		err       error
+		params    [3]int
+		salt      []byte
+		nonce     []byte
+		gcm       cipher.AEAD
+		plaintext []byte
+	)
+	for i, header := range []string{"Scrypt-N", "Scrypt-R", "Scrypt-P"} {
+		if params[i], err = strconv.Atoi(block.Headers[header]); err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", header, err)
+		}
+		if limit := [3]int{maxScryptN, maxScryptR, maxScryptP}[i]; (params[i] < 1) || (params[i] > limit) {
+			return nil, fmt.Errorf("invalid %s: %d is out of range 1-%d", header, params[i], limit)
+		}
+	}
+	if salt, err = hex.DecodeString(block.Headers["Salt"]); err != nil {
+		return nil, fmt.Errorf("invalid salt: %s", err)
+	}
+	if nonce, err = hex.DecodeString(block.Headers["Nonce"]); err != nil {
+		return nil, fmt.Errorf("invalid nonce: %s", err)
+	}
+	if gcm, err = newKeyGCM(passphrase, salt, params[0], params[1], params[2]); err != nil {
+		return nil, err
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return nil, fmt.Errorf("invalid nonce size: %d", len(nonce))
+	}
+	if plaintext, err = gcm.Open(nil, nonce, block.Bytes, additionalData(block)); err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return plaintext, nil
+}
+
+// DecryptPrivateKeyBlock returns the PEM block of the plain private key
+func DecryptPrivateKeyBlock(block *pem.Block, passphrase []byte) (*pem.Block, error) {
+	if !IsEncrypted(block) {
+		return block, nil
+	}
+	plaintext, err := OpenBlock(block, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ = pem.Decode(plaintext); block == nil {
+		return nil, fmt.Errorf("no pem data in encrypted private key")
+	}
+	return block, nil
+}
+
+// writeTemp writes data to a temporary file next to path and syncs it, the
+// path of the file is returned to be renamed over path
+func writeTemp(path string, data []byte) (string, error) {
+	var (
+		err  error
+		file *os.File
+	)
+	tmpPath := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if file, err = os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600); err != nil {
+		return "", fmt.Errorf("error creating %s: %s", tmpPath, err)
+	}
+	if _, err = file.Write(data); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return "", fmt.Errorf("error writing %s: %s", tmpPath, err)
+	}
+	return tmpPath, nil
+}
+
+// WriteTempPrivateKey writes the private key encrypted with passphrase, or in
+// plain if it is empty, to a synced temporary file next to privateKeyPath and
+// returns its path
+func WriteTempPrivateKey(privateKeyPath string, block *pem.Block, passphrase []byte) (string, error) {
+	block, err := EncryptPrivateKeyBlock(block, passphrase)
+	if err != nil {
+		return "", err
+	}
+	return writeTemp(privateKeyPath, pem.EncodeToMemory(block))
+}
+
+// WriteTempPublicKey writes the public key to a synced temporary file next to
+// publicKeyPath and returns its path
+func WriteTempPublicKey(publicKeyPath string, publicKey crypto.PublicKey) (string, error) {
+	return writeTemp(publicKeyPath, pem.EncodeToMemory(PublicKeyBlock(publicKey)))
+}
+
+// WritePrivateKey writes the private key encrypted with passphrase, or in
+// plain if it is empty. An existing file is replaced atomically.
+func WritePrivateKey(privateKeyPath string, block *pem.Block, passphrase []byte) error {
+	tmpPath, err := WriteTempPrivateKey(privateKeyPath, block, passphrase)
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, privateKeyPath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("error writing private key: %s", err)
+	}
+	return nil
+}
@@ -1,11 +1,15 @@
 package profile
 
 import (
+	"crypto"
+	"crypto/ed25519"
 	"crypto/md5"
+	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -14,34 +18,235 @@ import (
 	"github.com/btcsuite/btcutil/base58"
 )
 
+// KeyType is the type of the identity key of a profile
+type KeyType string
+
+const (
+	KeyTypeRSA     KeyType = "rsa"
+	KeyTypeEd25519 KeyType = "ed25519"
+)
+
+// Addresses are encoded with base58check: a version byte naming the key type,
+// the MD5 of the SHA-256 of the public key and a checksum. Legacy addresses are
+// the bare base58 hash of RSA keys, they are accepted until every profile
+// migrates.
+const (
+	addressVersionRSA     byte = 0x10
+	addressVersionEd25519 byte = 0x11
+	checkedAddressSize         = 1 + md5.Size + 4
+)
+
+var ErrInvalidAddress = errors.New("invalid address")
+
+const rsaKeySize = 2048
+
 type Profile struct {
-	privateKey *rsa.PrivateKey
-	publicKey  *rsa.PublicKey
+	privateKey crypto.Signer
+	publicKey  crypto.PublicKey
+	keyType    KeyType
 	address    string
 }
 
-func getAddress(publicKey *rsa.PublicKey) (string, error) {
-	publicKeyBytes := x509.MarshalPKCS1PublicKey(publicKey)
-	publicKeyBlock := &pem.Block{
-		Type:  "PUBLIC KEY",
-		Bytes: publicKeyBytes,
+// TypeOf returns the type of the public key
+func TypeOf(publicKey crypto.PublicKey) (KeyType, error) {
+	switch publicKey.(type) {
+	case *rsa.PublicKey:
+		return KeyTypeRSA, nil
+	case ed25519.PublicKey:
+		return KeyTypeEd25519, nil
 	}
+	return "", fmt.Errorf("unsupported key type: %T", publicKey)
+}
 
-	publicKeyPem := pem.EncodeToMemory(publicKeyBlock)
-	hash256 := sha256.Sum256(publicKeyPem)
+func keyHash(publicKey crypto.PublicKey) ([]byte, error) {
+	var encoded []byte
+	switch publicKey.(type) {
+	case *rsa.PublicKey:
+		encoded = pem.EncodeToMemory(PublicKeyBlock(publicKey))
+	case ed25519.PublicKey:
+		encoded = MarshalPublicKey(publicKey)
+	default:
+		return nil, fmt.Errorf("unsupported key type: %T", publicKey)
+	}
+	hash256 := sha256.Sum256(encoded)
 	hash128 := md5.Sum(hash256[:])
-	address := base58.Encode(hash128[:])
+	return hash128[:], nil
+}
+
+func getAddress(publicKey crypto.PublicKey) (string, error) {
+	hash, err := keyHash(publicKey)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := publicKey.(*rsa.PublicKey); ok {
+		return base58.CheckEncode(hash, addressVersionRSA), nil
+	}
+	return base58.CheckEncode(hash, addressVersionEd25519), nil
+}
+
+// LegacyAddressOf returns the address of the RSA public key in the format used
+// before addresses were checksummed, other keys never had one
+func LegacyAddressOf(publicKey crypto.PublicKey) (string, error) {
+	if _, ok := publicKey.(*rsa.PublicKey); !ok {
+		return "", fmt.Errorf("no legacy address for key type %T", publicKey)
+	}
+	hash, err := keyHash(publicKey)
+	if err != nil {
+		return "", err
+	}
+	return base58.Encode(hash), nil
+}
+
+// ValidateAddress explains why address could not be produced by AddressOf or
+// LegacyAddressOf
+func ValidateAddress(address string) error {
+	if address == "" {
+		return fmt.Errorf("%w: address is empty", ErrInvalidAddress)
+	}
+	decoded := base58.Decode(address)
+	switch len(decoded) {
+	case 0:
+		return fmt.Errorf("%w %q: not a base58 string", ErrInvalidAddress, address)
+	case md5.Size:
+		return nil
+	case checkedAddressSize:
+		_, version, err := base58.CheckDecode(address)
+		if err != nil {
+			return fmt.Errorf("%w %s: checksum mismatch, probably a typo", ErrInvalidAddress, address)
+		}
+		if (version != addressVersionRSA) && (version != addressVersionEd25519) {
+			return fmt.Errorf("%w %s: unknown version %d", ErrInvalidAddress, address, version)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w %s: unexpected length", ErrInvalidAddress, address)
+}
+
+// IsAddress reports whether address could be produced by AddressOf or
+// LegacyAddressOf
+func IsAddress(address string) bool {
+	return ValidateAddress(address) == nil
+}
+
+// IsLegacyAddress reports whether address is valid and has no checksum
+func IsLegacyAddress(address string) bool {
+	return IsAddress(address) && (len(base58.Decode(address)) != checkedAddressSize)
+}
+
+func AddressOf(publicKey crypto.PublicKey) (string, error) {
+	return getAddress(publicKey)
+}
+
+// BelongsTo reports whether address is the address of the public key in
+// either format
+func BelongsTo(publicKey crypto.PublicKey, address string) bool {
+	if actual, err := getAddress(publicKey); (err == nil) && (actual == address) {
+		return true
+	}
+	legacy, err := LegacyAddressOf(publicKey)
+	return (err == nil) && (legacy == address)
+}
+
+// MarshalPublicKey encodes RSA keys in PKCS #1 and other keys in PKIX, so the
+// encodings do not overlap
+func MarshalPublicKey(publicKey crypto.PublicKey) []byte {
+	if rsaKey, ok := publicKey.(*rsa.PublicKey); ok {
+		return x509.MarshalPKCS1PublicKey(rsaKey)
+	}
+	publicKeyBytes, _ := x509.MarshalPKIXPublicKey(publicKey)
+	return publicKeyBytes
+}
+
+func ParsePublicKey(publicKeyBytes []byte) (crypto.PublicKey, error) {
+	if rsaKey, err := x509.ParsePKCS1PublicKey(publicKeyBytes); err == nil {
+		return rsaKey, nil
+	}
+	publicKey, err := x509.ParsePKIXPublicKey(publicKeyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing public key: %s", err)
+	}
+	if _, ok := publicKey.(ed25519.PublicKey); !ok {
+		return nil, fmt.Errorf("unsupported key type: %T", publicKey)
+	}
+	return publicKey, nil
+}
+
+// VerifiedPublicKey parses publicKeyBytes and checks that address is the
+// address of the key in the current format
+func VerifiedPublicKey(address string, publicKeyBytes []byte) (crypto.PublicKey, error) {
+	var (
+		err       error
+		publicKey crypto.PublicKey
+		actual    string
+	)
+	if publicKey, err = ParsePublicKey(publicKeyBytes); err != nil {
+		return nil, err
+	}
+	if actual, err = AddressOf(publicKey); err != nil {
+		return nil, err
+	}
+	if actual != address {
+		return nil, fmt.Errorf("public key of %s does not match its address", address)
+	}
+	return publicKey, nil
+}
 
-	return address, nil
+func PublicKeyBlock(publicKey crypto.PublicKey) *pem.Block {
+	return &pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: MarshalPublicKey(publicKey),
+	}
 }
 
-func NewProfile(privateKey *rsa.PrivateKey) (Profile, error) {
+// GenerateKey generates a new identity key of keyType
+func GenerateKey(keyType KeyType) (crypto.Signer, error) {
+	var (
+		err        error
+		privateKey crypto.Signer
+	)
+	switch keyType {
+	case KeyTypeRSA:
+		privateKey, err = rsa.GenerateKey(rand.Reader, rsaKeySize)
+	case KeyTypeEd25519:
+		_, privateKey, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported key type: %s", keyType)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error generating %s key: %s", keyType, err)
+	}
+	return privateKey, nil
+}
+
+// PrivateKeyBlock encodes RSA keys in PKCS #1 and other keys in PKCS #8
+func PrivateKeyBlock(privateKey crypto.Signer) (*pem.Block, error) {
+	if rsaKey, ok := privateKey.(*rsa.PrivateKey); ok {
+		return &pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(rsaKey),
+		}, nil
+	}
+	privateKeyBytes, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling private key: %s", err)
+	}
+	return &pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: privateKeyBytes,
+	}, nil
+}
+
+func NewProfile(privateKey crypto.Signer) (Profile, error) {
 	var (
 		err       error
-		publicKey = &privateKey.PublicKey
+		publicKey = privateKey.Public()
+		keyType   KeyType
 		address   string
 	)
 
+	if keyType, err = TypeOf(publicKey); err != nil {
+		return Profile{}, err
+	}
 	if address, err = getAddress(publicKey); err != nil {
 		return Profile{}, fmt.Errorf("error getting address of sender: %s", err)
 	}
@@ -49,23 +254,30 @@ func NewProfile(privateKey *rsa.PrivateKey) (Profile, error) {
 	return Profile{
 		privateKey: privateKey,
 		publicKey:  publicKey,
+		keyType:    keyType,
 		address:    address,
 	}, nil
 }
 
-func (s Profile) GetPrivateKey() *rsa.PrivateKey {
+func (s Profile) GetPrivateKey() crypto.Signer {
 	return s.privateKey
 }
 
-func (s Profile) GetPublicKey() *rsa.PublicKey {
+func (s Profile) GetPublicKey() crypto.PublicKey {
 	return s.publicKey
 }
 
+func (s Profile) GetKeyType() KeyType {
+	return s.keyType
+}
+
 func (s Profile) GetAddress() string {
 	return s.address
 }
 
-func ReadPrivateKey(privateKeyPath string) (*rsa.PrivateKey, error) {
+// ReadPrivateKeyBlock reads the PEM block of the private key, passphrase is
+// called only if the key is encrypted
+func ReadPrivateKeyBlock(privateKeyPath string, passphrase PassphraseFunc) (*pem.Block, error) {
 	var err error
 	if _, err := os.Stat(privateKeyPath); (err != nil) && (os.IsNotExist(err)) {
 		return nil, fmt.Errorf("file does not exist: %s", err)
@@ -80,22 +292,78 @@ func ReadPrivateKey(privateKeyPath string) (*rsa.PrivateKey, error) {
 		return nil, fmt.Errorf("error reading private key: %s", err)
 	}
 	privateKeyBlock, _ := pem.Decode(privatePemBytes)
-	var privateKey *rsa.PrivateKey
-	if privateKey, err = x509.ParsePKCS1PrivateKey(privateKeyBlock.Bytes); err != nil {
+	if privateKeyBlock == nil {
+		return nil, fmt.Errorf("no pem data in %s", privateKeyPath)
+	}
+	if !IsEncrypted(privateKeyBlock) {
+		return privateKeyBlock, nil
+	}
+	var secret []byte
+	if passphrase != nil {
+		if secret, err = passphrase(); err != nil {
+			return nil, err
+		}
+	}
+	if len(secret) == 0 {
+		return nil, ErrPassphraseRequired
+	}
+	return DecryptPrivateKeyBlock(privateKeyBlock, secret)
+}
+
+func ParsePrivateKey(privateKeyBlock *pem.Block) (crypto.Signer, error) {
+	var err error
+	if privateKeyBlock.Type == "RSA PRIVATE KEY" {
+		var privateKey *rsa.PrivateKey
+		if privateKey, err = x509.ParsePKCS1PrivateKey(privateKeyBlock.Bytes); err != nil {
+			return nil, fmt.Errorf("error parsing private key: %s", err)
+		}
+		return privateKey, nil
+	}
+	var key interface{}
+	if key, err = x509.ParsePKCS8PrivateKey(privateKeyBlock.Bytes); err != nil {
 		return nil, fmt.Errorf("error parsing private key: %s", err)
 	}
-	return privateKey, nil
+	switch privateKey := key.(type) {
+	case *rsa.PrivateKey:
+		return privateKey, nil
+	case ed25519.PrivateKey:
+		return privateKey, nil
+	}
+	return nil, fmt.Errorf("unsupported key type: %T", key)
+}
+
+func ReadPrivateKey(privateKeyPath string, passphrase PassphraseFunc) (crypto.Signer, error) {
+	privateKeyBlock, err := ReadPrivateKeyBlock(privateKeyPath, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePrivateKey(privateKeyBlock)
+}
+
+func ReadPublicKey(publicKeyPath string) (crypto.PublicKey, error) {
+	var (
+		err            error
+		publicPemBytes []byte
+	)
+	if publicPemBytes, err = os.ReadFile(publicKeyPath); err != nil {
+		return nil, fmt.Errorf("error reading public key: %s", err)
+	}
+	publicKeyBlock, _ := pem.Decode(publicPemBytes)
+	if publicKeyBlock == nil {
+		return nil, fmt.Errorf("no pem data in %s", publicKeyPath)
+	}
+	return ParsePublicKey(publicKeyBlock.Bytes)
 }
 
-func ReadProfile(profilePath string) (Profile, error) {
+func ReadProfile(profilePath string, passphrase PassphraseFunc) (Profile, error) {
 	var err error
 	if _, err := os.Stat(profilePath); (err != nil) && (os.IsNotExist(err)) {
 		return Profile{}, fmt.Errorf("directory does not exist: %s", err)
 	}
 	privateKeyPath := filepath.Join(profilePath, "private.pem")
-	var privateKey *rsa.PrivateKey
-	if privateKey, err = ReadPrivateKey(privateKeyPath); err != nil {
-		return Profile{}, fmt.Errorf("error reading private key: %s", err)
+	var privateKey crypto.Signer
+	if privateKey, err = ReadPrivateKey(privateKeyPath, passphrase); err != nil {
+		return Profile{}, fmt.Errorf("error reading private key: %w", err)
 	}
 
 	var profile Profile
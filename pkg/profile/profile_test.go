@@ -0,0 +1,231 @@
+package profile
+
+import (
+	"crypto"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcutil/base58"
+)
+
+func generatePublicKey(t *testing.T, keyType KeyType) crypto.PublicKey {
+	t.Helper()
+	privateKey, err := GenerateKey(keyType)
+	if err != nil {
+		t.Fatalf("error generating %s key: %s", keyType, err)
+	}
+	return privateKey.Public()
+}
+
+func addressOf(t *testing.T, publicKey crypto.PublicKey) string {
+	t.Helper()
+	address, err := AddressOf(publicKey)
+	if err != nil {
+		t.Fatalf("AddressOf: %s", err)
+	}
+	return address
+}
+
+func legacyAddressOf(t *testing.T, publicKey crypto.PublicKey) string {
+	t.Helper()
+	address, err := LegacyAddressOf(publicKey)
+	if err != nil {
+		t.Fatalf("LegacyAddressOf: %s", err)
+	}
+	return address
+}
+
+// typo replaces a character in the middle of address with another base58
+// character
+func typo(address string) string {
+	i := len(address) / 2
+	replacement := "2"
+	if address[i] == '2' {
+		replacement = "3"
+	}
+	return address[:i] + replacement + address[i+1:]
+}
+
+func TestValidateAddress(t *testing.T) {
+	rsaKey := generatePublicKey(t, KeyTypeRSA)
+	ed25519Key := generatePublicKey(t, KeyTypeEd25519)
+	ed25519Hash, err := keyHash(ed25519Key)
+	if err != nil {
+		t.Fatalf("keyHash: %s", err)
+	}
+	tests := []struct {
+		name    string
+		address string
+		legacy  bool
+		// reason is a part of the error, empty if the address is valid
+		reason string
+	}{
+		{
+			name:    "rsa",
+			address: addressOf(t, rsaKey),
+		},
+		{
+			name:    "ed25519",
+			address: addressOf(t, ed25519Key),
+		},
+		{
+			name:    "legacy rsa",
+			address: legacyAddressOf(t, rsaKey),
+			legacy:  true,
+		},
+		{
+			name:    "unversioned ed25519",
+			address: base58.Encode(append([]byte{1}, ed25519Hash...)),
+			reason:  "unexpected length",
+		},
+		{
+			name:    "rsa typo",
+			address: typo(addressOf(t, rsaKey)),
+			reason:  "checksum mismatch",
+		},
+		{
+			name:    "ed25519 typo",
+			address: typo(addressOf(t, ed25519Key)),
+			reason:  "checksum mismatch",
+		},
+		{
+			name:    "empty",
+			address: "",
+			reason:  "empty",
+		},
+		{
+			name:    "not base58",
+			address: "0OIl",
+			reason:  "not a base58 string",
+		},
+		{
+			name:    "truncated",
+			address: addressOf(t, rsaKey)[:10],
+			reason:  "unexpected length",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateAddress(tt.address)
+			if tt.reason == "" {
+				if err != nil {
+					t.Fatalf("ValidateAddress: %s", err)
+				}
+				if IsLegacyAddress(tt.address) != tt.legacy {
+					t.Fatalf("IsLegacyAddress is %t, expected %t", !tt.legacy, tt.legacy)
+				}
+				return
+			}
+			if !errors.Is(err, ErrInvalidAddress) {
+				t.Fatalf("got %v, expected %s", err, ErrInvalidAddress)
+			}
+			if !strings.Contains(err.Error(), tt.reason) {
+				t.Fatalf("got %q, expected %q", err, tt.reason)
+			}
+			if IsAddress(tt.address) {
+				t.Fatalf("IsAddress accepted %q", tt.address)
+			}
+		})
+	}
+}
+
+func TestBelongsTo(t *testing.T) {
+	for _, keyType := range []KeyType{KeyTypeRSA, KeyTypeEd25519} {
+		publicKey := generatePublicKey(t, keyType)
+		otherKey := generatePublicKey(t, keyType)
+		tests := []struct {
+			name    string
+			address string
+			belongs bool
+		}{
+			{
+				name:    "address",
+				address: addressOf(t, publicKey),
+				belongs: true,
+			},
+			{
+				name:    "address of other key",
+				address: addressOf(t, otherKey),
+			},
+			{
+				name:    "typo",
+				address: typo(addressOf(t, publicKey)),
+			},
+		}
+		if keyType == KeyTypeRSA {
+			tests = append(tests, []struct {
+				name    string
+				address string
+				belongs bool
+			}{
+				{
+					name:    "legacy address",
+					address: legacyAddressOf(t, publicKey),
+					belongs: true,
+				},
+				{
+					name:    "legacy address of other key",
+					address: legacyAddressOf(t, otherKey),
+				},
+			}...)
+		}
+		for _, tt := range tests {
+			t.Run(string(keyType)+"/"+tt.name, func(t *testing.T) {
+				if BelongsTo(publicKey, tt.address) != tt.belongs {
+					t.Fatalf("BelongsTo is %t, expected %t", !tt.belongs, tt.belongs)
+				}
+			})
+		}
+	}
+}
+
+func TestVerifiedPublicKey(t *testing.T) {
+	publicKey := generatePublicKey(t, KeyTypeRSA)
+	otherKey := generatePublicKey(t, KeyTypeEd25519)
+	tests := []struct {
+		name    string
+		address string
+		key     []byte
+		valid   bool
+	}{
+		{
+			name:    "matching key",
+			address: addressOf(t, publicKey),
+			key:     MarshalPublicKey(publicKey),
+			valid:   true,
+		},
+		{
+			name:    "key of other address",
+			address: addressOf(t, publicKey),
+			key:     MarshalPublicKey(otherKey),
+		},
+		{
+			name:    "legacy address",
+			address: legacyAddressOf(t, publicKey),
+			key:     MarshalPublicKey(publicKey),
+		},
+		{
+			name:    "malformed key",
+			address: addressOf(t, publicKey),
+			key:     []byte("key"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := VerifiedPublicKey(tt.address, tt.key)
+			if tt.valid && (err != nil) {
+				t.Fatalf("VerifiedPublicKey: %s", err)
+			}
+			if !tt.valid && (err == nil) {
+				t.Fatalf("VerifiedPublicKey accepted the key")
+			}
+		})
+	}
+}
+
+func TestLegacyAddressOfEd25519(t *testing.T) {
+	if address, err := LegacyAddressOf(generatePublicKey(t, KeyTypeEd25519)); err == nil {
+		t.Fatalf("got legacy address %s of an Ed25519 key", address)
+	}
+}
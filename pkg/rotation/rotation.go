@@ -0,0 +1,133 @@
+package rotation
+
+import (
+	"crypto"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	api "github.com/aaletov/nats-chat/api/generated"
+	"github.com/aaletov/nats-chat/pkg/envelope"
+	"github.com/aaletov/nats-chat/pkg/profile"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	rotationContext = "nats-chat-rotation"
+	// Statements are kept in the profile directory, one file per old address
+	dirName   = "rotations"
+	extension = ".pb"
+)
+
+func digestParts(rmsg *api.NatsRotation) [][]byte {
+	var t [8]byte
+	binary.BigEndian.PutUint64(t[:], uint64(rmsg.Time.AsTime().UnixNano()))
+	return [][]byte{
+		t[:],
+		[]byte(rmsg.OldAddress),
+		rmsg.OldPublicKey,
+		[]byte(rmsg.NewAddress),
+		rmsg.NewPublicKey,
+	}
+}
+
+// New signs the statement that the profile moves to newKey with both the old
+// and the new key
+func New(old profile.Profile, newKey crypto.Signer) (*api.NatsRotation, error) {
+	var (
+		err        error
+		newAddress string
+	)
+	if newAddress, err = profile.AddressOf(newKey.Public()); err != nil {
+		return nil, err
+	}
+	rmsg := &api.NatsRotation{
+		Time:         timestamppb.Now(),
+		OldAddress:   old.GetAddress(),
+		OldPublicKey: profile.MarshalPublicKey(old.GetPublicKey()),
+		NewAddress:   newAddress,
+		NewPublicKey: profile.MarshalPublicKey(newKey.Public()),
+	}
+	if rmsg.OldSignature, err = envelope.SignData(old.GetPrivateKey(), rotationContext, digestParts(rmsg)...); err != nil {
+		return nil, err
+	}
+	if rmsg.NewSignature, err = envelope.SignData(newKey, rotationContext, digestParts(rmsg)...); err != nil {
+		return nil, err
+	}
+	return rmsg, nil
+}
+
+// Verify checks that the keys of the statement match its addresses and both of
+// them signed it, it returns the old and the new key
+func Verify(rmsg *api.NatsRotation) (oldKey crypto.PublicKey, newKey crypto.PublicKey, err error) {
+	if rmsg.OldAddress == rmsg.NewAddress {
+		return nil, nil, fmt.Errorf("rotation of %s to itself", rmsg.OldAddress)
+	}
+	if oldKey, err = profile.VerifiedPublicKey(rmsg.OldAddress, rmsg.OldPublicKey); err != nil {
+		return nil, nil, err
+	}
+	if newKey, err = profile.VerifiedPublicKey(rmsg.NewAddress, rmsg.NewPublicKey); err != nil {
+		return nil, nil, err
+	}
+	if err = envelope.VerifyData(oldKey, rmsg.OldSignature, rotationContext, digestParts(rmsg)...); err != nil {
+		return nil, nil, fmt.Errorf("old key: %s", err)
+	}
+	if err = envelope.VerifyData(newKey, rmsg.NewSignature, rotationContext, digestParts(rmsg)...); err != nil {
+		return nil, nil, fmt.Errorf("new key: %s", err)
+	}
+	return oldKey, newKey, nil
+}
+
+// Save keeps the statement in the profile directory
+func Save(profilePath string, rmsg *api.NatsRotation) error {
+	var (
+		err  error
+		data []byte
+	)
+	dir := filepath.Join(profilePath, dirName)
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("error creating rotations directory: %s", err)
+	}
+	if data, err = proto.Marshal(rmsg); err != nil {
+		return fmt.Errorf("error marshalling rotation: %s", err)
+	}
+	if err = os.WriteFile(filepath.Join(dir, rmsg.OldAddress+extension), data, 0600); err != nil {
+		return fmt.Errorf("error writing rotation: %s", err)
+	}
+	return nil
+}
+
+// Load returns statements kept in the profile directory ordered by time
+func Load(profilePath string) ([]*api.NatsRotation, error) {
+	dir := filepath.Join(profilePath, dirName)
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading rotations: %s", err)
+	}
+	var rotations []*api.NatsRotation
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), extension) {
+			continue
+		}
+		var data []byte
+		if data, err = os.ReadFile(filepath.Join(dir, entry.Name())); err != nil {
+			return nil, fmt.Errorf("error reading rotation: %s", err)
+		}
+		rmsg := &api.NatsRotation{}
+		if err = proto.Unmarshal(data, rmsg); err != nil {
+			return nil, fmt.Errorf("error parsing rotation %s: %s", entry.Name(), err)
+		}
+		rotations = append(rotations, rmsg)
+	}
+	sort.Slice(rotations, func(i, j int) bool {
+		return rotations[i].Time.AsTime().Before(rotations[j].Time.AsTime())
+	})
+	return rotations, nil
+}
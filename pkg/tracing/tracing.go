@@ -0,0 +1,125 @@
+// Package tracing sets up OpenTelemetry for the daemon and propagates trace
+// context between daemons in headers of nats messages
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Exporters of spans
+const (
+	ExporterNone   = "none"
+	ExporterStdout = "stdout"
+	ExporterOTLP   = "otlp"
+)
+
+// DefaultOTLPEndpoint is the traces endpoint of a local collector
+const DefaultOTLPEndpoint = "http://localhost:4318/v1/traces"
+
+const instrumentationName = "github.com/aaletov/nats-chat"
+
+var propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// Tracer returns the tracer of the daemon, spans are dropped until Setup
+// installs an exporter
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Setup installs the tracer provider exporting to exporter, endpoint is the
+// URL of the OTLP/HTTP traces endpoint. The returned function flushes the
+// remaining spans.
+func Setup(exporter string, endpoint string, service string, version string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagator)
+
+	var (
+		err error
+		exp sdktrace.SpanExporter
+	)
+	switch exporter {
+	case "", ExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case ExporterStdout:
+		if exp, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout)); err != nil {
+			return nil, fmt.Errorf("error creating stdout exporter: %s", err)
+		}
+	case ExporterOTLP:
+		if endpoint == "" {
+			endpoint = DefaultOTLPEndpoint
+		}
+		if exp, err = otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(endpoint)); err != nil {
+			return nil, fmt.Errorf("error creating otlp exporter: %s", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q, expected none, stdout or otlp", exporter)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceName(service),
+			semconv.ServiceVersion(version),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// headerCarrier adapts headers of nats messages to the propagator
+type headerCarrier nats.Header
+
+func (h headerCarrier) Get(key string) string {
+	return nats.Header(h).Get(key)
+}
+
+func (h headerCarrier) Set(key string, value string) {
+	nats.Header(h).Set(key, value)
+}
+
+func (h headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(h))
+	for key := range h {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Inject puts the trace context of ctx into the headers of msg
+func Inject(ctx context.Context, msg *nats.Msg) {
+	if msg.Header == nil {
+		msg.Header = nats.Header{}
+	}
+	propagator.Inject(ctx, headerCarrier(msg.Header))
+}
+
+// Extract returns ctx with the trace context from the headers of msg
+func Extract(ctx context.Context, msg *nats.Msg) context.Context {
+	return propagator.Extract(ctx, headerCarrier(msg.Header))
+}
+
+// Fields return the ids of the span in ctx for log lines, so they can be
+// correlated across daemons
+func Fields(ctx context.Context) logrus.Fields {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return logrus.Fields{}
+	}
+	return logrus.Fields{
+		"trace_id": sc.TraceID().String(),
+		"span_id":  sc.SpanID().String(),
+	}
+}
@@ -9,9 +9,16 @@ import time
 import docker
 import docker.models.containers as dmc 
 import socket
+import json
 
 home = os.getenv("NATS_CHAT_HOME")
 
+def readUntil(s: socket.SocketIO, text: str, limit: int = 10) -> bool:
+    for _ in range(limit):
+        if text in s.readline().decode("utf-8", errors="ignore"):
+            return True
+    return False
+
 class ComposeTestCase(unittest.TestCase):
     @staticmethod
     def getComposeFile() -> str:
@@ -66,8 +73,8 @@ class ComposeTestCase(unittest.TestCase):
             "docker",
             "volume",
             "rm",
-            "nats-chat_daemon-sock-1",
-            "nats-chat_daemon-sock-2",
+            "nats-chat_natschat-home-1",
+            "nats-chat_natschat-home-2",
         )
         subprocess.Popen(args, stdout=subprocess.DEVNULL,
                          stderr=subprocess.STDOUT).wait()
@@ -139,6 +146,35 @@ class CliTestCase(ComposeTestCase):
         finally:
             client.close()
 
+    def test_export_import(self) -> None:
+        logger = logging.getLogger("LOGGER")
+        client = docker.from_env()
+
+        try:
+            c: dmc.Container
+            c = client.containers.get("nats-chat-cli-1-1")
+            self.assertEqual(c.exec_run("nats-chat-cli generate")[0], 0)
+            code, out = c.exec_run("nats-chat-cli address")
+            self.assertEqual(code, 0)
+            addr = out.splitlines()[1].decode('utf-8')
+
+            env = {"NATS_CHAT_ARCHIVE_PASSPHRASE": "passphrase"}
+            self.assertEqual(c.exec_run("nats-chat-cli profile export /root/backup", environment=env)[0], 0)
+            self.assertNotEqual(c.exec_run("nats-chat-cli profile import /root/backup", environment=env)[0], 0)
+            self.assertNotEqual(c.exec_run("nats-chat-cli profile import --profile /root/temp /root/backup",
+                                           environment={"NATS_CHAT_ARCHIVE_PASSPHRASE": "wrong"})[0], 0)
+
+            code, out = c.exec_run("nats-chat-cli profile import --profile /root/temp /root/backup", environment=env)
+            self.assertEqual(code, 0)
+            self.assertTrue(addr in out.decode('utf-8'))
+            code, out = c.exec_run("nats-chat-cli address --profile /root/temp")
+            self.assertEqual(code, 0)
+            self.assertEqual(out.splitlines()[1].decode('utf-8'), addr)
+
+        finally:
+            client.close()
+
+
 class TestNatsChat(ComposeTestCase):
     @staticmethod
     def getComposeFile() -> str:
@@ -174,24 +210,19 @@ class TestNatsChat(ComposeTestCase):
             self.assertEqual(code2, 0)
 
             s1: socket.SocketIO            
-            code1, s1 = c1.exec_run("nats-chat-cli openchat", socket=True, stdin=True)
+            code1, s1 = c1.exec_run("nats-chat-cli openchat --recepient {addr2}".format(addr2=addr2), socket=True, stdin=True)
             self.assertTrue(code1 == None)
             s2: socket.SocketIO            
-            code2, s2 = c2.exec_run("nats-chat-cli openchat", socket=True, stdin=True)
+            code2, s2 = c2.exec_run("nats-chat-cli openchat --recepient {addr1}".format(addr1=addr1), socket=True, stdin=True)
             self.assertTrue(code2 == None)
         
             try:
                 s1._sock.send(b"I did not hit her\n")
                 s2._sock.send(b"Oh, hi Mark!\n")
 
-                s1.readline()
-                out1 = s1.readline().decode("utf-8")
-
-                s2.readline()   
-                out2 = s2.readline().decode("utf-8")
-
-                self.assertTrue("Oh, hi Mark!" in out1)
-                self.assertTrue("I did not hit her" in out2)
+                self.assertTrue(readUntil(s1, "Oh, hi Mark!"))
+                self.assertTrue(readUntil(s2, "I did not hit her"))
+                self.assertTrue(readUntil(s1, "read: I did not hit her"))
             finally:
                 s1.close()
                 s2.close()
@@ -209,6 +240,417 @@ class TestNatsChat(ComposeTestCase):
         finally:
             client.close()
 
+    def test_offline_message(self) -> None:
+        logger = logging.getLogger("LOGGER")
+        client = docker.from_env()
+
+        try:
+            c1: dmc.Container
+            c1 = client.containers.get("nats-chat-cli-1-1")
+            c2: dmc.Container
+            c2 = client.containers.get("nats-chat-cli-2-1")
+            self.assertEqual(c1.exec_run("nats-chat-cli generate")[0], 0)
+            self.assertEqual(c2.exec_run("nats-chat-cli generate")[0], 0)
+
+            code1, out1 = c1.exec_run("nats-chat-cli address")
+            addr1 = out1.splitlines()[1].decode('utf-8')
+            self.assertEqual(code1, 0)
+            code2, out2 = c2.exec_run("nats-chat-cli address")
+            addr2 = out2.splitlines()[1].decode('utf-8')
+            self.assertEqual(code2, 0)
+
+            online = "nats-chat-cli online --jetstream --nats-url \"nats://nats:4444\""
+            self.assertEqual(c1.exec_run(online)[0], 0)
+            self.assertEqual(c2.exec_run(online)[0], 0)
+
+            code1, out1 = c1.exec_run("nats-chat-cli createchat --recepient {addr2}".format(addr2=addr2))
+            self.assertEqual(code1, 0)
+            code2, out2 = c2.exec_run("nats-chat-cli createchat --recepient {addr1}".format(addr1=addr1))
+            self.assertEqual(code2, 0)
+            self.assertEqual(c2.exec_run("nats-chat-cli offline")[0], 0)
+
+            s1: socket.SocketIO
+            code1, s1 = c1.exec_run("nats-chat-cli openchat --recepient {addr2}".format(addr2=addr2), socket=True, stdin=True)
+            self.assertTrue(code1 == None)
+            try:
+                s1._sock.send(b"Are you there?\n")
+                time.sleep(1)
+            finally:
+                s1.close()
+
+            self.assertEqual(c2.exec_run(online)[0], 0)
+            code2, out2 = c2.exec_run("nats-chat-cli createchat --recepient {addr1}".format(addr1=addr1))
+            self.assertEqual(code2, 0)
+
+            s2: socket.SocketIO
+            code2, s2 = c2.exec_run("nats-chat-cli openchat --recepient {addr1}".format(addr1=addr1), socket=True, stdin=True)
+            self.assertTrue(code2 == None)
+            try:
+                s2.readline()
+                out2 = s2.readline().decode("utf-8")
+                self.assertTrue("Are you there?" in out2)
+            finally:
+                s2.close()
+
+            self.assertEqual(c1.exec_run("nats-chat-cli offline")[0], 0)
+            self.assertEqual(c2.exec_run("nats-chat-cli offline")[0], 0)
+
+        finally:
+            client.close()
+
+    def test_room_message(self) -> None:
+        logger = logging.getLogger("LOGGER")
+        client = docker.from_env()
+
+        try:
+            c1: dmc.Container
+            c1 = client.containers.get("nats-chat-cli-1-1")
+            c2: dmc.Container
+            c2 = client.containers.get("nats-chat-cli-2-1")
+            self.assertEqual(c1.exec_run("nats-chat-cli generate")[0], 0)
+            self.assertEqual(c2.exec_run("nats-chat-cli generate")[0], 0)
+
+            code2, out2 = c2.exec_run("nats-chat-cli address")
+            addr2 = out2.splitlines()[1].decode('utf-8')
+            self.assertEqual(code2, 0)
+
+            self.assertEqual(c1.exec_run("nats-chat-cli online --nats-url \"nats://nats:4444\"")[0], 0)
+            self.assertEqual(c2.exec_run("nats-chat-cli online --nats-url \"nats://nats:4444\"")[0], 0)
+
+            code1, out1 = c1.exec_run("nats-chat-cli createroom --name test")
+            self.assertEqual(code1, 0)
+            room = out1.splitlines()[-1].decode('utf-8')
+            code1, out1 = c1.exec_run("nats-chat-cli invite --room {room} --member {addr2}".format(room=room, addr2=addr2))
+            self.assertEqual(code1, 0)
+            time.sleep(1)
+
+            code2, out2 = c2.exec_run("nats-chat-cli rooms")
+            self.assertEqual(code2, 0)
+            self.assertTrue(room in out2.decode('utf-8'))
+
+            s1: socket.SocketIO
+            code1, s1 = c1.exec_run("nats-chat-cli openchat --room {room}".format(room=room), socket=True, stdin=True)
+            self.assertTrue(code1 == None)
+            s2: socket.SocketIO
+            code2, s2 = c2.exec_run("nats-chat-cli openchat --room {room}".format(room=room), socket=True, stdin=True)
+            self.assertTrue(code2 == None)
+
+            try:
+                time.sleep(1)
+                s1._sock.send(b"Welcome to the room\n")
+
+                s2.readline()
+                out2 = s2.readline().decode("utf-8")
+                self.assertTrue("Welcome to the room" in out2)
+            finally:
+                s1.close()
+                s2.close()
+
+            self.assertEqual(c2.exec_run("nats-chat-cli leaveroom --room {room}".format(room=room))[0], 0)
+            self.assertEqual(c1.exec_run("nats-chat-cli offline")[0], 0)
+            self.assertEqual(c2.exec_run("nats-chat-cli offline")[0], 0)
+
+        finally:
+            client.close()
+
+    def test_send_file(self) -> None:
+        logger = logging.getLogger("LOGGER")
+        client = docker.from_env()
+
+        try:
+            c1: dmc.Container
+            c1 = client.containers.get("nats-chat-cli-1-1")
+            c2: dmc.Container
+            c2 = client.containers.get("nats-chat-cli-2-1")
+            self.assertEqual(c1.exec_run("nats-chat-cli generate")[0], 0)
+            self.assertEqual(c2.exec_run("nats-chat-cli generate")[0], 0)
+
+            code1, out1 = c1.exec_run("nats-chat-cli address")
+            addr1 = out1.splitlines()[1].decode('utf-8')
+            self.assertEqual(code1, 0)
+            code2, out2 = c2.exec_run("nats-chat-cli address")
+            addr2 = out2.splitlines()[1].decode('utf-8')
+            self.assertEqual(code2, 0)
+
+            self.assertEqual(c1.exec_run("nats-chat-cli online --nats-url \"nats://nats:4444\"")[0], 0)
+            self.assertEqual(c2.exec_run("nats-chat-cli online --nats-url \"nats://nats:4444\"")[0], 0)
+            self.assertEqual(c1.exec_run("nats-chat-cli createchat --recepient {addr2}".format(addr2=addr2))[0], 0)
+            self.assertEqual(c2.exec_run("nats-chat-cli createchat --recepient {addr1}".format(addr1=addr1))[0], 0)
+
+            self.assertEqual(c1.exec_run("sh -c 'echo You are tearing me apart > /root/lisa.txt'")[0], 0)
+            s2: socket.SocketIO
+            code2, s2 = c2.exec_run("nats-chat-cli receive --yes", socket=True, stdin=True)
+            self.assertTrue(code2 == None)
+            try:
+                code1, out1 = c1.exec_run("nats-chat-cli sendfile --recepient {addr2} /root/lisa.txt".format(addr2=addr2))
+                self.assertEqual(code1, 0)
+                self.assertTrue("lisa.txt sent" in out1.decode('utf-8'))
+                self.assertTrue(readUntil(s2, "saved to"))
+            finally:
+                s2.close()
+
+            code2, out2 = c2.exec_run("cat /root/.natschat/downloads/lisa.txt")
+            self.assertEqual(code2, 0)
+            self.assertTrue("You are tearing me apart" in out2.decode('utf-8'))
+
+            self.assertEqual(c1.exec_run("nats-chat-cli offline")[0], 0)
+            self.assertEqual(c2.exec_run("nats-chat-cli offline")[0], 0)
+
+        finally:
+            client.close()
+
+    def test_rotate(self) -> None:
+        logger = logging.getLogger("LOGGER")
+        client = docker.from_env()
+
+        try:
+            c1: dmc.Container
+            c1 = client.containers.get("nats-chat-cli-1-1")
+            c2: dmc.Container
+            c2 = client.containers.get("nats-chat-cli-2-1")
+            self.assertEqual(c1.exec_run("nats-chat-cli generate")[0], 0)
+            self.assertEqual(c2.exec_run("nats-chat-cli generate")[0], 0)
+
+            code2, out2 = c2.exec_run("nats-chat-cli address")
+            addr2 = out2.splitlines()[1].decode('utf-8')
+            self.assertEqual(code2, 0)
+
+            self.assertEqual(c1.exec_run("nats-chat-cli contact add --name bob --address {addr2}".format(addr2=addr2))[0], 0)
+            self.assertEqual(c1.exec_run("nats-chat-cli online --nats-url \"nats://nats:4444\"")[0], 0)
+
+            code2, out2 = c2.exec_run("nats-chat-cli rotate")
+            self.assertEqual(code2, 0)
+            newAddr2 = out2.decode('utf-8').splitlines()[-2]
+            self.assertNotEqual(newAddr2, addr2)
+            self.assertEqual(c2.exec_run("nats-chat-cli online --nats-url \"nats://nats:4444\"")[0], 0)
+            time.sleep(1)
+
+            code1, out1 = c1.exec_run("nats-chat-cli contact list")
+            self.assertEqual(code1, 0)
+            self.assertTrue(newAddr2 in out1.decode('utf-8'))
+
+            self.assertEqual(c1.exec_run("nats-chat-cli offline")[0], 0)
+            self.assertEqual(c2.exec_run("nats-chat-cli offline")[0], 0)
+
+        finally:
+            client.close()
+
+    def test_reconnect(self) -> None:
+        logger = logging.getLogger("LOGGER")
+        client = docker.from_env()
+
+        try:
+            nats: dmc.Container
+            nats = client.containers.get("nats-chat-nats-1")
+            c1: dmc.Container
+            c1 = client.containers.get("nats-chat-cli-1-1")
+            c2: dmc.Container
+            c2 = client.containers.get("nats-chat-cli-2-1")
+            self.assertEqual(c1.exec_run("nats-chat-cli generate")[0], 0)
+            self.assertEqual(c2.exec_run("nats-chat-cli generate")[0], 0)
+
+            code1, out1 = c1.exec_run("nats-chat-cli address")
+            addr1 = out1.splitlines()[1].decode('utf-8')
+            self.assertEqual(code1, 0)
+            code2, out2 = c2.exec_run("nats-chat-cli address")
+            addr2 = out2.splitlines()[1].decode('utf-8')
+            self.assertEqual(code2, 0)
+
+            online = "nats-chat-cli online --jetstream --reconnect-wait 500ms --nats-url \"nats://nats:4444\""
+            self.assertEqual(c1.exec_run(online)[0], 0)
+            self.assertEqual(c2.exec_run(online)[0], 0)
+
+            self.assertEqual(c1.exec_run("nats-chat-cli createchat --recepient {addr2}".format(addr2=addr2))[0], 0)
+            self.assertEqual(c2.exec_run("nats-chat-cli createchat --recepient {addr1}".format(addr1=addr1))[0], 0)
+
+            s1: socket.SocketIO
+            code1, s1 = c1.exec_run("nats-chat-cli openchat --recepient {addr2}".format(addr2=addr2), socket=True, stdin=True)
+            self.assertTrue(code1 == None)
+            s2: socket.SocketIO
+            code2, s2 = c2.exec_run("nats-chat-cli openchat --recepient {addr1}".format(addr1=addr1), socket=True, stdin=True)
+            self.assertTrue(code2 == None)
+
+            try:
+                nats.restart(timeout=1)
+                self.assertTrue(readUntil(s1, "connection to nats lost"))
+                self.assertTrue(readUntil(s1, "reconnected to nats"))
+
+                s1._sock.send(b"Still there?\n")
+                self.assertTrue(readUntil(s2, "Still there?"))
+            finally:
+                s1.close()
+                s2.close()
+
+            self.assertEqual(c1.exec_run("nats-chat-cli offline")[0], 0)
+            self.assertEqual(c2.exec_run("nats-chat-cli offline")[0], 0)
+
+        finally:
+            client.close()
+
+    def test_status(self) -> None:
+        logger = logging.getLogger("LOGGER")
+        client = docker.from_env()
+
+        try:
+            c1: dmc.Container
+            c1 = client.containers.get("nats-chat-cli-1-1")
+            c2: dmc.Container
+            c2 = client.containers.get("nats-chat-cli-2-1")
+            self.assertEqual(c1.exec_run("nats-chat-cli generate")[0], 0)
+            self.assertEqual(c2.exec_run("nats-chat-cli generate")[0], 0)
+
+            code1, out1 = c1.exec_run("nats-chat-cli address")
+            addr1 = out1.splitlines()[1].decode('utf-8')
+            self.assertEqual(code1, 0)
+            code2, out2 = c2.exec_run("nats-chat-cli address")
+            addr2 = out2.splitlines()[1].decode('utf-8')
+            self.assertEqual(code2, 0)
+
+            code1, out1 = c1.exec_run("nats-chat-cli status")
+            self.assertEqual(code1, 0)
+            self.assertTrue("offline" in out1.decode('utf-8'))
+            code1, out1 = c1.exec_run("nats-chat-cli createchat --recepient {addr2}".format(addr2=addr2))
+            self.assertNotEqual(code1, 0)
+            self.assertTrue("FailedPrecondition" in out1.decode('utf-8'))
+
+            self.assertEqual(c1.exec_run("nats-chat-cli online --nats-url \"nats://nats:4444\"")[0], 0)
+            self.assertEqual(c2.exec_run("nats-chat-cli online --nats-url \"nats://nats:4444\"")[0], 0)
+            self.assertEqual(c1.exec_run("nats-chat-cli createchat --recepient {addr2}".format(addr2=addr2))[0], 0)
+            self.assertEqual(c2.exec_run("nats-chat-cli createchat --recepient {addr1}".format(addr1=addr1))[0], 0)
+
+            code1, out1 = c1.exec_run("nats-chat-cli status")
+            self.assertEqual(code1, 0)
+            status = out1.decode('utf-8')
+            self.assertTrue("online as {addr1}".format(addr1=addr1) in status)
+            self.assertTrue("nats CONNECTED" in status)
+            self.assertTrue("chats: 1" in status)
+            self.assertTrue(addr2 in status)
+
+            self.assertEqual(c1.exec_run("nats-chat-cli offline")[0], 0)
+            self.assertEqual(c2.exec_run("nats-chat-cli offline")[0], 0)
+
+        finally:
+            client.close()
+
+    def test_metrics(self) -> None:
+        logger = logging.getLogger("LOGGER")
+        client = docker.from_env()
+
+        try:
+            c1: dmc.Container
+            c1 = client.containers.get("nats-chat-cli-1-1")
+            c2: dmc.Container
+            c2 = client.containers.get("nats-chat-cli-2-1")
+            self.assertEqual(c1.exec_run("nats-chat-cli generate")[0], 0)
+            self.assertEqual(c2.exec_run("nats-chat-cli generate")[0], 0)
+
+            code1, out1 = c1.exec_run("nats-chat-cli address")
+            addr1 = out1.splitlines()[1].decode('utf-8')
+            self.assertEqual(code1, 0)
+            code2, out2 = c2.exec_run("nats-chat-cli address")
+            addr2 = out2.splitlines()[1].decode('utf-8')
+            self.assertEqual(code2, 0)
+
+            self.assertEqual(c1.exec_run("nats-chat-cli online --nats-url \"nats://nats:4444\"")[0], 0)
+            self.assertEqual(c2.exec_run("nats-chat-cli online --nats-url \"nats://nats:4444\"")[0], 0)
+            self.assertEqual(c1.exec_run("nats-chat-cli createchat --recepient {addr2}".format(addr2=addr2))[0], 0)
+            self.assertEqual(c2.exec_run("nats-chat-cli createchat --recepient {addr1}".format(addr1=addr1))[0], 0)
+
+            s1: socket.SocketIO
+            code1, s1 = c1.exec_run("nats-chat-cli openchat --recepient {addr2}".format(addr2=addr2), socket=True, stdin=True)
+            self.assertTrue(code1 == None)
+            s2: socket.SocketIO
+            code2, s2 = c2.exec_run("nats-chat-cli openchat --recepient {addr1}".format(addr1=addr1), socket=True, stdin=True)
+            self.assertTrue(code2 == None)
+
+            try:
+                s1._sock.send(b"I did not hit her\n")
+                s2._sock.send(b"Oh, hi Mark!\n")
+                self.assertTrue(readUntil(s1, "Oh, hi Mark!"))
+                self.assertTrue(readUntil(s2, "I did not hit her"))
+
+                code1, out1 = c1.exec_run("wget -q -O - http://daemon-1:9090/metrics")
+                self.assertEqual(code1, 0)
+                metrics = out1.decode('utf-8')
+                self.assertTrue("natschat_messages_sent_total{{chat=\"{addr2}\"}} 1".format(addr2=addr2) in metrics)
+                self.assertTrue("natschat_messages_received_total{{chat=\"{addr2}\"}} 1".format(addr2=addr2) in metrics)
+                self.assertTrue("natschat_dial_duration_seconds_count{result=\"ok\"} 1" in metrics)
+                self.assertTrue("natschat_grpc_active_streams{method=\"/api.Daemon/Send\"} 1" in metrics)
+            finally:
+                s1.close()
+                s2.close()
+
+            self.assertEqual(c1.exec_run("nats-chat-cli offline")[0], 0)
+            self.assertEqual(c2.exec_run("nats-chat-cli offline")[0], 0)
+        finally:
+            client.close()
+
+    def test_tracing(self) -> None:
+        logger = logging.getLogger("LOGGER")
+        client = docker.from_env()
+
+        try:
+            c1: dmc.Container
+            c1 = client.containers.get("nats-chat-cli-1-1")
+            c2: dmc.Container
+            c2 = client.containers.get("nats-chat-cli-2-1")
+            d1: dmc.Container
+            d1 = client.containers.get("nats-chat-daemon-1-1")
+            d2: dmc.Container
+            d2 = client.containers.get("nats-chat-daemon-2-1")
+            self.assertEqual(c1.exec_run("nats-chat-cli generate")[0], 0)
+            self.assertEqual(c2.exec_run("nats-chat-cli generate")[0], 0)
+
+            code1, out1 = c1.exec_run("nats-chat-cli address")
+            addr1 = out1.splitlines()[1].decode('utf-8')
+            self.assertEqual(code1, 0)
+            code2, out2 = c2.exec_run("nats-chat-cli address")
+            addr2 = out2.splitlines()[1].decode('utf-8')
+            self.assertEqual(code2, 0)
+
+            self.assertEqual(c1.exec_run("nats-chat-cli online --nats-url \"nats://nats:4444\"")[0], 0)
+            self.assertEqual(c2.exec_run("nats-chat-cli online --nats-url \"nats://nats:4444\"")[0], 0)
+            self.assertEqual(c1.exec_run("nats-chat-cli createchat --recepient {addr2}".format(addr2=addr2))[0], 0)
+            self.assertEqual(c2.exec_run("nats-chat-cli createchat --recepient {addr1}".format(addr1=addr1))[0], 0)
+
+            s1: socket.SocketIO
+            code1, s1 = c1.exec_run("nats-chat-cli openchat --recepient {addr2}".format(addr2=addr2), socket=True, stdin=True)
+            self.assertTrue(code1 == None)
+            s2: socket.SocketIO
+            code2, s2 = c2.exec_run("nats-chat-cli openchat --recepient {addr1}".format(addr1=addr1), socket=True, stdin=True)
+            self.assertTrue(code2 == None)
+
+            try:
+                s2._sock.send(b"Oh, hi Mark!\n")
+                self.assertTrue(readUntil(s1, "Oh, hi Mark!"))
+            finally:
+                s1.close()
+                s2.close()
+
+            # Spans are exported in batches every 5 seconds
+            time.sleep(6)
+            def spans(d: dmc.Container) -> Dict[str, str]:
+                decoder = json.JSONDecoder()
+                out = d.logs(stderr=False).decode('utf-8')
+                found = {}
+                i = out.find("{")
+                while i >= 0:
+                    span, end = decoder.raw_decode(out, i)
+                    found[span["Name"]] = span["SpanContext"]["TraceID"]
+                    i = out.find("{", end)
+                return found
+            sent = spans(d2)
+            received = spans(d1)
+            self.assertTrue("Send" in sent)
+            self.assertEqual(sent["Send"], sent["nats.publish"])
+            self.assertEqual(sent["Send"], received["nats.receive"])
+            self.assertEqual(sent["Send"], received["deliver"])
+
+            self.assertEqual(c1.exec_run("nats-chat-cli offline")[0], 0)
+            self.assertEqual(c2.exec_run("nats-chat-cli offline")[0], 0)
+        finally:
+            client.close()
+
 if __name__ == '__main__':
     logging.basicConfig(stream=sys.stderr)
     logging.getLogger("LOGGER").setLevel(logging.DEBUG)